@@ -6,8 +6,17 @@ import (
 	"github.com/loqutus/rws/pkg/client/conf"
 	"github.com/loqutus/rws/pkg/client/containers"
 	"github.com/loqutus/rws/pkg/client/hosts"
+	"github.com/loqutus/rws/pkg/client/images"
+	"github.com/loqutus/rws/pkg/client/ingress"
+	"github.com/loqutus/rws/pkg/client/manifests"
 	"github.com/loqutus/rws/pkg/client/pods"
+	"github.com/loqutus/rws/pkg/client/quotas"
+	"github.com/loqutus/rws/pkg/client/registries"
+	"github.com/loqutus/rws/pkg/client/secrets"
+	"github.com/loqutus/rws/pkg/client/services"
 	"github.com/loqutus/rws/pkg/client/storage"
+	"github.com/loqutus/rws/pkg/client/top"
+	"os"
 	"strings"
 )
 
@@ -16,41 +25,339 @@ var HostName = conf.HostName
 func main() {
 	// client --type storage --action upload --name file
 	// client --type storage --action list
-	var action, name, image, cmd string
-	var cores, disk, memory, count, port uint64
+	var action, name, image, cmd, namespace, owner, portsSpec string
+	var envSpec, secretEnvSpec, secretFileSpec, dataSpec, volumesSpec string
+	var tail, since, livenessSpec, readinessSpec string
+	var restartSpec, stopSignal, postStartSpec, preStopSpec string
+	var pullPolicy, registry, server, username, password, hostsSpec string
+	var phase, dnsPolicy string
+	var labelsSpec, selectorSpec, podName, servicePortsSpec, balancer string
+	var rulesSpec, tlsSecret string
+	var src, dst, manifestFile string
+	var stopTimeout uint64
+	var timestamps, follow, withStorage bool
+	var cores, disk, memory, count, port, storageBytes, containersLimit uint64
+	var coresLimit, diskLimit, memoryLimit uint64
 	flag.StringVar(&action, "action", "", conf.Actions)
 	flag.StringVar(&image, "image", "", "redis or mysql")
 	flag.StringVar(&name, "name", "", "container/file/host name")
 	flag.Uint64Var(&port, "port", 0, "host port")
 	flag.Uint64Var(&cores, "cores", 1, "cores for each container in Pod")
 	flag.Uint64Var(&disk, "disk", 1, "disk for each container in Pod")
-	flag.Uint64Var(&memory, "memory", 1, "memory for each container in Pod")
+	flag.Uint64Var(&memory, "memory", 0, "memory in bytes for each container in Pod, 0 for no request")
 	flag.Uint64Var(&count, "count", 1, "containers cound in Pod")
+	flag.Uint64Var(&coresLimit, "cores-limit", 0, "cores limit for each container, defaults to --cores")
+	flag.Uint64Var(&diskLimit, "disk-limit", 0, "disk limit for each container, not set by default")
+	flag.Uint64Var(&memoryLimit, "memory-limit", 0, "memory limit for each container, defaults to --memory if it is at least 6MiB")
 	flag.StringVar(&cmd, "cmd", "", "command to run in container")
+	flag.StringVar(&portsSpec, "ports", "", "ports to publish, [hostPort:]containerPort[/tcp|udp],...")
+	flag.StringVar(&envSpec, "env", "", "container environment, NAME=value,...")
+	flag.StringVar(&secretEnvSpec, "secret-env", "", "secrets as environment, NAME=secret/key,...")
+	flag.StringVar(&secretFileSpec, "secret-file", "", "secrets as files, /path=secret/key,...")
+	flag.StringVar(&volumesSpec, "volumes", "", "storage files to mount, file:/path[:ro],...")
+	flag.StringVar(&livenessSpec, "liveness", "", "liveness probe, http:port/path, tcp:port or exec:cmd, options ,delay=N,period=N,timeout=N,success=N,failure=N")
+	flag.StringVar(&readinessSpec, "readiness", "", "readiness probe, same format as --liveness")
+	flag.StringVar(&restartSpec, "restart", "", "restart policy, always, on-failure[:max retries] or never")
+	flag.StringVar(&stopSignal, "stop-signal", "", "signal sent to stop the container, SIGTERM by default")
+	flag.Uint64Var(&stopTimeout, "stop-timeout", 0, "seconds to wait after the stop signal before killing the container")
+	flag.StringVar(&postStartSpec, "post-start", "", "hook run after start, http:port/path or exec:cmd")
+	flag.StringVar(&preStopSpec, "pre-stop", "", "hook run before stop, http:port/path or exec:cmd")
+	flag.StringVar(&pullPolicy, "pull-policy", "", "image pull policy, always, if-not-present or never")
+	flag.StringVar(&registry, "registry", "", "registry credential used to pull the image")
+	flag.StringVar(&server, "server", "", "registry server address")
+	flag.StringVar(&username, "username", "", "registry username")
+	flag.StringVar(&password, "password", "", "registry password")
+	flag.StringVar(&hostsSpec, "hosts", "", "hosts to pull the image on, host,..., all hosts by default")
+	flag.StringVar(&dnsPolicy, "dns-policy", "", "resolve names with the rws DNS, cluster, or with the runtime's, host")
+	flag.StringVar(&labelsSpec, "labels", "", "pod labels, key=value,...")
+	flag.StringVar(&podName, "pod", "", "pod the service proxies to")
+	flag.StringVar(&selectorSpec, "selector", "", "labels of the pods the service proxies to, key=value,...")
+	flag.StringVar(&servicePortsSpec, "service-ports", "", "service ports, [port:]containerPort[/tcp|http],...")
+	flag.StringVar(&balancer, "balancer", "", "service balancer, round-robin or least-connections")
+	flag.StringVar(&rulesSpec, "rules", "", "ingress rules, [host]/path=pod:containerPort,...")
+	flag.StringVar(&tlsSecret, "tls-secret", "", "secret with tls.crt and tls.key for the hosts of the ingress rules")
+	flag.StringVar(&phase, "phase", "", "pod_list phase filter, Pending, Running or Failed")
+	flag.StringVar(&dataSpec, "data", "", "secret data, key=value,...")
+	flag.StringVar(&namespace, "namespace", "", "namespace of pod, file or quota")
+	flag.StringVar(&owner, "owner", "", "owner of pod, file or quota")
+	flag.Uint64Var(&storageBytes, "storage", 0, "storage bytes for quota")
+	flag.Uint64Var(&containersLimit, "containers", 0, "containers count for quota")
+	flag.StringVar(&tail, "tail", "all", "number of log lines to show")
+	flag.StringVar(&since, "since", "", "show logs since timestamp or relative time like 10m")
+	flag.BoolVar(&timestamps, "timestamps", false, "show log timestamps")
+	flag.BoolVar(&follow, "follow", false, "follow log output")
+	flag.StringVar(&src, "src", "", "container_cp source, container:path or a local path")
+	flag.StringVar(&dst, "dst", "", "container_cp destination, container:path or a local path")
+	flag.BoolVar(&withStorage, "cp-storage", false, "container_cp to or from a storage file instead of a local path")
+	flag.StringVar(&manifestFile, "f", "", "manifest file for apply, delete and diff, YAML or JSON, - for stdin")
 	flag.StringVar(&HostName, "hostname", "http://localhost:8888", "hostname to connect to")
 	flag.Parse()
+	ports, err := containers.ParsePorts(portsSpec)
+	if err != nil {
+		fmt.Println(err)
+		panic("bad --ports")
+	}
+	env, err := containers.ParseEnv(envSpec)
+	if err != nil {
+		fmt.Println(err)
+		panic("bad --env")
+	}
+	secretRefs, err := containers.ParseSecretRefs(secretEnvSpec, secretFileSpec)
+	if err != nil {
+		fmt.Println(err)
+		panic("bad --secret-env or --secret-file")
+	}
+	volumes, err := containers.ParseVolumes(volumesSpec)
+	if err != nil {
+		fmt.Println(err)
+		panic("bad --volumes")
+	}
+	liveness, err := containers.ParseProbe(livenessSpec)
+	if err != nil {
+		fmt.Println(err)
+		panic("bad --liveness")
+	}
+	readiness, err := containers.ParseProbe(readinessSpec)
+	if err != nil {
+		fmt.Println(err)
+		panic("bad --readiness")
+	}
+	restartPolicy, err := containers.ParseRestartPolicy(restartSpec)
+	if err != nil {
+		fmt.Println(err)
+		panic("bad --restart")
+	}
+	postStart, err := containers.ParseProbe(postStartSpec)
+	if err != nil {
+		fmt.Println(err)
+		panic("bad --post-start")
+	}
+	preStop, err := containers.ParseProbe(preStopSpec)
+	if err != nil {
+		fmt.Println(err)
+		panic("bad --pre-stop")
+	}
+	labels, err := containers.ParseEnv(labelsSpec)
+	if err != nil {
+		fmt.Println(err)
+		panic("bad --labels")
+	}
+	var lifecycle *containers.Lifecycle
+	if postStart != nil || preStop != nil {
+		lifecycle = &containers.Lifecycle{PostStart: postStart, PreStop: preStop}
+	}
 	switch action {
 	case "storage_upload", "storage_download", "storage_remove", "storage_list", "storage_list_all":
-		if name != "" && action != "storage_list" && action != "storage_list_all" {
+		if name != "" && action == "storage_upload" && (namespace != "" || owner != "") {
+			s, err := storage.UploadOwned(name, namespace, owner)
+			if err != nil {
+				fmt.Println(err)
+				panic("storage upload failed")
+			}
+			fmt.Println(s)
+		} else if name != "" && action != "storage_list" && action != "storage_list_all" {
 			storage.Storage(action, name)
 		} else if name == "" && action == "storage_list" {
 			storage.Storage(action, "")
 		} else {
 			panic("file name required")
 		}
-	case "container_run", "container_stop", "container_list", "container_list_local", "container_remove":
+	case "container_run", "container_stop", "container_list", "container_list_local", "container_remove", "container_stats":
 		cmds := strings.Split(cmd, " ")
-		r := containers.ContainerAction(action, image, name, cmds)
+		var c = containers.Container{
+			Image:              image,
+			Name:               name,
+			Disk:               disk,
+			Memory:             memory,
+			Cores:              cores,
+			Cmd:                cmds,
+			Namespace:          namespace,
+			Owner:              owner,
+			CoresLimit:         coresLimit,
+			MemoryLimit:        memoryLimit,
+			DiskLimit:          diskLimit,
+			Ports:              ports,
+			Env:                env,
+			Secrets:            secretRefs,
+			Volumes:            volumes,
+			Liveness:           liveness,
+			Readiness:          readiness,
+			RestartPolicy:      restartPolicy,
+			StopSignal:         stopSignal,
+			StopTimeout:        stopTimeout,
+			Lifecycle:          lifecycle,
+			ImagePullPolicy:    pullPolicy,
+			RegistryCredential: registry,
+			DNSPolicy:          dnsPolicy,
+		}
+		r := containers.ContainerSpecAction(action, c)
 		fmt.Println(r)
-	case "host_add", "host_remove", "host_list", "host_info":
+	case "container_exec":
+		code, err := containers.Exec(name, strings.Split(cmd, " "))
+		if err != nil {
+			fmt.Println(err)
+			panic("exec error")
+		}
+		os.Exit(code)
+	case "container_cp":
+		err := containers.Copy(src, dst, withStorage)
+		if err != nil {
+			fmt.Println(err)
+			panic("copy error")
+		}
+	case "container_logs", "pod_logs":
+		req := containers.LogsRequest{
+			Name:       name,
+			Tail:       tail,
+			Since:      since,
+			Timestamps: timestamps,
+			Follow:     follow,
+		}
+		err := containers.LogsAction(action, req, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			panic("logs error")
+		}
+	case "host_add", "host_remove", "host_list", "host_info", "host_stats":
 		r := hosts.HostsAction(action, name, port)
 		fmt.Println(r)
+	case "top":
+		err := top.PrintTop(os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			panic("top error")
+		}
 	case "pod_add", "pod_stop", "pod_remove", "pod_list":
-		var c []containers.Container
 		cmds := strings.Split(cmd, " ")
-		var pod = pods.Pod{name, image, count, cores, memory, disk, cmds, c}
+		var pod = pods.Pod{
+			Name:               name,
+			Image:              image,
+			Count:              count,
+			Cores:              cores,
+			Memory:             memory,
+			Disk:               disk,
+			Cmd:                cmds,
+			Namespace:          namespace,
+			Owner:              owner,
+			CoresLimit:         coresLimit,
+			MemoryLimit:        memoryLimit,
+			DiskLimit:          diskLimit,
+			Ports:              ports,
+			Env:                env,
+			Secrets:            secretRefs,
+			Volumes:            volumes,
+			Liveness:           liveness,
+			Readiness:          readiness,
+			RestartPolicy:      restartPolicy,
+			StopSignal:         stopSignal,
+			StopTimeout:        stopTimeout,
+			Lifecycle:          lifecycle,
+			ImagePullPolicy:    pullPolicy,
+			RegistryCredential: registry,
+			DNSPolicy:          dnsPolicy,
+			Labels:             labels,
+		}
+		if phase != "" {
+			pod.Status = &pods.PodStatus{Phase: phase}
+		}
 		r := pods.PodsAction(action, pod)
 		fmt.Println(r)
+	case "quota_add", "quota_remove", "quota_list", "quota_usage":
+		var quota = quotas.Quota{
+			Name:       name,
+			Namespace:  namespace,
+			Owner:      owner,
+			Cores:      cores,
+			Memory:     memory,
+			Disk:       disk,
+			Containers: containersLimit,
+			Storage:    storageBytes,
+		}
+		r := quotas.QuotasAction(action, quota)
+		fmt.Println(r)
+	case "secret_add", "secret_remove", "secret_list":
+		data, err := containers.ParseEnv(dataSpec)
+		if err != nil {
+			fmt.Println(err)
+			panic("bad --data")
+		}
+		var secret = secrets.Secret{
+			Name:      name,
+			Namespace: namespace,
+			Data:      data,
+		}
+		r := secrets.SecretsAction(action, secret)
+		fmt.Println(r)
+	case "registry_add", "registry_remove", "registry_list":
+		var reg = registries.Registry{
+			Name:      name,
+			Namespace: namespace,
+			Server:    server,
+			Username:  username,
+			Password:  password,
+		}
+		r := registries.RegistriesAction(action, reg)
+		fmt.Println(r)
+	case "service_add", "service_remove", "service_list":
+		selector, err := containers.ParseEnv(selectorSpec)
+		if err != nil {
+			fmt.Println(err)
+			panic("bad --selector")
+		}
+		servicePorts, err := services.ParseServicePorts(servicePortsSpec)
+		if err != nil {
+			fmt.Println(err)
+			panic("bad --service-ports")
+		}
+		var s = services.Service{
+			Name:      name,
+			Namespace: namespace,
+			Owner:     owner,
+			Pod:       podName,
+			Selector:  selector,
+			Ports:     servicePorts,
+			Balancer:  balancer,
+		}
+		r := services.ServicesAction(action, s)
+		fmt.Println(r)
+	case "ingress_add", "ingress_remove", "ingress_list":
+		rules, err := ingress.ParseRules(rulesSpec)
+		if err != nil {
+			fmt.Println(err)
+			panic("bad --rules")
+		}
+		var ing = ingress.Ingress{
+			Name:      name,
+			Namespace: namespace,
+			Owner:     owner,
+			Rules:     rules,
+			Balancer:  balancer,
+		}
+		if tlsSecret != "" {
+			ing.TLS = []ingress.TLS{{Hosts: ingress.RuleHosts(rules), Secret: tlsSecret}}
+		}
+		r := ingress.IngressAction(action, ing)
+		fmt.Println(r)
+	case "image_list", "image_pull":
+		var req = images.PullRequest{
+			Image:              image,
+			Namespace:          namespace,
+			RegistryCredential: registry,
+		}
+		if hostsSpec != "" {
+			req.Hosts = strings.Split(hostsSpec, ",")
+		}
+		r := images.ImagesAction(action, req)
+		fmt.Println(r)
+	case "apply", "delete", "diff":
+		if manifestFile == "" {
+			panic("manifest file required, -f")
+		}
+		err := manifests.ManifestsAction(action, manifestFile, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			panic(action + " error")
+		}
 	default:
 		fmt.Println("unknown action " + action)
 		panic(conf.Actions)
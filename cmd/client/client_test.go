@@ -10,10 +10,13 @@ import (
 	"github.com/loqutus/rws/pkg/client/containers"
 	"github.com/loqutus/rws/pkg/client/hosts"
 	"github.com/loqutus/rws/pkg/client/pods"
+	"github.com/loqutus/rws/pkg/client/quotas"
+	"github.com/loqutus/rws/pkg/client/secrets"
 	"github.com/loqutus/rws/pkg/client/storage"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -72,7 +75,7 @@ func TestStorage(t *testing.T) {
 		fmt.Println(err4)
 		t.Errorf("storage list json.Unmarshal error")
 	}
-	var z = []storage.File{storage.File{"test", "localhost:8888", 5, 1}}
+	var z = []storage.File{storage.File{Name: "test", Host: "localhost:8888", Size: 5, Replicas: 1}}
 	if len(z) != len(c) || z[0].Name != c[0].Name || z[0].Host != c[0].Host ||
 		z[0].Replicas != c[0].Replicas || z[0].Size != c[0].Size {
 		fmt.Println("Got: " + s)
@@ -197,15 +200,13 @@ func TestHostInfo(t *testing.T) {
 func TestPod(t *testing.T) {
 	fmt.Println("test Pod add")
 	cmd := []string{"/bin/sleep", "60"}
-	var cont []containers.Container
-	pod := pods.Pod{"pod-test", "alpine", 1, 1, 1, 1, cmd, cont}
+	pod := pods.Pod{Name: "pod-test", Image: "alpine", Count: 1, Cores: 1, Memory: 1, Disk: 1, Cmd: cmd}
 	_ = pods.PodsAction("pod_add", pod)
 	fmt.Println("test Pod list")
 	_ = pods.PodsAction("pod_list", pods.Pod{})
 	fmt.Println("test Pod remove")
 	_ = pods.PodsAction("pod_remove", pod)
-	var cont1 []containers.Container
-	pod = pods.Pod{"myfancypod", "alpine", 1, 1, 1, 1, cmd, cont1}
+	pod = pods.Pod{Name: "myfancypod", Image: "alpine", Count: 1, Cores: 1, Memory: 1, Disk: 1, Cmd: cmd}
 	_ = pods.PodsAction("pod_add", pod)
 }
 
@@ -215,3 +216,47 @@ func TestHost(t *testing.T) {
 	fmt.Println("test host remove")
 	_ = hosts.HostsAction("host_remove", "localhost", 8888)
 }
+
+func TestQuota(t *testing.T) {
+	fmt.Println("test quota add")
+	quota := quotas.Quota{Name: "quota-test", Namespace: "quota-test", Cores: 1, Containers: 1}
+	_ = quotas.QuotasAction("quota_add", quota)
+	fmt.Println("test quota usage")
+	var usage []struct {
+		Quota quotas.Quota
+		Used  struct{ Cores, Containers uint64 }
+	}
+	err := json.Unmarshal([]byte(quotas.QuotasAction("quota_usage", quotas.Quota{})), &usage)
+	if err != nil {
+		fmt.Println(err)
+		t.Errorf("quota usage json.Unmarshal error")
+	}
+	found := false
+	for _, u := range usage {
+		if u.Quota.Name == quota.Name {
+			found = true
+			break
+		}
+	}
+	if found != true {
+		t.Errorf("quota not found in quota usage")
+	}
+	fmt.Println("test quota remove")
+	_ = quotas.QuotasAction("quota_remove", quota)
+}
+
+func TestSecret(t *testing.T) {
+	fmt.Println("test secret add")
+	secret := secrets.Secret{Name: "secret-test", Data: map[string]string{"password": "secret-test-value"}}
+	_ = secrets.SecretsAction("secret_add", secret)
+	fmt.Println("test secret list")
+	l := secrets.SecretsAction("secret_list", secrets.Secret{})
+	if !strings.Contains(l, secret.Name) {
+		t.Errorf("secret not found in secret list")
+	}
+	if strings.Contains(l, "secret-test-value") {
+		t.Errorf("secret list returns secret values")
+	}
+	fmt.Println("test secret remove")
+	_ = secrets.SecretsAction("secret_remove", secret)
+}
@@ -3,10 +3,20 @@ package main
 import (
 	"github.com/loqutus/rws/pkg/server/conf"
 	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/dns"
+	"github.com/loqutus/rws/pkg/server/gc"
 	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/images"
+	"github.com/loqutus/rws/pkg/server/ingress"
+	"github.com/loqutus/rws/pkg/server/manifests"
 	"github.com/loqutus/rws/pkg/server/pods"
+	"github.com/loqutus/rws/pkg/server/quotas"
+	"github.com/loqutus/rws/pkg/server/registries"
 	"github.com/loqutus/rws/pkg/server/scheduler"
+	"github.com/loqutus/rws/pkg/server/secrets"
+	"github.com/loqutus/rws/pkg/server/services"
 	"github.com/loqutus/rws/pkg/server/storage"
+	"github.com/loqutus/rws/pkg/server/top"
 	"github.com/loqutus/rws/pkg/server/web"
 	"log"
 	"net/http"
@@ -16,6 +26,14 @@ func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Llongfile | log.Lmicroseconds)
 	log.Println("starting server")
 	go scheduler.Scheduler()
+	containers.OnStateChange = pods.ContainerChanged
+	go containers.Monitor()
+	go containers.Prober()
+	go gc.Collector()
+	go images.Reporter()
+	go dns.Server()
+	go services.Proxy()
+	go ingress.Router()
 	http.HandleFunc("/storage_upload/", storage.UploadHandler)
 	http.HandleFunc("/storage_download/", storage.DownloadHandler)
 	http.HandleFunc("/storage_remove/", storage.RemoveHandler)
@@ -26,14 +44,44 @@ func main() {
 	http.HandleFunc("/container_list", containers.ContainerListHandler)
 	http.HandleFunc("/container_list_local", containers.ContainerListLocalHandler)
 	http.HandleFunc("/container_remove", containers.ContainerRemoveHandler)
+	http.HandleFunc("/container_logs", containers.ContainerLogsHandler)
+	http.HandleFunc("/container_exec", containers.ContainerExecHandler)
+	http.HandleFunc("/container_stats", containers.ContainerStatsHandler)
+	http.HandleFunc("/container_cp", containers.ContainerCpHandler)
+	http.HandleFunc("/container_cp_storage", containers.ContainerCpStorageHandler)
 	http.HandleFunc("/pod_add", pods.PodAddHandler)
 	http.HandleFunc("/pod_stop", pods.PodStopHandler)
 	http.HandleFunc("/pod_list", pods.PodListHandler)
 	http.HandleFunc("/pod_remove", pods.PodRemoveHandler)
+	http.HandleFunc("/pod_logs", pods.PodLogsHandler)
+	http.HandleFunc("/pod_replica_run", pods.PodReplicaRunHandler)
 	http.HandleFunc("/host_add", hosts.HostAddHandler)
 	http.HandleFunc("/host_remove", hosts.HostRemoveHandler)
 	http.HandleFunc("/host_list", hosts.HostListHandler)
 	http.HandleFunc("/host_info", hosts.HostInfoHandler)
+	http.HandleFunc("/host_stats", hosts.HostStatsHandler)
+	http.HandleFunc("/top", top.TopHandler)
+	http.HandleFunc("/image_list", images.ImageListHandler)
+	http.HandleFunc("/image_pull", images.ImagePullHandler)
+	http.HandleFunc("/image_pull_local", images.ImagePullLocalHandler)
+	http.HandleFunc("/quota_add", quotas.QuotaAddHandler)
+	http.HandleFunc("/quota_remove", quotas.QuotaRemoveHandler)
+	http.HandleFunc("/quota_list", quotas.QuotaListHandler)
+	http.HandleFunc("/quota_usage", quotas.QuotaUsageHandler)
+	http.HandleFunc("/secret_add", secrets.SecretAddHandler)
+	http.HandleFunc("/secret_remove", secrets.SecretRemoveHandler)
+	http.HandleFunc("/secret_list", secrets.SecretListHandler)
+	http.HandleFunc("/registry_add", registries.RegistryAddHandler)
+	http.HandleFunc("/registry_remove", registries.RegistryRemoveHandler)
+	http.HandleFunc("/registry_list", registries.RegistryListHandler)
+	http.HandleFunc("/service_add", services.ServiceAddHandler)
+	http.HandleFunc("/service_remove", services.ServiceRemoveHandler)
+	http.HandleFunc("/service_list", services.ServiceListHandler)
+	http.HandleFunc("/ingress_add", ingress.IngressAddHandler)
+	http.HandleFunc("/ingress_remove", ingress.IngressRemoveHandler)
+	http.HandleFunc("/ingress_list", ingress.IngressListHandler)
+	http.HandleFunc("/apply", manifests.ApplyHandler)
+	http.HandleFunc("/delete", manifests.DeleteHandler)
 	http.HandleFunc("/web", web.IndexHandler)
 	http.HandleFunc("/web/hosts", web.HostsHandler)
 	http.HandleFunc("/web/containers", web.ContainersHandler)
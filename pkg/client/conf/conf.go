@@ -1,5 +1,5 @@
 package conf
 
 const HostName = "http://localhost:8888"
-const Actions = "storage_upload, storage_download, storage_remove, storage_list, storage_list_all, container_run, container_stop, container_list, container_list_all, container_remove, host_add, host_remove, host_list, host_info, pod_add, pod_stop, pod_list, pod_remove"
+const Actions = "storage_upload, storage_download, storage_remove, storage_list, storage_list_all, container_run, container_stop, container_list, container_list_all, container_remove, container_logs, container_exec, container_stats, container_cp, host_add, host_remove, host_list, host_info, host_stats, top, pod_add, pod_stop, pod_list, pod_remove, pod_logs, quota_add, quota_remove, quota_list, quota_usage, secret_add, secret_remove, secret_list, registry_add, registry_remove, registry_list, service_add, service_remove, service_list, ingress_add, ingress_remove, ingress_list, image_list, image_pull, apply, delete, diff"
 const StorageTestDir = "/home/rusik/go/src/github.com/loqutus/rws/test"
\ No newline at end of file
@@ -2,26 +2,337 @@ package containers
 
 import (
 	"bytes"
-	"fmt"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/loqutus/rws/pkg/client/utils"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Container struct {
-	Image  string
-	Name   string
-	Disk   uint64
-	Memory uint64
-	Cores  uint64
-	Host   string
-	ID     string
-	Cmd    []string
+	Image              string
+	Name               string
+	Disk               uint64
+	Memory             uint64
+	Cores              uint64
+	Host               string
+	ID                 string
+	Cmd                []string
+	Namespace          string
+	Owner              string
+	CoresLimit         uint64
+	MemoryLimit        uint64
+	DiskLimit          uint64
+	State              string
+	ExitCode           int
+	OOMKilled          bool
+	Ports              []Port
+	Endpoints          []string
+	Env                map[string]string
+	Secrets            []SecretRef
+	Volumes            []Volume
+	Liveness           *Probe
+	Readiness          *Probe
+	Ready              bool
+	RestartCount       uint64
+	RestartPolicy      RestartPolicy
+	StopSignal         string
+	StopTimeout        uint64
+	Lifecycle          *Lifecycle
+	Stopped            bool
+	ImagePullPolicy    string
+	RegistryCredential string
+	PullStatus         string
+	PullError          string
+	StartedAt          time.Time
+	FinishedAt         time.Time
+	Pod                string
+	Replica            string
+	NetworkContainer   string
+	SharedVolumes      []SharedVolume
+	Init               bool
+	SpecHash           string
+	DNSPolicy          string
+}
+
+// SharedVolume is a directory shared by the containers of a pod replica.
+type SharedVolume struct {
+	Name     string
+	Path     string
+	ReadOnly bool
+}
+
+// RestartPolicy is always, on-failure with MaxRetries (zero is unlimited) or never.
+type RestartPolicy struct {
+	Name       string
+	MaxRetries uint64
+}
+
+// Lifecycle hooks are exec or http probes run after start and before stop.
+type Lifecycle struct {
+	PostStart *Probe
+	PreStop   *Probe
+}
+
+// Probe is an http, tcp or exec health check, times are in seconds.
+type Probe struct {
+	Type             string
+	Path             string
+	Port             uint64
+	Cmd              []string
+	InitialDelay     uint64
+	Period           uint64
+	Timeout          uint64
+	SuccessThreshold uint64
+	FailureThreshold uint64
+}
+
+// Volume mounts the storage file File at Path, read-write volumes are
+// written back to storage when the container stops.
+type Volume struct {
+	File     string
+	Path     string
+	ReadOnly bool
+}
+
+// SecretRef injects Key of Secret as the Env variable and/or a file at Path.
+type SecretRef struct {
+	Secret string
+	Key    string
+	Env    string
+	Path   string
+}
+
+// Port publishes ContainerPort on HostPort, zero HostPort is allocated by the server.
+type Port struct {
+	ContainerPort uint64
+	HostPort      uint64
+	Protocol      string
+}
+
+// ParsePorts parses a comma separated list of [hostPort:]containerPort[/protocol].
+func ParsePorts(s string) ([]Port, error) {
+	var result []Port
+	if s == "" {
+		return result, nil
+	}
+	for _, spec := range strings.Split(s, ",") {
+		var p Port
+		protoSplit := strings.SplitN(spec, "/", 2)
+		if len(protoSplit) == 2 {
+			p.Protocol = protoSplit[1]
+			if p.Protocol != "tcp" && p.Protocol != "udp" {
+				return nil, errors.New("unknown protocol in port " + spec)
+			}
+		}
+		portSplit := strings.Split(protoSplit[0], ":")
+		if len(portSplit) > 2 {
+			return nil, errors.New("bad port " + spec)
+		}
+		var err error
+		p.ContainerPort, err = strconv.ParseUint(portSplit[len(portSplit)-1], 10, 16)
+		if err != nil {
+			return nil, errors.New("bad container port in " + spec)
+		}
+		if len(portSplit) == 2 {
+			p.HostPort, err = strconv.ParseUint(portSplit[0], 10, 16)
+			if err != nil {
+				return nil, errors.New("bad host port in " + spec)
+			}
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+// ParseEnv parses a comma separated list of NAME=value.
+func ParseEnv(s string) (map[string]string, error) {
+	result := make(map[string]string)
+	if s == "" {
+		return result, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		kvSplit := strings.SplitN(kv, "=", 2)
+		if len(kvSplit) != 2 || kvSplit[0] == "" {
+			return nil, errors.New("bad variable " + kv)
+		}
+		result[kvSplit[0]] = kvSplit[1]
+	}
+	return result, nil
+}
+
+// ParseSecretRefs parses comma separated NAME=secret/key env references
+// and /path=secret/key file references.
+func ParseSecretRefs(envSpec, fileSpec string) ([]SecretRef, error) {
+	var result []SecretRef
+	for i, spec := range []string{envSpec, fileSpec} {
+		if spec == "" {
+			continue
+		}
+		isFile := i == 1
+		for _, ref := range strings.Split(spec, ",") {
+			refSplit := strings.SplitN(ref, "=", 2)
+			if len(refSplit) != 2 {
+				return nil, errors.New("bad secret reference " + ref)
+			}
+			secretSplit := strings.SplitN(refSplit[1], "/", 2)
+			if len(secretSplit) != 2 {
+				return nil, errors.New("secret reference " + ref + " should be secret/key")
+			}
+			r := SecretRef{Secret: secretSplit[0], Key: secretSplit[1]}
+			if isFile {
+				r.Path = refSplit[0]
+			} else {
+				r.Env = refSplit[0]
+			}
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
+
+// ParseVolumes parses a comma separated list of file:/path[:ro].
+func ParseVolumes(s string) ([]Volume, error) {
+	var result []Volume
+	if s == "" {
+		return result, nil
+	}
+	for _, spec := range strings.Split(s, ",") {
+		specSplit := strings.Split(spec, ":")
+		if len(specSplit) < 2 || len(specSplit) > 3 || specSplit[0] == "" || specSplit[1] == "" {
+			return nil, errors.New("bad volume " + spec)
+		}
+		v := Volume{File: specSplit[0], Path: specSplit[1]}
+		if len(specSplit) == 3 {
+			switch specSplit[2] {
+			case "ro":
+				v.ReadOnly = true
+			case "rw":
+			default:
+				return nil, errors.New("bad volume mode in " + spec)
+			}
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// LogsRequest selects the logs of a container or, for pod_logs, a pod.
+type LogsRequest struct {
+	Name       string
+	Tail       string
+	Since      string
+	Timestamps bool
+	Follow     bool
+}
+
+// LogsAction writes container_logs or pod_logs output to w, with Follow
+// it returns when the server closes the stream.
+func LogsAction(action string, req LogsRequest, w io.Writer) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "container_logs", "pod_logs":
+		return utils.Stream(action, bytes.NewBuffer(b), w)
+	default:
+		panic("unknown action")
+	}
+}
+
+// ParseProbe parses http:port/path, tcp:port or exec:command args,
+// optionally followed by ,delay=N,period=N,timeout=N,success=N,failure=N.
+func ParseProbe(s string) (*Probe, error) {
+	if s == "" {
+		return nil, nil
+	}
+	optSplit := strings.Split(s, ",")
+	typeSplit := strings.SplitN(optSplit[0], ":", 2)
+	if len(typeSplit) != 2 {
+		return nil, errors.New("bad probe " + s)
+	}
+	p := Probe{Type: typeSplit[0]}
+	var err error
+	switch p.Type {
+	case "http":
+		pathSplit := strings.SplitN(typeSplit[1], "/", 2)
+		p.Port, err = strconv.ParseUint(pathSplit[0], 10, 16)
+		p.Path = "/"
+		if len(pathSplit) == 2 {
+			p.Path += pathSplit[1]
+		}
+	case "tcp":
+		p.Port, err = strconv.ParseUint(typeSplit[1], 10, 16)
+	case "exec":
+		p.Cmd = strings.Split(typeSplit[1], " ")
+	default:
+		return nil, errors.New("unknown probe type " + p.Type)
+	}
+	if err != nil {
+		return nil, errors.New("bad probe port in " + s)
+	}
+	for _, opt := range optSplit[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("bad probe option " + opt)
+		}
+		v, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil {
+			return nil, errors.New("bad probe option " + opt)
+		}
+		switch kv[0] {
+		case "delay":
+			p.InitialDelay = v
+		case "period":
+			p.Period = v
+		case "timeout":
+			p.Timeout = v
+		case "success":
+			p.SuccessThreshold = v
+		case "failure":
+			p.FailureThreshold = v
+		default:
+			return nil, errors.New("unknown probe option " + opt)
+		}
+	}
+	return &p, nil
+}
+
+// ParseRestartPolicy parses always, never or on-failure[:maxRetries].
+func ParseRestartPolicy(s string) (RestartPolicy, error) {
+	split := strings.SplitN(s, ":", 2)
+	p := RestartPolicy{Name: split[0]}
+	switch p.Name {
+	case "", "always", "never":
+		if len(split) == 2 {
+			return p, errors.New("only on-failure restart policy takes max retries")
+		}
+	case "on-failure":
+		if len(split) == 2 {
+			var err error
+			p.MaxRetries, err = strconv.ParseUint(split[1], 10, 64)
+			if err != nil {
+				return p, errors.New("bad max retries in " + s)
+			}
+		}
+	default:
+		return p, errors.New("unknown restart policy " + s)
+	}
+	return p, nil
 }
 
 func ContainerAction(action, image, name string, cmd []string) string {
+	c := Container{Image: image, Name: name, Disk: 1, Memory: 1, Cores: 1, Cmd: cmd}
+	return ContainerSpecAction(action, c)
+}
+
+func ContainerSpecAction(action string, c Container) string {
 	var err error
 	var resp []byte
-	c := Container{image, name, 1, 1, 1, "", "", cmd}
 	b, err2 := json.Marshal(c)
 	if err2 != nil {
 		fmt.Println(err2)
@@ -29,7 +340,7 @@ func ContainerAction(action, image, name string, cmd []string) string {
 	}
 	buf := bytes.NewBuffer(b)
 	switch action {
-	case "container_list", "container_run", "container_stop", "container_remove", "container_list_local":
+	case "container_list", "container_run", "container_stop", "container_remove", "container_list_local", "container_stats":
 		resp, err = utils.Req(action, buf)
 	default:
 		panic("unknown action")
@@ -39,4 +350,4 @@ func ContainerAction(action, image, name string, cmd []string) string {
 		panic("get error")
 	}
 	return string(resp)
-}
\ No newline at end of file
+}
@@ -0,0 +1,204 @@
+package containers
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/loqutus/rws/pkg/client/conf"
+	"github.com/loqutus/rws/pkg/client/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type CopyRequest struct {
+	Name      string
+	Path      string
+	File      string
+	ToStorage bool
+}
+
+// ParseCpPath splits container:path. Local paths, which have no colon
+// or start with a dot or a slash, return an empty container name.
+func ParseCpPath(s string) (string, string) {
+	if strings.HasPrefix(s, "/") || strings.HasPrefix(s, ".") {
+		return "", s
+	}
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", s
+	}
+	return s[:i], s[i+1:]
+}
+
+func cpURL(name, p string) string {
+	q := url.Values{}
+	q.Set("name", name)
+	q.Set("path", p)
+	return conf.HostName + "/container_cp?" + q.Encode()
+}
+
+// Copy copies between a local path and a container:path, in either
+// direction. With withStorage the other side is a storage file name.
+func Copy(src, dst string, withStorage bool) error {
+	srcName, srcPath := ParseCpPath(src)
+	dstName, dstPath := ParseCpPath(dst)
+	switch {
+	case srcName != "" && dstName != "":
+		return errors.New("copying between two containers is not supported")
+	case srcName == "" && dstName == "":
+		return errors.New("either the source or the destination has to be container:path")
+	case withStorage && srcName != "":
+		return copyStorage(CopyRequest{Name: srcName, Path: srcPath, File: dst, ToStorage: true})
+	case withStorage:
+		return copyStorage(CopyRequest{Name: dstName, Path: dstPath, File: src})
+	case srcName != "":
+		return copyFrom(srcName, srcPath, dstPath)
+	default:
+		return copyTo(srcPath, dstName, dstPath)
+	}
+}
+
+func copyStorage(req CopyRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err2 := utils.Req("container_cp_storage", bytes.NewBuffer(b))
+	return err2
+}
+
+// copyFrom extracts the archive of p into the local directory dst, or
+// writes the single file it contains to dst.
+func copyFrom(name, p, dst string) error {
+	resp, err := http.Get(cpURL(name, p))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("container_cp: %d %s", resp.StatusCode, b)
+	}
+	fi, err2 := os.Stat(dst)
+	toDir := err2 == nil && fi.IsDir()
+	tr := tar.NewReader(resp.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := dst
+		if toDir {
+			target = filepath.Join(dst, filepath.FromSlash(path.Clean("/"+hdr.Name)))
+		} else if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return errors.New(p + " is not a file, copy it into a directory")
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			var f *os.File
+			f, err = os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err == nil {
+				_, err = io.Copy(f, tr)
+				f.Close()
+			}
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+		}
+		if err != nil {
+			return err
+		}
+		if !toDir {
+			return nil
+		}
+	}
+}
+
+// copyTo sends the local file or directory src to the container. A dst
+// ending in a slash is the directory to copy into, otherwise src is
+// renamed to the last element of dst.
+func copyTo(src, name, dst string) error {
+	dir, base := path.Split(dst)
+	if base == "" {
+		base = filepath.Base(src)
+	}
+	if dir == "" {
+		dir = "/"
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(src, base, pw))
+	}()
+	r, err := http.NewRequest("PUT", cpURL(name, dir), pr)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/x-tar")
+	resp, err2 := http.DefaultClient.Do(r)
+	if err2 != nil {
+		return err2
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("container_cp: %d %s", resp.StatusCode, b)
+	}
+	return nil
+}
+
+// writeTar writes src to w as a tar archive with src named base.
+func writeTar(src, base string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err2 := tar.FileInfoHeader(fi, link)
+		if err2 != nil {
+			return err2
+		}
+		rel, err3 := filepath.Rel(src, p)
+		if err3 != nil {
+			return err3
+		}
+		hdr.Name = path.Join(base, filepath.ToSlash(rel))
+		err4 := tw.WriteHeader(hdr)
+		if err4 != nil {
+			return err4
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err5 := os.Open(p)
+		if err5 != nil {
+			return err5
+		}
+		defer f.Close()
+		_, err6 := io.Copy(tw, f)
+		return err6
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
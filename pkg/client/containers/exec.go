@@ -0,0 +1,118 @@
+package containers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/loqutus/rws/pkg/client/conf"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Channel bytes of container_exec messages, see the server side.
+const (
+	ExecStdin  = 0
+	ExecStdout = 1
+	ExecStderr = 2
+	ExecResize = 3
+	ExecExit   = 4
+)
+
+type ExecRequest struct {
+	Name string
+	Cmd  []string
+	Tty  bool
+}
+
+type terminalSize struct {
+	Width  uint
+	Height uint
+}
+
+// Exec runs cmd in the container connected to the local terminal and
+// returns the command exit code. A tty is allocated when stdin is a terminal.
+func Exec(name string, cmd []string) (int, error) {
+	url := strings.Replace(conf.HostName, "http", "ws", 1) + "/container_exec"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	fd := int(os.Stdin.Fd())
+	req := ExecRequest{Name: name, Cmd: cmd, Tty: terminal.IsTerminal(fd)}
+	b, err2 := json.Marshal(req)
+	if err2 != nil {
+		return -1, err2
+	}
+	err3 := conn.WriteMessage(websocket.TextMessage, b)
+	if err3 != nil {
+		return -1, err3
+	}
+	var mu sync.Mutex
+	send := func(channel byte, p []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return conn.WriteMessage(websocket.BinaryMessage, append([]byte{channel}, p...))
+	}
+	if req.Tty {
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return -1, err
+		}
+		defer terminal.Restore(fd, state)
+		sendSize := func() {
+			width, height, err := terminal.GetSize(fd)
+			if err != nil {
+				return
+			}
+			size, _ := json.Marshal(terminalSize{Width: uint(width), Height: uint(height)})
+			send(ExecResize, size)
+		}
+		sendSize()
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, syscall.SIGWINCH)
+		defer signal.Stop(winch)
+		go func() {
+			for range winch {
+				sendSize()
+			}
+		}()
+	}
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if send(ExecStdin, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				send(ExecStdin, nil)
+				return
+			}
+		}
+	}()
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return -1, errors.New("connection closed before exit code: " + err.Error())
+		}
+		if len(message) == 0 {
+			continue
+		}
+		switch message[0] {
+		case ExecStdout:
+			os.Stdout.Write(message[1:])
+		case ExecStderr:
+			os.Stderr.Write(message[1:])
+		case ExecExit:
+			return strconv.Atoi(string(message[1:]))
+		}
+	}
+}
@@ -24,7 +24,7 @@ func HostsAction(action string, hostName string, hostPort uint64) string {
 		panic("json encoding error")
 	}
 	switch action {
-	case "host_add", "host_remove", "host_list", "host_info":
+	case "host_add", "host_remove", "host_list", "host_info", "host_stats":
 		resp, err = utils.Req(action, b)
 		if err == errors.New("host already exists") {
 			fmt.Println("host already exists")
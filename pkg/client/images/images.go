@@ -0,0 +1,35 @@
+package images
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/loqutus/rws/pkg/client/utils"
+)
+
+type PullRequest struct {
+	Image              string
+	Namespace          string
+	RegistryCredential string
+	Hosts              []string
+}
+
+func ImagesAction(action string, req PullRequest) string {
+	b, err := json.Marshal(req)
+	if err != nil {
+		fmt.Println("json marshal error")
+		panic(err)
+	}
+	buf := bytes.NewBuffer(b)
+	switch action {
+	case "image_list", "image_pull":
+		resp, err := utils.Req(action, buf)
+		if err != nil {
+			fmt.Println("post error")
+			panic(err)
+		}
+		return string(resp)
+	default:
+		panic("unknown action")
+	}
+}
@@ -0,0 +1,99 @@
+package ingress
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/loqutus/rws/pkg/client/utils"
+	"strconv"
+	"strings"
+)
+
+type Ingress struct {
+	Name      string
+	Namespace string
+	Owner     string
+	Rules     []Rule
+	TLS       []TLS
+	Balancer  string
+}
+
+type Rule struct {
+	Host          string
+	Path          string
+	Pod           string
+	Selector      map[string]string
+	ContainerPort uint64
+	StripPath     bool
+}
+
+type TLS struct {
+	Hosts  []string
+	Secret string
+}
+
+// ParseRules parses a comma separated list of [host]/path=pod:containerPort.
+func ParseRules(s string) ([]Rule, error) {
+	var result []Rule
+	if s == "" {
+		return result, nil
+	}
+	for _, spec := range strings.Split(s, ",") {
+		var r Rule
+		kvSplit := strings.SplitN(spec, "=", 2)
+		if len(kvSplit) != 2 {
+			return nil, errors.New("bad ingress rule " + spec)
+		}
+		i := strings.Index(kvSplit[0], "/")
+		if i < 0 {
+			return nil, errors.New("ingress rule " + spec + " needs a path")
+		}
+		r.Host, r.Path = kvSplit[0][:i], kvSplit[0][i:]
+		backendSplit := strings.Split(kvSplit[1], ":")
+		if len(backendSplit) != 2 || backendSplit[0] == "" {
+			return nil, errors.New("bad backend in ingress rule " + spec)
+		}
+		r.Pod = backendSplit[0]
+		var err error
+		r.ContainerPort, err = strconv.ParseUint(backendSplit[1], 10, 16)
+		if err != nil {
+			return nil, errors.New("bad container port in ingress rule " + spec)
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// RuleHosts returns the hosts of the rules, to terminate TLS for.
+func RuleHosts(rules []Rule) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, r := range rules {
+		if r.Host != "" && !seen[r.Host] {
+			seen[r.Host] = true
+			hosts = append(hosts, r.Host)
+		}
+	}
+	return hosts
+}
+
+func IngressAction(action string, ing Ingress) string {
+	b, err := json.Marshal(ing)
+	if err != nil {
+		fmt.Println("json marshal error")
+		panic(err)
+	}
+	buf := bytes.NewBuffer(b)
+	switch action {
+	case "ingress_add", "ingress_remove", "ingress_list":
+		resp, err := utils.Req(action, buf)
+		if err != nil {
+			fmt.Println("post error")
+			panic(err)
+		}
+		return string(resp)
+	default:
+		panic("unknown action")
+	}
+}
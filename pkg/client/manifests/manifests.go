@@ -0,0 +1,196 @@
+package manifests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/loqutus/rws/pkg/client/utils"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Object is one object of a manifest:
+//
+//	kind: Pod
+//	spec:
+//	  name: web
+//	  image: nginx
+//	  cmd: ["nginx", "-g", "daemon off;"]
+//
+// Spec field names are those of the object type, in any case.
+type Object struct {
+	Kind string
+	Spec json.RawMessage
+}
+
+type Request struct {
+	Objects []Object
+	DryRun  bool
+}
+
+type Result struct {
+	Kind    string
+	Name    string
+	Action  string
+	Changes []string
+	Error   string
+}
+
+// Read parses a manifest file, "-" is stdin. A file holds YAML documents
+// separated by "---", each of them an object or a list of objects. JSON
+// is read as YAML.
+func Read(fileName string) ([]Object, error) {
+	var r io.Reader = os.Stdin
+	if fileName != "-" {
+		f, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	data, err2 := ioutil.ReadAll(r)
+	if err2 != nil {
+		return nil, err2
+	}
+	var objects []Object
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var raw interface{}
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		l, err2 := objectsOf(jsonValue(raw))
+		if err2 != nil {
+			return nil, err2
+		}
+		objects = append(objects, l...)
+	}
+	if len(objects) == 0 {
+		return nil, errors.New(fileName + " has no objects")
+	}
+	return objects, nil
+}
+
+// objectsOf returns the object or the list of objects of a document,
+// kind and spec keys are matched in any case.
+func objectsOf(v interface{}) ([]Object, error) {
+	switch x := v.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		var l []Object
+		for _, item := range x {
+			objects, err := objectsOf(item)
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, objects...)
+		}
+		return l, nil
+	case map[string]interface{}:
+		var o Object
+		var spec interface{}
+		for k, val := range x {
+			switch strings.ToLower(k) {
+			case "kind":
+				o.Kind = fmt.Sprint(val)
+			case "spec":
+				spec = val
+			}
+		}
+		if o.Kind == "" {
+			return nil, errors.New("object without kind")
+		}
+		b, err := json.Marshal(spec)
+		if err != nil {
+			return nil, err
+		}
+		o.Spec = b
+		return []Object{o}, nil
+	default:
+		return nil, errors.New("manifest documents have to be objects or lists of objects")
+	}
+}
+
+// jsonValue converts the map[interface{}]interface{} maps of the YAML
+// decoder to maps json can encode.
+func jsonValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, val := range x {
+			m[fmt.Sprint(k)] = jsonValue(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range x {
+			x[i] = jsonValue(val)
+		}
+		return x
+	default:
+		return v
+	}
+}
+
+// ManifestsAction sends the objects of the manifest file to apply, delete
+// or diff, which is apply without changing anything, and prints the results.
+func ManifestsAction(action, fileName string, w io.Writer) error {
+	objects, err := Read(fileName)
+	if err != nil {
+		return err
+	}
+	req := Request{Objects: objects}
+	endpoint := action
+	switch action {
+	case "apply", "delete":
+	case "diff":
+		endpoint = "apply"
+		req.DryRun = true
+	default:
+		return errors.New("unknown action " + action)
+	}
+	b, err2 := json.Marshal(req)
+	if err2 != nil {
+		return err2
+	}
+	resp, err3 := utils.Req(endpoint, bytes.NewBuffer(b))
+	if err3 != nil {
+		return err3
+	}
+	var results []Result
+	err4 := json.Unmarshal(resp, &results)
+	if err4 != nil {
+		return err4
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	failed := 0
+	for _, r := range results {
+		status := r.Action
+		if r.Error != "" {
+			status = "error: " + r.Error
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t\n", r.Kind, r.Name, status)
+		for _, c := range r.Changes {
+			fmt.Fprintf(tw, "\t\t  %s\t\n", strings.Replace(c, "\n", " ", -1))
+		}
+	}
+	err5 := tw.Flush()
+	if err5 != nil {
+		return err5
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects failed", failed, len(results))
+	}
+	return nil
+}
@@ -6,17 +6,77 @@ import (
 	"fmt"
 	"github.com/loqutus/rws/pkg/client/containers"
 	"github.com/loqutus/rws/pkg/client/utils"
+	"time"
 )
 
 type Pod struct {
-	Name       string
-	Image      string
-	Count      uint64
-	Cores      uint64
-	Memory     uint64
-	Disk       uint64
-	Cmd        []string
-	Containers []containers.Container
+	Name               string
+	Image              string
+	Count              uint64
+	Cores              uint64
+	Memory             uint64
+	Disk               uint64
+	Cmd                []string
+	Containers         []containers.Container
+	Namespace          string
+	Owner              string
+	CoresLimit         uint64
+	MemoryLimit        uint64
+	DiskLimit          uint64
+	Ports              []containers.Port
+	Env                map[string]string
+	Secrets            []containers.SecretRef
+	Volumes            []containers.Volume
+	Liveness           *containers.Probe
+	Readiness          *containers.Probe
+	RestartPolicy      containers.RestartPolicy
+	StopSignal         string
+	StopTimeout        uint64
+	Lifecycle          *containers.Lifecycle
+	ImagePullPolicy    string
+	RegistryCredential string
+	// ContainerSpecs are the containers of a multi-container pod.
+	ContainerSpecs []containers.Container
+	// InitContainers run one after another before the containers start.
+	InitContainers []containers.Container
+	// DNSPolicy is cluster, the default, or host.
+	DNSPolicy string
+	// Labels are selected by services.
+	Labels map[string]string
+	// Status is returned by pod_list, its Phase filters the list.
+	Status *PodStatus
+}
+
+// PodStatus phases are Pending, Running and Failed.
+type PodStatus struct {
+	Phase      string
+	Desired    uint64
+	Running    uint64
+	Ready      uint64
+	Containers []ContainerStatus
+	Conditions []Condition
+	Updated    time.Time
+}
+
+type ContainerStatus struct {
+	Name         string
+	Replica      string
+	Host         string
+	Init         bool
+	State        string
+	Reason       string
+	Message      string
+	ExitCode     int
+	RestartCount uint64
+	Ready        bool
+}
+
+type Condition struct {
+	Type    string
+	Status  bool
+	Reason  string
+	Message string
+	Since   time.Time
 }
 
 func PodsAction(action string, pod Pod) string {
@@ -27,7 +87,7 @@ func PodsAction(action string, pod Pod) string {
 	}
 	buf := bytes.NewBuffer(b)
 	switch action {
-	case "pod_add", "pod_remove", "pod_list", "pod_info":
+	case "pod_add", "pod_stop", "pod_remove", "pod_list", "pod_info":
 		resp, err := utils.Req(action, buf)
 		if err != nil {
 			fmt.Println("post error")
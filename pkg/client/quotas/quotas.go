@@ -0,0 +1,42 @@
+package quotas
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/loqutus/rws/pkg/client/utils"
+)
+
+type Quota struct {
+	Name       string
+	Namespace  string
+	Owner      string
+	Cores      uint64
+	Memory     uint64
+	Disk       uint64
+	Containers uint64
+	Storage    uint64
+	MaxCores   uint64
+	MaxMemory  uint64
+	MaxDisk    uint64
+}
+
+func QuotasAction(action string, quota Quota) string {
+	b, err := json.Marshal(quota)
+	if err != nil {
+		fmt.Println("json marshal error")
+		panic(err)
+	}
+	buf := bytes.NewBuffer(b)
+	switch action {
+	case "quota_add", "quota_remove", "quota_list", "quota_usage":
+		resp, err := utils.Req(action, buf)
+		if err != nil {
+			fmt.Println("post error")
+			panic(err)
+		}
+		return string(resp)
+	default:
+		panic("unknown action")
+	}
+}
@@ -0,0 +1,36 @@
+package registries
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/loqutus/rws/pkg/client/utils"
+)
+
+type Registry struct {
+	Name      string
+	Namespace string
+	Server    string
+	Username  string
+	Password  string
+}
+
+func RegistriesAction(action string, reg Registry) string {
+	b, err := json.Marshal(reg)
+	if err != nil {
+		fmt.Println("json marshal error")
+		panic(err)
+	}
+	buf := bytes.NewBuffer(b)
+	switch action {
+	case "registry_add", "registry_remove", "registry_list":
+		resp, err := utils.Req(action, buf)
+		if err != nil {
+			fmt.Println("post error")
+			panic(err)
+		}
+		return string(resp)
+	default:
+		panic("unknown action")
+	}
+}
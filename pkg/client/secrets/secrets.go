@@ -0,0 +1,34 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/loqutus/rws/pkg/client/utils"
+)
+
+type Secret struct {
+	Name      string
+	Namespace string
+	Data      map[string]string
+}
+
+func SecretsAction(action string, secret Secret) string {
+	b, err := json.Marshal(secret)
+	if err != nil {
+		fmt.Println("json marshal error")
+		panic(err)
+	}
+	buf := bytes.NewBuffer(b)
+	switch action {
+	case "secret_add", "secret_remove", "secret_list":
+		resp, err := utils.Req(action, buf)
+		if err != nil {
+			fmt.Println("post error")
+			panic(err)
+		}
+		return string(resp)
+	default:
+		panic("unknown action")
+	}
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/loqutus/rws/pkg/client/utils"
+	"strconv"
+	"strings"
+)
+
+type Service struct {
+	Name      string
+	Namespace string
+	Owner     string
+	Pod       string
+	Selector  map[string]string
+	Ports     []ServicePort
+	Balancer  string
+	Endpoints []Endpoint
+}
+
+type ServicePort struct {
+	Port          uint64
+	ContainerPort uint64
+	Protocol      string
+}
+
+type Endpoint struct {
+	Port      uint64
+	Addr      string
+	Container string
+}
+
+// ParseServicePorts parses a comma separated list of
+// [port:]containerPort[/tcp|http], ports are allocated if not given.
+func ParseServicePorts(s string) ([]ServicePort, error) {
+	var result []ServicePort
+	if s == "" {
+		return result, nil
+	}
+	for _, spec := range strings.Split(s, ",") {
+		var p ServicePort
+		protoSplit := strings.SplitN(spec, "/", 2)
+		if len(protoSplit) == 2 {
+			p.Protocol = protoSplit[1]
+			if p.Protocol != "tcp" && p.Protocol != "http" {
+				return nil, errors.New("unknown protocol in service port " + spec)
+			}
+		}
+		portSplit := strings.Split(protoSplit[0], ":")
+		if len(portSplit) > 2 {
+			return nil, errors.New("bad service port " + spec)
+		}
+		var err error
+		p.ContainerPort, err = strconv.ParseUint(portSplit[len(portSplit)-1], 10, 16)
+		if err != nil {
+			return nil, errors.New("bad container port in " + spec)
+		}
+		if len(portSplit) == 2 {
+			p.Port, err = strconv.ParseUint(portSplit[0], 10, 16)
+			if err != nil {
+				return nil, errors.New("bad service port in " + spec)
+			}
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+func ServicesAction(action string, s Service) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		fmt.Println("json marshal error")
+		panic(err)
+	}
+	buf := bytes.NewBuffer(b)
+	switch action {
+	case "service_add", "service_remove", "service_list":
+		resp, err := utils.Req(action, buf)
+		if err != nil {
+			fmt.Println("post error")
+			panic(err)
+		}
+		return string(resp)
+	default:
+		panic("unknown action")
+	}
+}
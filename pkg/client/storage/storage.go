@@ -6,17 +6,24 @@ import (
 	"github.com/loqutus/rws/pkg/client/conf"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
 type File struct {
-	Name     string
-	Host     string
-	Size     uint64
-	Replicas uint64
+	Name      string
+	Host      string
+	Size      uint64
+	Replicas  uint64
+	Namespace string
+	Owner     string
 }
 
 func Upload(name string) (string, error) {
+	return UploadOwned(name, "", "")
+}
+
+func UploadOwned(name, namespace, owner string) (string, error) {
 	data, err := ioutil.ReadFile(name)
 	if err != nil {
 		fmt.Println(err)
@@ -24,8 +31,11 @@ func Upload(name string) (string, error) {
 	}
 	fileNameSplit := strings.Split(name, "/")
 	fileName := fileNameSplit[len(fileNameSplit)-1]
-	url := fmt.Sprintf("%s/%s/%s", conf.HostName, "storage_upload", fileName)
-	resp, err1 := http.Post(url, "application/json", bytes.NewBuffer(data))
+	q := url.Values{}
+	q.Set("namespace", namespace)
+	q.Set("owner", owner)
+	uploadURL := fmt.Sprintf("%s/%s/%s?%s", conf.HostName, "storage_upload", fileName, q.Encode())
+	resp, err1 := http.Post(uploadURL, "application/json", bytes.NewBuffer(data))
 	if err1 != nil {
 		fmt.Println(err1)
 		panic("request error")
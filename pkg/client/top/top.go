@@ -0,0 +1,95 @@
+package top
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/loqutus/rws/pkg/client/utils"
+	"io"
+	"text/tabwriter"
+)
+
+type HostUsage struct {
+	Name        string
+	Cores       uint64
+	CPUPercent  float64
+	Load1       float64
+	Load5       float64
+	Load15      float64
+	MemoryUsed  uint64
+	MemoryTotal uint64
+	DiskUsed    uint64
+	DiskTotal   uint64
+	Containers  int
+	Error       string
+}
+
+type PodUsage struct {
+	Name        string
+	Namespace   string
+	Containers  int
+	CPUPercent  float64
+	MemoryUsage uint64
+	NetworkRx   uint64
+	NetworkTx   uint64
+	BlockRead   uint64
+	BlockWrite  uint64
+}
+
+type ContainerStats struct {
+	Name        string
+	Host        string
+	CPUPercent  float64
+	MemoryUsage uint64
+	MemoryLimit uint64
+	NetworkRx   uint64
+	NetworkTx   uint64
+	BlockRead   uint64
+	BlockWrite  uint64
+}
+
+type Top struct {
+	Hosts      []HostUsage
+	Pods       []PodUsage
+	Containers []ContainerStats
+}
+
+func mib(b uint64) string {
+	return fmt.Sprintf("%.1fMiB", float64(b)/1024/1024)
+}
+
+// PrintTop writes the cluster usage as tables of hosts, pods and containers.
+func PrintTop(w io.Writer) error {
+	resp, err := utils.Req("top", bytes.NewBuffer(nil))
+	if err != nil {
+		return err
+	}
+	var t Top
+	err2 := json.Unmarshal(resp, &t)
+	if err2 != nil {
+		return err2
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tCPU%\tLOAD\tMEMORY\tDISK\tCONTAINERS\t")
+	for _, h := range t.Hosts {
+		if h.Error != "" {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\t%s\n", h.Name, h.Error)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%.1f\t%.2f %.2f %.2f\t%s/%s\t%s/%s\t%d\t\n", h.Name, h.CPUPercent,
+			h.Load1, h.Load5, h.Load15, mib(h.MemoryUsed), mib(h.MemoryTotal), mib(h.DiskUsed), mib(h.DiskTotal), h.Containers)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "POD\tNAMESPACE\tCONTAINERS\tCPU%\tMEMORY\tNET RX/TX\tBLOCK R/W\t")
+	for _, p := range t.Pods {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.1f\t%s\t%s/%s\t%s/%s\t\n", p.Name, p.Namespace, p.Containers, p.CPUPercent,
+			mib(p.MemoryUsage), mib(p.NetworkRx), mib(p.NetworkTx), mib(p.BlockRead), mib(p.BlockWrite))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "CONTAINER\tHOST\tCPU%\tMEMORY\tNET RX/TX\tBLOCK R/W\t")
+	for _, c := range t.Containers {
+		fmt.Fprintf(tw, "%s\t%s\t%.1f\t%s/%s\t%s/%s\t%s/%s\t\n", c.Name, c.Host, c.CPUPercent, mib(c.MemoryUsage),
+			mib(c.MemoryLimit), mib(c.NetworkRx), mib(c.NetworkTx), mib(c.BlockRead), mib(c.BlockWrite))
+	}
+	return tw.Flush()
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/loqutus/rws/pkg/client/conf"
+	"io"
 	"io/ioutil"
 	"net/http"
 )
@@ -28,3 +29,19 @@ func Req(action string, bodyBuffer *bytes.Buffer) ([]byte, error) {
 	}
 	return b, nil
 }
+
+// Stream posts the request and copies the response to w as it arrives.
+func Stream(action string, bodyBuffer *bytes.Buffer, w io.Writer) error {
+	url := fmt.Sprintf("%s/%s", conf.HostName, action)
+	resp, err1 := http.Post(url, "application/json", bodyBuffer)
+	if err1 != nil {
+		return err1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %d %s", action, resp.StatusCode, b)
+	}
+	_, err2 := io.Copy(w, resp.Body)
+	return err2
+}
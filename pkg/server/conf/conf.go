@@ -2,7 +2,80 @@ package conf
 
 const Addr = "0.0.0.0:8888"
 const DataDir = "/data"
+
+// HostDataDir is where DataDir is on the host the agent runs on, the
+// runtime resolves bind mount sources there.
+const HostDataDir = "/data"
+
+// StateDir is the directory in DataDir that holds the volumes, secrets,
+// resolv.conf files and logs of containers, apart from stored files.
+// Files can't be stored under its name.
+const StateDir = ".rws"
 const LocalHostName = "localhost:8888"
 const LocalIPPrefix = "10.0.0."
+
+// AdvertiseIP is the address of this host that containers and other hosts
+// reach the agent's DNS server at. When it is empty the host name is
+// resolved, which works while /etc/hosts and /etc/hostname are the host's.
+const AdvertiseIP = ""
 const LocalPort = "8888"
 const EtcdHost = "http://10.0.0.1:2379"
+
+// Runtime is the container runtime used by this host: docker, containerd or fake.
+const Runtime = "docker"
+const DockerAPIVersion = "1.38"
+const ContainerdAddress = "/run/containerd/containerd.sock"
+const ContainerdNamespace = "rws"
+
+// HostPortMin and HostPortMax bound automatically allocated host ports.
+const HostPortMin = 30000
+const HostPortMax = 32767
+
+// SecretKeyFile holds the hex encoded AES-256 key secrets are encrypted with.
+// It has to be the same on every host.
+const SecretKeyFile = "/etc/rws/secret.key"
+
+// ContainerRetention is how many seconds exited containers are kept before
+// the garbage collector removes them, GCInterval how often it runs.
+const ContainerRetention = 24 * 60 * 60
+const GCInterval = 60
+
+// InitRetries is how many times a failed init container is started again.
+const InitRetries = 5
+
+// ClusterID is put on the containers rws creates so agents of other
+// clusters sharing a runtime leave them alone. ImportUnmanaged makes the
+// agent import containers it didn't create as standalone records.
+const ClusterID = "rws"
+const ImportUnmanaged = false
+
+// ImageReportInterval is how often in seconds agents report their images.
+// Unused images are removed, oldest first, once disk usage goes over
+// ImageGCHighPercent until it is below ImageGCLowPercent.
+const ImageReportInterval = 60
+const ImageGCHighPercent = 85
+const ImageGCLowPercent = 70
+
+// DNSPort is where the agent answers <pod>.<namespace>.DNSDomain queries
+// on all its addresses, pods without a namespace are in
+// DNSDefaultNamespace. Other names are forwarded to the first nameserver
+// of /etc/resolv.conf. DNSTTL is how many seconds answers may be cached,
+// and how long the agent caches the records it answers from.
+const DNSPort = "53"
+const DNSDomain = "rws"
+const DNSDefaultNamespace = "default"
+const DNSTTL = 5
+
+// Service ports are allocated from ServicePortMin to ServicePortMax, below
+// the host ports of containers. Agents update the endpoints they proxy
+// to every ServiceSyncInterval seconds.
+const ServicePortMin = 29000
+const ServicePortMax = 29999
+const ServiceSyncInterval = 5
+
+// The ingress router listens on IngressHTTPAddr and IngressHTTPSAddr and
+// reloads ingresses, certificates and endpoints every
+// IngressSyncInterval seconds.
+const IngressHTTPAddr = ":80"
+const IngressHTTPSAddr = ":443"
+const IngressSyncInterval = 5
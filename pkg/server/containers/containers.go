@@ -5,31 +5,161 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
 	"github.com/loqutus/rws/pkg/server/conf"
 	"github.com/loqutus/rws/pkg/server/etcd"
 	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/quotas"
+	"github.com/loqutus/rws/pkg/server/runtimes"
 	"github.com/loqutus/rws/pkg/server/storage"
 	"github.com/loqutus/rws/pkg/server/utils"
 	"golang.org/x/net/context"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Container is a container record. Cores, Memory and Disk are resource
+// requests used for placement, the *Limit fields are enforced by the runtime
+// and default to the requests.
 type Container struct {
-	Image  string
-	Name   string
-	Disk   uint64
-	Memory uint64
-	Cores  uint64
-	Host   string
-	ID     string
-	Cmd    []string
+	Image       string
+	Name        string
+	Disk        uint64
+	Memory      uint64
+	Cores       uint64
+	Host        string
+	ID          string
+	Cmd         []string
+	Namespace   string
+	Owner       string
+	CoresLimit  uint64
+	MemoryLimit uint64
+	DiskLimit   uint64
+	State       string
+	ExitCode    int
+	OOMKilled   bool
+	Ports       []Port
+	Endpoints   []string
+	Env         map[string]string
+	Secrets     []SecretRef
+	Volumes     []Volume
+	Liveness    *Probe
+	Readiness   *Probe
+	// Ready is maintained by the prober, containers without a readiness
+	// probe are ready while running.
+	Ready         bool
+	RestartCount  uint64
+	RestartPolicy RestartPolicy
+	StopSignal    string
+	StopTimeout   uint64
+	Lifecycle     *Lifecycle
+	// Stopped is set when the container was stopped through rws,
+	// the restart policy doesn't apply to it then.
+	Stopped            bool
+	ImagePullPolicy    string
+	RegistryCredential string
+	// PullStatus is the image pull progress, PullError why it failed.
+	// PullStartedAt lets the garbage collector find stuck pulls.
+	PullStatus    string
+	PullError     string
+	PullStartedAt time.Time
+	// StartedAt and FinishedAt are copied from the runtime by the monitor.
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Pod is the owner reference to the pod that created the container,
+	// the garbage collector removes the container when the pod is gone.
+	Pod string
+	// Replica names the pod replica the container belongs to. Containers
+	// of a replica join the network of NetworkContainer and can share
+	// SharedVolumes.
+	Replica          string
+	NetworkContainer string
+	SharedVolumes    []SharedVolume
+	// Init containers run to completion before the replica starts.
+	Init bool
+	// SpecHash identifies the spec the container was created from, it
+	// is put on the runtime container as a label.
+	SpecHash string
+	// DNSPolicy is DNSCluster, the default, or DNSHost.
+	DNSPolicy string
+}
+
+// MinMemoryLimit is the smallest memory limit docker accepts.
+const MinMemoryLimit = 6 * 1024 * 1024
+
+// RuntimeSpec converts the container record to what the runtime needs to create it.
+func (c Container) RuntimeSpec() runtimes.Spec {
+	spec := runtimes.Spec{
+		Name:        c.Name,
+		Image:       c.Image,
+		Cmd:         c.Cmd,
+		CPUShares:   c.Cores * 1024,
+		DiskLimit:   c.DiskLimit,
+		Env:         envList(c.Env),
+		StopSignal:  c.StopSignal,
+		StopTimeout: c.StopTimeout,
+		Labels:      c.labels(),
+	}
+	for _, p := range c.Ports {
+		spec.Ports = append(spec.Ports, runtimes.PortBinding{
+			ContainerPort: p.ContainerPort,
+			HostPort:      p.HostPort,
+			Protocol:      p.protocol(),
+		})
+	}
+	coresLimit := c.CoresLimit
+	if coresLimit == 0 {
+		coresLimit = c.Cores
+	}
+	spec.NanoCPUs = coresLimit * 1e9
+	// A request below what docker accepts isn't made a hard limit, it
+	// would get the container OOM killed.
+	memoryLimit := c.MemoryLimit
+	if memoryLimit == 0 && c.Memory >= MinMemoryLimit {
+		memoryLimit = c.Memory
+	}
+	if memoryLimit > 0 && memoryLimit < MinMemoryLimit {
+		memoryLimit = MinMemoryLimit
+	}
+	spec.MemoryLimit = memoryLimit
+	if c.Memory >= MinMemoryLimit && (memoryLimit == 0 || c.Memory < memoryLimit) {
+		spec.MemoryReservation = c.Memory
+	}
+	return spec
+}
+
+// hostPath translates a path under conf.DataDir to where the runtime
+// finds it on the host, for bind mount sources.
+func hostPath(p string) string {
+	rel, err := filepath.Rel(conf.DataDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return p
+	}
+	return filepath.Join(conf.HostDataDir, rel)
+}
+
+// joinNetwork makes the container share the network namespace of
+// NetworkContainer, which has to be running on this host.
+func joinNetwork(spec *runtimes.Spec, c Container) error {
+	if c.NetworkContainer == "" {
+		return nil
+	}
+	if len(c.Ports) > 0 {
+		return errors.New("container " + c.Name + " shares the network of " + c.NetworkContainer + " and can't publish ports")
+	}
+	nc, err := GetContainer(c.NetworkContainer)
+	if err != nil {
+		return err
+	}
+	if !hosts.IsLocal(nc.Host) || nc.State != "running" {
+		return errors.New("network container " + nc.Name + " is not running on this host")
+	}
+	spec.NetworkContainer = nc.ID
+	return nil
 }
 
 func GetHostContainers(host string, port uint64) ([]Container, error) {
@@ -46,7 +176,7 @@ func GetHostContainers(host string, port uint64) ([]Container, error) {
 		log.Println(1, err2)
 		return []Container{}, err2
 	}
-	if len(BodyBytes) == 0 {
+	if len(BodyBytes) == 0 || string(BodyBytes) == "{}" {
 		log.Println(1, "no containers running on Host")
 		return []Container{}, nil
 	}
@@ -60,93 +190,136 @@ func GetHostContainers(host string, port uint64) ([]Container, error) {
 	return HostContainers, nil
 }
 
-func RunContainer(imageName, containerName string, cmd []string) (string, error) {
+func RunContainer(cont Container) (string, error) {
 	log.Println(1, "RunContainer")
 	ctx := context.Background()
-	c := client.WithVersion("1.38")
-	cli, err := client.NewClientWithOpts(c)
+	rt := runtimes.Get()
+	cont.Host = conf.LocalHostName
+	if localName, err := hosts.LocalName(); err == nil {
+		cont.Host = localName
+	}
+	portsMu.Lock()
+	ports, err := AllocatePorts(cont.Host, cont.Ports)
 	if err != nil {
-		log.Println(1, "RunContainer: client create error")
+		portsMu.Unlock()
+		log.Println(1, "RunContainer: AllocatePorts error")
 		log.Println(1, err)
 		return "", err
 	}
-	out, err2 := cli.ImagePull(ctx, imageName, types.ImagePullOptions{})
+	cont.Ports = ports
+	cont.SpecHash = cont.specHash()
+	existing, err8 := GetContainer(cont.Name)
+	if err8 == nil && (existing.State != "failed" || existing.ID != "") {
+		portsMu.Unlock()
+		return "", errors.New("container " + cont.Name + " already exists")
+	}
+	cont.State = "pulling"
+	cont.PullStartedAt = time.Now()
+	err9 := saveRecord(cont)
+	portsMu.Unlock()
+	if err9 != nil {
+		log.Println(1, "RunContainer: etcd.SetKey error")
+		log.Println(1, err9)
+		return "", err9
+	}
+	err2 := pullImage(ctx, &cont)
 	if err2 != nil {
 		log.Println(1, "RunContainer: image pull error")
-		log.Println(1, out)
 		log.Println(1, err2)
+		cont.State = "failed"
+		cont.PullError = err2.Error()
+		cont.FinishedAt = time.Now()
+		saveRecord(cont)
 		return "", err2
 	}
-	resp, err3 := cli.ContainerCreate(ctx, &container.Config{
-		Image: imageName,
-		Cmd:   cmd,
-	}, nil, nil, containerName)
+	cont.State = "creating"
+	cont.PullError = ""
+	saveRecord(cont)
+	spec := cont.RuntimeSpec()
+	err7 := joinNetwork(&spec, cont)
+	if err7 == nil {
+		err7 = injectSecrets(&spec, cont)
+	}
+	if err7 == nil {
+		err7 = prepareVolumes(&spec, cont)
+	}
+	if err7 == nil {
+		err7 = prepareSharedVolumes(&spec, cont)
+	}
+	if err7 == nil {
+		err7 = injectDNS(&spec, cont)
+	}
+	if err7 != nil {
+		log.Println(1, "RunContainer: network, secrets, volumes or DNS error")
+		log.Println(1, err7)
+		removeSecrets(cont.Name)
+		removeVolumes(cont.Name)
+		removeResolvConf(cont.Name)
+		removeSharedVolumes(cont)
+		etcd.DeleteKey("/rws/containers/" + cont.Name)
+		return "", err7
+	}
+	id, err3 := rt.Create(ctx, spec)
 	if err3 != nil {
 		log.Println(1, "RunContainer: container create error")
-		log.Println(1, resp)
 		log.Println(1, err3)
+		removeSecrets(cont.Name)
+		removeVolumes(cont.Name)
+		removeResolvConf(cont.Name)
+		removeSharedVolumes(cont)
+		etcd.DeleteKey("/rws/containers/" + cont.Name)
 		return "", err3
 	}
-	err4 := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+	err4 := rt.Start(ctx, id)
 	if err4 != nil {
 		log.Println(1, "RunContainer: container start error")
 		log.Println(1, err4)
+		err10 := rt.Remove(ctx, id)
+		if err10 != nil {
+			log.Println(1, "RunContainer: container remove error")
+			log.Println(1, err10)
+		}
+		removeSecrets(cont.Name)
+		removeVolumes(cont.Name)
+		removeResolvConf(cont.Name)
+		removeSharedVolumes(cont)
+		etcd.DeleteKey("/rws/containers/" + cont.Name)
 		return "", err4
 	}
-	cont := Container{Name: containerName, Image: imageName, Host: conf.LocalHostName, ID: resp.ID}
-	containerBytes, err5 := json.Marshal(cont)
-	if err5 != nil {
-		return "", err5
-	}
-	err6 := etcd.CreateKey("/rws/containers/"+containerName, string(containerBytes))
+	cont.ID = id
+	cont.State = "running"
+	cont.Ready = cont.Readiness == nil
+	cont.Endpoints = cont.endpoints()
+	err6 := saveRecord(cont)
 	if err6 != nil {
-		log.Println(1, "RunContainer: etcd.CreateKey error")
+		log.Println(1, "RunContainer: etcd.SetKey error")
 		log.Println(1, err6)
 		return "", err6
 	}
-	log.Println(1, "RunContainer: container "+resp.ID+" running")
-	return resp.ID, nil
+	log.Println(1, "RunContainer: container "+id+" running")
+	cont.postStart()
+	return id, nil
 }
 
+// ListLocalContainers returns the records of containers running on this
+// host, which the monitor keeps in sync with the runtime.
 func ListLocalContainers() (string, error) {
 	log.Println(1, "ListLocalContainers")
-	c := client.WithVersion("1.38")
-	cli, err := client.NewClientWithOpts(c)
+	records, err := localRecords()
 	if err != nil {
-		log.Println(1, "ListLocalContainers: client create error")
-		log.Println(1, err)
-		return "client create error", err
+		log.Println(1, "ListLocalContainers: etcd.ListDir error")
+		return "", err
 	}
-	localContainers, err2 := cli.ContainerList(context.Background(), types.ContainerListOptions{})
-	if err2 != nil {
-		log.Println(1, "ListLocalContainers: containerList error")
-		log.Println(1, err2)
-		return "containerList error", err2
+	var returnContainers []Container
+	for _, c := range records {
+		if c.State == "running" {
+			returnContainers = append(returnContainers, c)
+		}
 	}
-	if len(localContainers) == 0 {
+	if len(returnContainers) == 0 {
 		log.Println(1, "ListLocalContainers: there is no running containers on this Host")
 		return "{}", nil
 	}
-	var allContainers []Container
-	allContainersString, err3 := ListAllContainers()
-	if err3 != nil {
-		log.Println(1, "ListLocalContainers: ListAllContainers error")
-		return "", err3
-	}
-	err4 := json.Unmarshal([]byte(allContainersString), &allContainers)
-	if err4 != nil {
-		log.Println(1, "ListLocalContainers: json unmarshal error")
-		return "", err4
-	}
-	var returnContainers []Container
-	for _, localContainer := range localContainers {
-		for _, allContainer := range allContainers {
-			if localContainer.ID == allContainer.ID {
-				returnContainers = append(returnContainers, allContainer)
-				break
-			}
-		}
-	}
 	b, err3 := json.Marshal(returnContainers)
 	if err3 != nil {
 		log.Println(1, "json marshal error")
@@ -199,34 +372,57 @@ func ContainerListHandler(w http.ResponseWriter, _ *http.Request) {
 func StopContainer(containerName string) error {
 	log.Println(1, "StopContainer")
 	ctx := context.Background()
-	c := client.WithVersion("1.38")
-	cli, err1 := client.NewClientWithOpts(c)
-	if err1 != nil {
-		log.Println(1, "StopContainer: NewClientWithOpts error")
-		log.Println(1, err1)
-		return err1
-	}
-	ContainerId, err := GetContainerId(containerName)
+	cont, err := GetContainer(containerName)
 	if err != nil {
-		log.Println(1, "StopContainer: ContainerId error")
+		log.Println(1, "StopContainer: GetContainer error")
 		log.Println(1, err)
 		return err
 	}
-	err2 := cli.ContainerStop(ctx, ContainerId, nil)
+	// the record is marked first, so the monitor doesn't restart the
+	// container while it is being stopped
+	cont.Stopped = true
+	cont.Ready = false
+	err4 := saveRecord(cont)
+	if err4 != nil {
+		log.Println(1, "StopContainer: record update error")
+		log.Println(1, err4)
+		return err4
+	}
+	cont.preStop()
+	err2 := runtimes.Get().Stop(ctx, cont.ID)
 	if err2 != nil {
 		log.Println(1, "StopContainer: ContainerStop error")
 		log.Println(1, err2)
+		current, err5 := loadRecord(cont.Name)
+		if err5 == nil && current.ID == cont.ID {
+			current.Stopped = false
+			saveRecord(current)
+		}
 		return err2
 	}
+	err3 := writeBackVolumes(cont)
+	if err3 != nil {
+		log.Println(1, "StopContainer: writeBackVolumes error")
+		log.Println(1, err3)
+		return err3
+	}
 	return nil
 }
 
 func GetContainerId(containerName string) (string, error) {
 	log.Println(1, "GetContainerId")
-	dir, err := etcd.ListDir("/rws/containers/")
+	cont, err := GetContainer(containerName)
 	if err != nil {
 		return "", err
 	}
+	return cont.ID, nil
+}
+
+func GetContainer(containerName string) (Container, error) {
+	dir, err := etcd.ListDir("/rws/containers/")
+	if err != nil {
+		return Container{}, err
+	}
 	found := false
 	for _, c := range dir {
 		keySplit := strings.Split(c.Key, "/")
@@ -237,47 +433,108 @@ func GetContainerId(containerName string) (string, error) {
 		}
 	}
 	if found == false {
-		return "", errors.New("container doesn't exist")
+		return Container{}, errors.New("container doesn't exist")
 	}
 	containerString, err2 := etcd.GetKey("/rws/containers/" + containerName)
 	if err2 != nil {
-		return "", err2
+		return Container{}, err2
 	}
 	var cont Container
 	err3 := json.Unmarshal([]byte(containerString), &cont)
 	if err3 != nil {
-		return "", err3
+		return Container{}, err3
 	}
-	return cont.ID, nil
+	return cont, nil
 }
 
 func RemoveContainer(containerName string) error {
 	log.Println(1, "RemoveContainer")
-	ContainerID, err := GetContainerId(containerName)
+	cont, err := GetContainer(containerName)
 	if err != nil {
-		log.Println(1, "RemoveContainer: GetContainerId error")
+		log.Println(1, "RemoveContainer: GetContainer error")
 		log.Println(1, err)
 		return err
 	}
+	ContainerID := cont.ID
 	ctx := context.Background()
-	c := client.WithVersion("1.38")
-	cli, err1 := client.NewClientWithOpts(c)
-	if err1 != nil {
-		log.Println(1, "client create error:")
-		log.Println(1, err1)
-		return err1
-	}
-	opts := types.ContainerRemoveOptions{RemoveVolumes: false, RemoveLinks: false, Force: false}
-	err2 := cli.ContainerRemove(ctx, ContainerID, opts)
+	var err2 error
+	if ContainerID != "" {
+		// containers whose image pull failed were never created
+		err2 = runtimes.Get().Remove(ctx, ContainerID)
+	}
 	if err2 != nil {
 		log.Println(1, "RemoveContainer: container remove error:")
 		log.Println(1, err2)
 		return err2
 	}
+	err3 := removeSecrets(containerName)
+	if err3 == nil {
+		err3 = removeVolumes(containerName)
+	}
+	if err3 == nil {
+		err3 = removeSharedVolumes(cont)
+	}
+	if err3 == nil {
+		err3 = removeResolvConf(containerName)
+	}
+	if err3 != nil {
+		log.Println(1, "RemoveContainer: local files remove error")
+		log.Println(1, err3)
+	}
+	err4 := etcd.DeleteKey("/rws/containers/" + containerName)
+	if err4 != nil {
+		log.Println(1, "RemoveContainer: etcd.DeleteKey error")
+		log.Println(1, err4)
+		return err4
+	}
 	log.Println(1, "RemoveContainer: Container "+ContainerID+" removed")
 	return nil
 }
 
+// Delete stops the container if it runs and removes it, on whichever
+// host it is.
+func Delete(containerName string) error {
+	log.Println(1, "Delete")
+	cont, err := GetContainer(containerName)
+	if err != nil {
+		return err
+	}
+	if hosts.IsLocal(cont.Host) {
+		if cont.State == "running" {
+			err2 := StopContainer(containerName)
+			if err2 != nil {
+				return err2
+			}
+		}
+		return RemoveContainer(containerName)
+	}
+	if cont.State == "running" {
+		err3 := postContainer(cont, "container_stop")
+		if err3 != nil {
+			return err3
+		}
+	}
+	return postContainer(cont, "container_remove")
+}
+
+// postContainer sends the container to an action on the host running it.
+func postContainer(cont Container, action string) error {
+	b, err := json.Marshal(cont)
+	if err != nil {
+		return err
+	}
+	resp, err2 := http.Post("http://"+hosts.Addr(cont.Host)+"/"+action, "application/json", bytes.NewBuffer(b))
+	if err2 != nil {
+		return err2
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(action + " on " + cont.Host + " returned " + strconv.Itoa(resp.StatusCode) + ": " + string(body))
+	}
+	return nil
+}
+
 func ContainerRunHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println(1, "ContainerRunHandler")
 	bodyBytes, err2 := ioutil.ReadAll(r.Body)
@@ -300,10 +557,19 @@ func ContainerRunHandler(w http.ResponseWriter, r *http.Request) {
 	if err3 != nil {
 		utils.Fail("ContainerRunHandler: json.Unmarshal error", err3, w)
 	}
+	err4 := quotas.CheckContainer(c.Namespace, c.Owner, c.Cores, c.Memory, c.Disk)
+	if err4 == nil {
+		requested := quotas.Usage{Cores: c.Cores, Memory: c.Memory, Disk: c.Disk, Containers: 1}
+		err4 = quotas.Check(c.Namespace, c.Owner, requested)
+	}
+	if err4 != nil {
+		utils.Forbidden("ContainerRunHandler: quota check failed", err4, w)
+		return
+	}
 	if ThatHost.Disk >= c.Disk &&
 		ThatHost.Cores >= c.Cores &&
 		ThatHost.Memory >= c.Memory {
-		id, err := RunContainer(c.Image, c.Name, c.Cmd)
+		id, err := RunContainer(c)
 		if err != nil {
 			utils.Fail("ContainerRunHandler: RunContainer error", err, w)
 			return
@@ -357,14 +623,14 @@ func ContainerStopHandler(w http.ResponseWriter, r *http.Request) {
 		utils.Fail("ContainerStopHandler: container not found", errors.New(""), w)
 		return
 	}
-	if cont.Host == conf.LocalHostName {
+	if hosts.IsLocal(cont.Host) {
 		err2 := StopContainer(cont.Name)
 		if err2 != nil {
 			utils.Fail("ContainerStopHandler: stopContainer utils.Failure", err2, w)
 			return
 		}
 	} else {
-		url := "http://" + cont.Host + "/container_stop/" + cont.Name
+		url := "http://" + hosts.Addr(cont.Host) + "/container_stop"
 		b, err2 := json.Marshal(cont)
 		if err2 != nil {
 			utils.Fail("ContainerStopHandler: json Marshal error", err2, w)
@@ -374,7 +640,7 @@ func ContainerStopHandler(w http.ResponseWriter, r *http.Request) {
 		body, err3 := http.Post(url, "application/json", buf)
 		if err3 == nil {
 			if body.StatusCode != 200 {
-				utils.Fail("ContainerStopHandler: http.Post status code error: "+string(body.StatusCode), err3, w)
+				utils.Fail("ContainerStopHandler: http.Post status code error: "+strconv.Itoa(body.StatusCode), err3, w)
 				return
 			}
 		} else {
@@ -426,7 +692,7 @@ func ContainerRemoveHandler(w http.ResponseWriter, r *http.Request) {
 		utils.Fail("ContainerRemoveHandler: container not found", errors.New(""), w)
 		return
 	}
-	if cont.Host == conf.LocalHostName {
+	if hosts.IsLocal(cont.Host) {
 		err2 := RemoveContainer(c.Name)
 		if err2 == nil {
 			fmt.Fprintf(w, "OK")
@@ -435,7 +701,7 @@ func ContainerRemoveHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
-		url := "http://" + cont.Host + "/container_remove"
+		url := "http://" + hosts.Addr(cont.Host) + "/container_remove"
 		b, err2 := json.Marshal(c)
 		if err2 != nil {
 			log.Println(1, err2)
@@ -445,7 +711,7 @@ func ContainerRemoveHandler(w http.ResponseWriter, r *http.Request) {
 		body, err3 := http.Post(url, "application/json", buf)
 		if err3 == nil {
 			if body.StatusCode != 200 {
-				utils.Fail("ContainerRemovepHandler: http.Post status code error: "+string(body.StatusCode), err3, w)
+				utils.Fail("ContainerRemovepHandler: http.Post status code error: "+strconv.Itoa(body.StatusCode), err3, w)
 				return
 			}
 		} else {
@@ -0,0 +1,210 @@
+package containers
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"github.com/loqutus/rws/pkg/server/storage"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+// CopyRequest is the body of container_cp_storage. It copies the file at
+// Path in container Name to the storage file File, or the other way
+// round unless ToStorage is set.
+type CopyRequest struct {
+	Name      string
+	Path      string
+	File      string
+	ToStorage bool
+}
+
+func cpURL(c Container, p string) string {
+	q := url.Values{}
+	q.Set("name", c.Name)
+	q.Set("path", p)
+	return "http://" + hosts.Addr(c.Host) + "/container_cp?" + q.Encode()
+}
+
+// CopyFrom returns a tar archive of path in the container, from the local
+// runtime or from the host running it.
+func CopyFrom(ctx context.Context, name, p string) (io.ReadCloser, error) {
+	cont, err := GetContainer(name)
+	if err != nil {
+		return nil, err
+	}
+	if hosts.IsLocal(cont.Host) {
+		return runtimes.Get().CopyFrom(ctx, cont.ID, p)
+	}
+	r, err2 := http.NewRequest("GET", cpURL(cont, p), nil)
+	if err2 != nil {
+		return nil, err2
+	}
+	resp, err3 := http.DefaultClient.Do(r.WithContext(ctx))
+	if err3 != nil {
+		return nil, err3
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, errors.New("CopyFrom: " + cont.Host + " returned " + strconv.Itoa(resp.StatusCode) + ": " + string(b))
+	}
+	return resp.Body, nil
+}
+
+// CopyTo extracts the tar archive content into dir in the container.
+func CopyTo(ctx context.Context, name, dir string, content io.Reader) error {
+	cont, err := GetContainer(name)
+	if err != nil {
+		return err
+	}
+	if hosts.IsLocal(cont.Host) {
+		return runtimes.Get().CopyTo(ctx, cont.ID, dir, content)
+	}
+	r, err2 := http.NewRequest("PUT", cpURL(cont, dir), content)
+	if err2 != nil {
+		return err2
+	}
+	r.Header.Set("Content-Type", "application/x-tar")
+	resp, err3 := http.DefaultClient.Do(r.WithContext(ctx))
+	if err3 != nil {
+		return err3
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("CopyTo: " + cont.Host + " returned " + strconv.Itoa(resp.StatusCode) + ": " + string(b))
+	}
+	return nil
+}
+
+// CopyStorage copies a single file between a container and the storage.
+// Files copied to the storage get the namespace and owner of the container.
+func CopyStorage(ctx context.Context, req CopyRequest) error {
+	cont, err := GetContainer(req.Name)
+	if err != nil {
+		return err
+	}
+	if req.File == "" || req.Path == "" {
+		return errors.New("container path and storage file required")
+	}
+	if req.ToStorage {
+		rc, err2 := CopyFrom(ctx, req.Name, req.Path)
+		if err2 != nil {
+			return err2
+		}
+		defer rc.Close()
+		tr := tar.NewReader(rc)
+		hdr, err3 := tr.Next()
+		if err3 != nil {
+			return err3
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return errors.New(req.Path + " is not a regular file")
+		}
+		data, err4 := ioutil.ReadAll(tr)
+		if err4 != nil {
+			return err4
+		}
+		return storage.Put(req.File, cont.Namespace, cont.Owner, data)
+	}
+	data, err5 := storage.Fetch(req.File)
+	if err5 != nil {
+		return err5
+	}
+	dir, name := path.Split(req.Path)
+	if name == "" {
+		name = req.File
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	err6 := tw.WriteHeader(hdr)
+	if err6 != nil {
+		return err6
+	}
+	_, err7 := tw.Write(data)
+	if err7 != nil {
+		return err7
+	}
+	err8 := tw.Close()
+	if err8 != nil {
+		return err8
+	}
+	if dir == "" {
+		dir = "/"
+	}
+	return CopyTo(ctx, req.Name, dir, &buf)
+}
+
+// ContainerCpHandler streams a tar archive of path out of the container
+// on GET and extracts the tar archive in the body into path on PUT.
+func ContainerCpHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "ContainerCpHandler")
+	name := r.URL.Query().Get("name")
+	p := r.URL.Query().Get("path")
+	if name == "" || p == "" {
+		utils.Fail("ContainerCpHandler: no name or path", errors.New("container name and path required"), w)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		rc, err := CopyFrom(r.Context(), name, p)
+		if err != nil {
+			utils.Fail("ContainerCpHandler: CopyFrom error", err, w)
+			return
+		}
+		defer rc.Close()
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.WriteHeader(http.StatusOK)
+		_, err2 := io.Copy(w, rc)
+		if err2 != nil {
+			log.Println(1, "ContainerCpHandler: stream error")
+			log.Println(1, err2)
+		}
+	case "PUT":
+		err := CopyTo(r.Context(), name, p, r.Body)
+		if err != nil {
+			utils.Fail("ContainerCpHandler: CopyTo error", err, w)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func ContainerCpStorageHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "ContainerCpStorageHandler")
+	var req CopyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.Fail("ContainerCpStorageHandler: json decode error", err, w)
+		return
+	}
+	err2 := CopyStorage(r.Context(), req)
+	if err2 != nil {
+		utils.Fail("ContainerCpStorageHandler: CopyStorage error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,67 @@
+package containers
+
+import (
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// DNS policies. Containers use the DNS server of the agent by default,
+// DNSHost keeps the resolv.conf the runtime gives them.
+const (
+	DNSCluster = "cluster"
+	DNSHost    = "host"
+)
+
+func resolvDir(containerName string) string {
+	return filepath.Join(conf.DataDir, conf.StateDir, "resolv", containerName)
+}
+
+// injectDNS bind-mounts a resolv.conf pointing to the agent's DNS server,
+// names are searched in the container's namespace first.
+func injectDNS(spec *runtimes.Spec, c Container) error {
+	switch c.DNSPolicy {
+	case DNSHost:
+		return nil
+	case "", DNSCluster:
+	default:
+		return errors.New("unknown DNS policy " + c.DNSPolicy)
+	}
+	ip, err := hosts.AdvertisedIP()
+	if err != nil && c.DNSPolicy == "" {
+		log.Println(1, "injectDNS: no advertised address, container "+c.Name+" keeps the runtime's DNS")
+		log.Println(1, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	namespace := c.Namespace
+	if namespace == "" {
+		namespace = conf.DNSDefaultNamespace
+	}
+	dir := resolvDir(c.Name)
+	err2 := os.MkdirAll(dir, 0755)
+	if err2 != nil {
+		return err2
+	}
+	file := filepath.Join(dir, "resolv.conf")
+	content := "nameserver " + ip.String() + "\n" +
+		"search " + namespace + "." + conf.DNSDomain + " " + conf.DNSDomain + "\n" +
+		"options ndots:2\n"
+	err3 := ioutil.WriteFile(file, []byte(content), 0644)
+	if err3 != nil {
+		return err3
+	}
+	spec.Mounts = append(spec.Mounts, runtimes.Mount{Source: hostPath(file), Target: "/etc/resolv.conf", ReadOnly: true})
+	return nil
+}
+
+func removeResolvConf(containerName string) error {
+	return os.RemoveAll(resolvDir(containerName))
+}
@@ -0,0 +1,181 @@
+package containers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"golang.org/x/net/context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// container_exec is a WebSocket. The client sends an ExecRequest as the
+// first text message, after that every binary message starts with one of
+// the Exec* channel bytes followed by the payload. An empty ExecStdin
+// message closes stdin, the last message is ExecExit with the exit code.
+const (
+	ExecStdin  = 0
+	ExecStdout = 1
+	ExecStderr = 2
+	ExecResize = 3
+	ExecExit   = 4
+)
+
+type ExecRequest struct {
+	Name string
+	Cmd  []string
+	Tty  bool
+}
+
+var upgrader = websocket.Upgrader{}
+
+// execWriter sends everything written to it as messages of one channel.
+type execWriter struct {
+	conn    *websocket.Conn
+	mu      *sync.Mutex
+	channel byte
+}
+
+func (e execWriter) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	err := e.conn.WriteMessage(websocket.BinaryMessage, append([]byte{e.channel}, p...))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func ContainerExecHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "ContainerExecHandler")
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(1, "ContainerExecHandler: websocket upgrade error")
+		log.Println(1, err)
+		return
+	}
+	defer conn.Close()
+	_, first, err2 := conn.ReadMessage()
+	if err2 != nil {
+		log.Println(1, "ContainerExecHandler: request read error")
+		log.Println(1, err2)
+		return
+	}
+	var req ExecRequest
+	err3 := json.Unmarshal(first, &req)
+	if err3 != nil {
+		execFail(conn, err3)
+		return
+	}
+	cont, err4 := GetContainer(req.Name)
+	if err4 != nil {
+		execFail(conn, err4)
+		return
+	}
+	if hosts.IsLocal(cont.Host) {
+		runExec(conn, cont, req)
+	} else {
+		proxyExec(conn, cont, first)
+	}
+}
+
+func execFail(conn *websocket.Conn, err error) {
+	log.Println(1, "container_exec error")
+	log.Println(1, err)
+	conn.WriteMessage(websocket.BinaryMessage, append([]byte{ExecStderr}, []byte(err.Error()+"\n")...))
+	conn.WriteMessage(websocket.BinaryMessage, append([]byte{ExecExit}, []byte("-1")...))
+}
+
+func runExec(conn *websocket.Conn, cont Container, req ExecRequest) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stdinReader, stdinWriter := io.Pipe()
+	resize := make(chan runtimes.TerminalSize, 1)
+	go func() {
+		defer stdinWriter.Close()
+		defer close(resize)
+		stdinOpen := true
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				// the client went away
+				cancel()
+				return
+			}
+			if len(message) == 0 {
+				continue
+			}
+			switch message[0] {
+			case ExecStdin:
+				if len(message) == 1 && stdinOpen {
+					stdinWriter.Close()
+					stdinOpen = false
+				} else if stdinOpen {
+					stdinWriter.Write(message[1:])
+				}
+			case ExecResize:
+				var size runtimes.TerminalSize
+				if json.Unmarshal(message[1:], &size) == nil {
+					select {
+					case resize <- size:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	var mu sync.Mutex
+	streams := runtimes.ExecStreams{
+		Stdin:  stdinReader,
+		Stdout: execWriter{conn, &mu, ExecStdout},
+		Stderr: execWriter{conn, &mu, ExecStderr},
+		Resize: resize,
+	}
+	code, err := runtimes.Get().Exec(ctx, cont.ID, runtimes.ExecOptions{Cmd: req.Cmd, Tty: req.Tty}, streams)
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		execFail(conn, err)
+		return
+	}
+	log.Println(1, "ContainerExecHandler: exec in "+cont.Name+" exited with "+strconv.Itoa(code))
+	conn.WriteMessage(websocket.BinaryMessage, append([]byte{ExecExit}, []byte(strconv.Itoa(code))...))
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// proxyExec relays the session to the host running the container.
+func proxyExec(conn *websocket.Conn, cont Container, first []byte) {
+	remote, _, err := websocket.DefaultDialer.Dial("ws://"+hosts.Addr(cont.Host)+"/container_exec", nil)
+	if err != nil {
+		execFail(conn, errors.New("can't connect to "+cont.Host+": "+err.Error()))
+		return
+	}
+	defer remote.Close()
+	err2 := remote.WriteMessage(websocket.TextMessage, first)
+	if err2 != nil {
+		execFail(conn, err2)
+		return
+	}
+	done := make(chan struct{}, 2)
+	relay := func(from, to *websocket.Conn) {
+		defer func() { done <- struct{}{} }()
+		for {
+			messageType, message, err := from.ReadMessage()
+			if err != nil {
+				return
+			}
+			err2 := to.WriteMessage(messageType, message)
+			if err2 != nil {
+				return
+			}
+		}
+	}
+	go relay(conn, remote)
+	go relay(remote, conn)
+	<-done
+}
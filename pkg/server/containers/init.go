@@ -0,0 +1,76 @@
+package containers
+
+import (
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"golang.org/x/net/context"
+	"log"
+	"strconv"
+	"time"
+)
+
+// waitExit waits until the container is no longer running and copies
+// its exit state into the record.
+func waitExit(c Container) (Container, error) {
+	for {
+		info, err := runtimes.Get().Inspect(context.Background(), c.ID)
+		if err != nil {
+			return c, err
+		}
+		if !info.Running {
+			record, err2 := GetContainer(c.Name)
+			if err2 != nil {
+				return c, err2
+			}
+			record.State = info.State
+			record.ExitCode = info.ExitCode
+			record.OOMKilled = info.OOMKilled
+			record.StartedAt = info.StartedAt
+			record.FinishedAt = info.FinishedAt
+			return record, saveRecord(record)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// RunToCompletion runs an init container and waits for it to exit. A
+// failed container is started again with backoff up to conf.InitRetries
+// times, RestartCount counts the attempts. The exited container is kept
+// so its status and logs can be looked at.
+func RunToCompletion(c Container) (Container, error) {
+	c.Init = true
+	c.RestartPolicy = RestartPolicy{}
+	_, err := RunContainer(c)
+	if err != nil {
+		return c, err
+	}
+	record, err2 := GetContainer(c.Name)
+	if err2 != nil {
+		return c, err2
+	}
+	for {
+		record, err = waitExit(record)
+		if err != nil {
+			return record, err
+		}
+		if record.ExitCode == 0 {
+			log.Println(1, "RunToCompletion: init container "+c.Name+" completed")
+			return record, nil
+		}
+		if record.RestartCount >= conf.InitRetries {
+			return record, errors.New("init container " + c.Name + " exited with " + strconv.Itoa(record.ExitCode))
+		}
+		delay := restartDelay(record)
+		log.Println(1, "RunToCompletion: init container "+c.Name+" exited with "+strconv.Itoa(record.ExitCode)+", retrying in "+delay.String())
+		time.Sleep(delay)
+		err3 := startAgain(record)
+		if err3 != nil {
+			return record, err3
+		}
+		record, err = GetContainer(c.Name)
+		if err != nil {
+			return record, err
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package containers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"golang.org/x/net/context"
+	"log"
+	"time"
+)
+
+// Labels rws puts on the runtime containers it creates.
+const (
+	LabelCluster   = "rws.cluster"
+	LabelName      = "rws.name"
+	LabelPod       = "rws.pod"
+	LabelNamespace = "rws.namespace"
+	LabelSpecHash  = "rws.spec-hash"
+)
+
+// Spec returns the record without the fields set by rws while the
+// container runs, what is left describes the container.
+func (c Container) Spec() Container {
+	c.Host = ""
+	c.ID = ""
+	c.State = ""
+	c.ExitCode = 0
+	c.OOMKilled = false
+	c.Endpoints = nil
+	c.Ready = false
+	c.RestartCount = 0
+	c.Stopped = false
+	c.PullStatus = ""
+	c.PullError = ""
+	c.PullStartedAt = time.Time{}
+	c.StartedAt = time.Time{}
+	c.FinishedAt = time.Time{}
+	c.SpecHash = ""
+	return c
+}
+
+// specHash hashes the spec of the container.
+func (c Container) specHash() string {
+	b, err := json.Marshal(c.Spec())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c Container) labels() map[string]string {
+	return map[string]string{
+		LabelCluster:   conf.ClusterID,
+		LabelName:      c.Name,
+		LabelPod:       c.Pod,
+		LabelNamespace: c.Namespace,
+		LabelSpecHash:  c.SpecHash,
+	}
+}
+
+// Recover looks at every container of the runtime when the agent starts.
+// Labelled containers with a matching record are adopted, ones whose
+// record is gone are adopted as long as their pod still exists, and the
+// rest is removed. Unlabelled containers are imported as standalone
+// records if conf.ImportUnmanaged is set.
+func Recover() {
+	log.Println(1, "Recover")
+	ctx := context.Background()
+	l, err := runtimes.Get().List(ctx, true)
+	if err != nil {
+		log.Println(1, "Recover: runtime List error")
+		log.Println(1, err)
+		return
+	}
+	host := conf.LocalHostName
+	if localName, err2 := hosts.LocalName(); err2 == nil {
+		host = localName
+	}
+	for _, info := range l {
+		if info.Labels[LabelCluster] == "" {
+			if conf.ImportUnmanaged {
+				importContainer(info, host)
+			}
+			continue
+		}
+		if info.Labels[LabelCluster] != conf.ClusterID {
+			continue
+		}
+		recoverContainer(info, host)
+	}
+}
+
+func recoverContainer(info runtimes.Info, host string) {
+	name := info.Labels[LabelName]
+	if name == "" {
+		return
+	}
+	record, err := GetContainer(name)
+	switch {
+	case err == nil && record.ID == info.ID:
+		return
+	case err == nil && record.ID == "" && record.SpecHash == info.Labels[LabelSpecHash] && hosts.IsLocal(record.Host):
+		// the agent stopped between creating the container and saving its ID
+		log.Println(1, "Recover: adopting container "+name+" into its record")
+		record.ID = info.ID
+		record.State = info.State
+		record.PullError = ""
+		err2 := saveRecord(record)
+		if err2 != nil {
+			log.Println(1, "Recover: etcd.SetKey error")
+			log.Println(1, err2)
+		}
+	case err == nil:
+		log.Println(1, "Recover: container "+info.ID+" is not the one recorded for "+name+", removing it")
+		removeRuntimeContainer(info)
+	case info.Labels[LabelPod] != "" && !podExists(info.Labels[LabelPod]):
+		log.Println(1, "Recover: pod "+info.Labels[LabelPod]+" of container "+name+" is gone, removing it")
+		removeRuntimeContainer(info)
+	default:
+		log.Println(1, "Recover: adopting container "+name)
+		c := Container{
+			Name:      name,
+			Image:     info.Image,
+			Pod:       info.Labels[LabelPod],
+			Namespace: info.Labels[LabelNamespace],
+			SpecHash:  info.Labels[LabelSpecHash],
+			Host:      host,
+			ID:        info.ID,
+			State:     info.State,
+		}
+		err3 := createRecord(c)
+		if err3 != nil {
+			log.Println(1, "Recover: etcd.CreateKey error")
+			log.Println(1, err3)
+		}
+	}
+}
+
+// importContainer creates a standalone record for a container rws
+// didn't create. Containers whose name is taken by a record are skipped.
+func importContainer(info runtimes.Info, host string) {
+	if info.Name == "" {
+		return
+	}
+	records, err := localRecords()
+	if err != nil {
+		log.Println(1, "Recover: etcd.ListDir error")
+		log.Println(1, err)
+		return
+	}
+	for _, r := range records {
+		if r.ID == info.ID {
+			return
+		}
+	}
+	c := Container{
+		Name:  info.Name,
+		Image: info.Image,
+		Host:  host,
+		ID:    info.ID,
+		State: info.State,
+	}
+	err2 := createRecord(c)
+	if err2 != nil {
+		log.Println(1, "Recover: not importing container "+c.Name)
+		log.Println(1, err2)
+		return
+	}
+	log.Println(1, "Recover: imported container "+c.Name)
+}
+
+// podExists says yes when it can't tell, so nothing is removed while etcd
+// is unreachable.
+func podExists(name string) bool {
+	dir, err := etcd.ListDir("/rws/pods")
+	if err != nil {
+		return true
+	}
+	for _, node := range dir {
+		if node.Key == "/rws/pods/"+name {
+			return true
+		}
+	}
+	return false
+}
+
+func removeRuntimeContainer(info runtimes.Info) {
+	ctx := context.Background()
+	rt := runtimes.Get()
+	if info.Running {
+		err := rt.Stop(ctx, info.ID)
+		if err != nil {
+			log.Println(1, "Recover: runtime Stop error")
+			log.Println(1, err)
+			return
+		}
+	}
+	err2 := rt.Remove(ctx, info.ID)
+	if err2 != nil {
+		log.Println(1, "Recover: runtime Remove error")
+		log.Println(1, err2)
+	}
+}
+
+func createRecord(c Container) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return etcd.CreateKey("/rws/containers/"+c.Name, string(b))
+}
@@ -0,0 +1,65 @@
+package containers
+
+import (
+	"log"
+)
+
+// RestartPolicy tells the agent what to do when a container exits:
+// "always" restarts it, "on-failure" restarts it after a non-zero exit
+// at most MaxRetries times (zero is unlimited), "never" or empty leaves it.
+type RestartPolicy struct {
+	Name       string
+	MaxRetries uint64
+}
+
+// Lifecycle hooks are exec or http probes run after the container starts
+// and before it is stopped. Their Timeout defaults to DefaultHookTimeout.
+type Lifecycle struct {
+	PostStart *Probe
+	PreStop   *Probe
+}
+
+const DefaultHookTimeout = 30
+
+// ShouldRestart reports whether the restart policy wants an exited
+// container started again. Containers stopped through rws stay stopped.
+func (c Container) ShouldRestart() bool {
+	if c.Stopped || (c.State != "exited" && c.State != "dead") {
+		return false
+	}
+	switch c.RestartPolicy.Name {
+	case "always":
+		return true
+	case "on-failure":
+		return c.ExitCode != 0 && (c.RestartPolicy.MaxRetries == 0 || c.RestartCount < c.RestartPolicy.MaxRetries)
+	default:
+		return false
+	}
+}
+
+func runHook(c Container, name string, hook *Probe) {
+	if hook == nil {
+		return
+	}
+	h := *hook
+	if h.Timeout == 0 {
+		h.Timeout = DefaultHookTimeout
+	}
+	err := runProbe(c, h)
+	if err != nil {
+		log.Println(1, name+" hook of "+c.Name+" failed")
+		log.Println(1, err)
+	}
+}
+
+func (c Container) postStart() {
+	if c.Lifecycle != nil {
+		runHook(c, "PostStart", c.Lifecycle.PostStart)
+	}
+}
+
+func (c Container) preStop() {
+	if c.Lifecycle != nil {
+		runHook(c, "PreStop", c.Lifecycle.PreStop)
+	}
+}
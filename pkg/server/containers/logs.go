@@ -0,0 +1,98 @@
+package containers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"golang.org/x/net/context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// LogsRequest is the body of container_logs and pod_logs, Name is the
+// container or pod name.
+type LogsRequest struct {
+	Name       string
+	Tail       string
+	Since      string
+	Timestamps bool
+	Follow     bool
+}
+
+// FlushWriter flushes after every write so followed logs reach the client
+// as they are produced.
+type FlushWriter struct {
+	W io.Writer
+}
+
+func (f FlushWriter) Write(p []byte) (int, error) {
+	n, err := f.W.Write(p)
+	if flusher, ok := f.W.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// OpenLogs returns the log stream of a container, from the local runtime
+// or from the host running it.
+func OpenLogs(ctx context.Context, req LogsRequest) (io.ReadCloser, error) {
+	cont, err := GetContainer(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if hosts.IsLocal(cont.Host) {
+		opts := runtimes.LogsOptions{
+			Tail:       req.Tail,
+			Since:      req.Since,
+			Timestamps: req.Timestamps,
+			Follow:     req.Follow,
+		}
+		return runtimes.Get().Logs(ctx, cont.ID, opts)
+	}
+	b, err2 := json.Marshal(req)
+	if err2 != nil {
+		return nil, err2
+	}
+	r, err3 := http.NewRequest("POST", "http://"+hosts.Addr(cont.Host)+"/container_logs", bytes.NewBuffer(b))
+	if err3 != nil {
+		return nil, err3
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp, err4 := http.DefaultClient.Do(r.WithContext(ctx))
+	if err4 != nil {
+		return nil, err4
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("OpenLogs: " + cont.Host + " returned " + strconv.Itoa(resp.StatusCode))
+	}
+	return resp.Body, nil
+}
+
+func ContainerLogsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "ContainerLogsHandler")
+	var req LogsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.Fail("ContainerLogsHandler: json decode error", err, w)
+		return
+	}
+	logs, err2 := OpenLogs(r.Context(), req)
+	if err2 != nil {
+		utils.Fail("ContainerLogsHandler: OpenLogs error", err2, w)
+		return
+	}
+	defer logs.Close()
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	_, err3 := io.Copy(FlushWriter{w}, logs)
+	if err3 != nil {
+		log.Println(1, "ContainerLogsHandler: stream error")
+		log.Println(1, err3)
+	}
+}
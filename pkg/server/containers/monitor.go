@@ -0,0 +1,208 @@
+package containers
+
+import (
+	"encoding/json"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"golang.org/x/net/context"
+	"log"
+	"time"
+)
+
+// maxRestartDelay caps the backoff between restarts of a crashing container.
+const maxRestartDelay = 5 * time.Minute
+
+// OnStateChange is called after the state or readiness of a container
+// changed in its record, the server sets it to update pod status.
+var OnStateChange func(c Container)
+
+func stateChanged(c Container) {
+	if OnStateChange != nil {
+		OnStateChange(c)
+	}
+}
+
+// Monitor keeps the records of containers on this host in sync with the
+// runtime. It recovers the containers left from before the agent started,
+// follows the runtime event stream and resyncs every record when it starts
+// and after the stream was interrupted.
+func Monitor() {
+	Recover()
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		// subscribe first so nothing is missed during the resync
+		events, errs := runtimes.Get().Events(ctx)
+		resync()
+	follow:
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					break follow
+				}
+				syncEvent(e)
+			case err := <-errs:
+				log.Println(1, "Monitor: event stream error")
+				log.Println(1, err)
+				break follow
+			}
+		}
+		cancel()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// localRecords returns the records of containers on this host.
+func localRecords() ([]Container, error) {
+	dir, err := etcd.ListDir("/rws/containers")
+	if err != nil {
+		return nil, err
+	}
+	var l []Container
+	for _, node := range dir {
+		var c Container
+		err := json.Unmarshal([]byte(node.Value), &c)
+		if err != nil {
+			log.Println(1, "localRecords: json.Unmarshal error")
+			log.Println(1, err)
+			continue
+		}
+		if hosts.IsLocal(c.Host) && c.ID != "" {
+			l = append(l, c)
+		}
+	}
+	return l, nil
+}
+
+func resync() {
+	log.Println(1, "Monitor: resync")
+	l, err := localRecords()
+	if err != nil {
+		log.Println(1, "Monitor: etcd.ListDir error")
+		log.Println(1, err)
+		return
+	}
+	for _, c := range l {
+		syncContainer(c, false)
+	}
+}
+
+func syncEvent(e runtimes.Event) {
+	l, err := localRecords()
+	if err != nil {
+		log.Println(1, "Monitor: etcd.ListDir error")
+		log.Println(1, err)
+		return
+	}
+	for _, c := range l {
+		if c.ID == e.ID || c.Name == e.ID {
+			syncContainer(c, e.Action == "oom")
+			return
+		}
+	}
+}
+
+// syncContainer copies the runtime state of the container into its record
+// and applies the restart policy. Containers removed behind rws's back
+// get the "removed" state.
+func syncContainer(c Container, oom bool) {
+	updated := c
+	info, err := runtimes.Get().Inspect(context.Background(), c.ID)
+	if err == runtimes.ErrNotFound {
+		updated.State = "removed"
+		updated.Ready = false
+	} else if err != nil {
+		log.Println(1, "Monitor: Inspect error for container "+c.Name)
+		log.Println(1, err)
+		return
+	} else {
+		updated.State = info.State
+		updated.ExitCode = info.ExitCode
+		updated.OOMKilled = info.OOMKilled || oom || (c.OOMKilled && info.State != "running")
+		updated.StartedAt = info.StartedAt
+		updated.FinishedAt = info.FinishedAt
+		if info.RestartCount > updated.RestartCount {
+			updated.RestartCount = info.RestartCount
+		}
+		if info.State != "running" {
+			updated.Ready = false
+		}
+	}
+	if updated.OOMKilled && !c.OOMKilled {
+		log.Println(1, "Monitor: container "+c.Name+" was killed by the OOM killer")
+	}
+	if updated.State != c.State || updated.ExitCode != c.ExitCode || updated.OOMKilled != c.OOMKilled ||
+		!updated.StartedAt.Equal(c.StartedAt) || !updated.FinishedAt.Equal(c.FinishedAt) ||
+		updated.RestartCount != c.RestartCount || updated.Ready != c.Ready {
+		// the record may have changed during Inspect, only the fields
+		// the runtime owns are taken over
+		current, err2 := loadRecord(c.Name)
+		if err2 != nil || current.ID != c.ID {
+			return
+		}
+		merged := current
+		merged.State = updated.State
+		merged.ExitCode = updated.ExitCode
+		merged.OOMKilled = updated.OOMKilled
+		merged.StartedAt = updated.StartedAt
+		merged.FinishedAt = updated.FinishedAt
+		if updated.RestartCount > merged.RestartCount {
+			merged.RestartCount = updated.RestartCount
+		}
+		if merged.State != "running" {
+			merged.Ready = false
+		}
+		err3 := saveRecord(merged)
+		if err3 != nil {
+			log.Println(1, "Monitor: etcd.SetKey error")
+			log.Println(1, err3)
+			return
+		}
+		if merged.State != current.State || merged.Ready != current.Ready {
+			stateChanged(merged)
+		}
+		// StopContainer writes volumes back itself
+		if (merged.State == "exited" || merged.State == "dead") && current.State != merged.State && !merged.Stopped {
+			err4 := writeBackVolumes(merged)
+			if err4 != nil {
+				log.Println(1, "Monitor: writeBackVolumes error for container "+c.Name)
+				log.Println(1, err4)
+			}
+		}
+		updated = merged
+	}
+	if updated.ShouldRestart() {
+		scheduleRestart(updated)
+	}
+}
+
+// restartDelay doubles with every restart, starting at one second.
+func restartDelay(c Container) time.Duration {
+	delay := time.Second
+	for i := uint64(0); i < c.RestartCount && delay < maxRestartDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartDelay {
+		delay = maxRestartDelay
+	}
+	return delay
+}
+
+// scheduleRestart starts the container again after the backoff delay
+// if its record still asks for it then.
+func scheduleRestart(c Container) {
+	delay := restartDelay(c)
+	log.Println(1, "Monitor: restarting "+c.Name+" in "+delay.String()+", restart policy "+c.RestartPolicy.Name)
+	time.AfterFunc(delay, func() {
+		current, err := GetContainer(c.Name)
+		if err != nil || current.ID != c.ID || !current.ShouldRestart() {
+			return
+		}
+		err2 := startAgain(current)
+		if err2 != nil {
+			log.Println(1, "Monitor: restart error")
+			log.Println(1, err2)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package containers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"strconv"
+	"sync"
+)
+
+// portsMu is held from AllocatePorts until the container record with the
+// allocated ports is saved, so two containers started at once on this
+// host don't get the same port.
+var portsMu sync.Mutex
+
+// Port publishes ContainerPort on HostPort of the container's host.
+// A zero HostPort is allocated from conf.HostPortMin..conf.HostPortMax.
+type Port struct {
+	ContainerPort uint64
+	HostPort      uint64
+	Protocol      string
+}
+
+func (p Port) protocol() string {
+	if p.Protocol == "" {
+		return "tcp"
+	}
+	return p.Protocol
+}
+
+func portKey(port uint64, protocol string) string {
+	return strconv.FormatUint(port, 10) + "/" + protocol
+}
+
+// holdsPorts reports whether the container's host ports are taken. Failed
+// pulls never bound them and removed or dead containers are gone.
+func (c Container) holdsPorts() bool {
+	switch c.State {
+	case "failed", "removed", "dead":
+		return false
+	}
+	return true
+}
+
+// UsedHostPorts returns the host ports taken by containers recorded on host.
+func UsedHostPorts(host string) (map[string]bool, error) {
+	used := make(map[string]bool)
+	dir, err := etcd.ListDir("/rws/containers")
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range dir {
+		var c Container
+		err := json.Unmarshal([]byte(node.Value), &c)
+		if err != nil {
+			return nil, err
+		}
+		if c.Host != host || !c.holdsPorts() {
+			continue
+		}
+		for _, p := range c.Ports {
+			used[portKey(p.HostPort, p.protocol())] = true
+		}
+	}
+	return used, nil
+}
+
+// AllocatePorts fills in missing host ports and fails if a requested host
+// port is already used on host. The caller holds portsMu until the record
+// is saved.
+func AllocatePorts(host string, ports []Port) ([]Port, error) {
+	if len(ports) == 0 {
+		return ports, nil
+	}
+	used, err := UsedHostPorts(host)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Port, len(ports))
+	for i, p := range ports {
+		p.Protocol = p.protocol()
+		if p.HostPort != 0 {
+			if used[portKey(p.HostPort, p.Protocol)] {
+				return nil, errors.New("host port " + portKey(p.HostPort, p.Protocol) + " already allocated on " + host)
+			}
+		} else {
+			for hp := uint64(conf.HostPortMin); hp <= conf.HostPortMax; hp++ {
+				if !used[portKey(hp, p.Protocol)] {
+					p.HostPort = hp
+					break
+				}
+			}
+			if p.HostPort == 0 {
+				return nil, errors.New("no free host ports left on " + host)
+			}
+		}
+		used[portKey(p.HostPort, p.Protocol)] = true
+		result[i] = p
+	}
+	return result, nil
+}
+
+// endpoints returns host:port/protocol for every published port.
+func (c Container) endpoints() []string {
+	var result []string
+	for _, p := range c.Ports {
+		result = append(result, c.Host+":"+portKey(p.HostPort, p.protocol()))
+	}
+	return result
+}
@@ -0,0 +1,321 @@
+package containers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Probe checks a container with an HTTP GET of Path on Port, a TCP
+// connect to Port, or by running Cmd in it. Times are in seconds,
+// zero values get the defaults below.
+type Probe struct {
+	Type             string
+	Path             string
+	Port             uint64
+	Cmd              []string
+	InitialDelay     uint64
+	Period           uint64
+	Timeout          uint64
+	SuccessThreshold uint64
+	FailureThreshold uint64
+}
+
+const (
+	DefaultProbePeriod           = 10
+	DefaultProbeTimeout          = 1
+	DefaultProbeSuccessThreshold = 1
+	DefaultProbeFailureThreshold = 3
+)
+
+func (p Probe) period() time.Duration {
+	if p.Period == 0 {
+		return DefaultProbePeriod * time.Second
+	}
+	return time.Duration(p.Period) * time.Second
+}
+
+func (p Probe) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return DefaultProbeTimeout * time.Second
+	}
+	return time.Duration(p.Timeout) * time.Second
+}
+
+func (p Probe) successThreshold() uint64 {
+	if p.SuccessThreshold == 0 {
+		return DefaultProbeSuccessThreshold
+	}
+	return p.SuccessThreshold
+}
+
+func (p Probe) failureThreshold() uint64 {
+	if p.FailureThreshold == 0 {
+		return DefaultProbeFailureThreshold
+	}
+	return p.FailureThreshold
+}
+
+// probeAddr returns where Port of the container can be reached from this
+// host: the container IP, or the published host port if it has no IP.
+func probeAddr(c Container, port uint64) (string, error) {
+	info, err := runtimes.Get().Inspect(context.Background(), c.ID)
+	if err != nil {
+		return "", err
+	}
+	if info.IP != "" {
+		return net.JoinHostPort(info.IP, strconv.FormatUint(port, 10)), nil
+	}
+	for _, p := range c.Ports {
+		if p.ContainerPort == port {
+			return net.JoinHostPort("127.0.0.1", strconv.FormatUint(p.HostPort, 10)), nil
+		}
+	}
+	return "", errors.New("port " + strconv.FormatUint(port, 10) + " of " + c.Name + " is not reachable")
+}
+
+func runProbe(c Container, p Probe) error {
+	switch p.Type {
+	case "http":
+		addr, err := probeAddr(c, p.Port)
+		if err != nil {
+			return err
+		}
+		client := http.Client{Timeout: p.timeout()}
+		resp, err2 := client.Get("http://" + addr + p.Path)
+		if err2 != nil {
+			return err2
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return errors.New("http probe returned " + strconv.Itoa(resp.StatusCode))
+		}
+		return nil
+	case "tcp":
+		addr, err := probeAddr(c, p.Port)
+		if err != nil {
+			return err
+		}
+		conn, err2 := net.DialTimeout("tcp", addr, p.timeout())
+		if err2 != nil {
+			return err2
+		}
+		return conn.Close()
+	case "exec":
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout())
+		defer cancel()
+		streams := runtimes.ExecStreams{Stdout: ioutil.Discard, Stderr: ioutil.Discard}
+		code, err := runtimes.Get().Exec(ctx, c.ID, runtimes.ExecOptions{Cmd: p.Cmd}, streams)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return errors.New("exec probe exited with " + strconv.Itoa(code))
+		}
+		return nil
+	default:
+		return errors.New("unknown probe type " + p.Type)
+	}
+}
+
+// probeState counts consecutive results of one probe.
+type probeState struct {
+	next      time.Time
+	successes uint64
+	failures  uint64
+}
+
+// due returns when p runs next, not before its initial delay.
+func (s probeState) due(p Probe, started time.Time) time.Time {
+	t := started.Add(time.Duration(p.InitialDelay) * time.Second)
+	if s.next.After(t) {
+		return s.next
+	}
+	return t
+}
+
+// check runs the probe if it is due and reports whether it has just
+// reached its success or failure threshold.
+func (s *probeState) check(c Container, p Probe, now time.Time) (passed, failed bool) {
+	if now.Before(s.next) {
+		return false, false
+	}
+	s.next = now.Add(p.period())
+	err := runProbe(c, p)
+	if err != nil {
+		log.Println(1, "probe of "+c.Name+" failed: "+err.Error())
+		s.successes = 0
+		s.failures += 1
+		return false, s.failures >= p.failureThreshold()
+	}
+	s.failures = 0
+	s.successes += 1
+	return s.successes >= p.successThreshold(), false
+}
+
+// Prober runs the liveness and readiness probes of containers on this host.
+func Prober() {
+	var mu sync.Mutex
+	probing := make(map[string]bool)
+	for {
+		time.Sleep(5 * time.Second)
+		dir, err := etcd.ListDir("/rws/containers")
+		if err != nil {
+			log.Println(1, "Prober: etcd.ListDir error")
+			log.Println(1, err)
+			continue
+		}
+		for _, node := range dir {
+			var c Container
+			err := json.Unmarshal([]byte(node.Value), &c)
+			if err != nil {
+				continue
+			}
+			if !hosts.IsLocal(c.Host) || (c.Liveness == nil && c.Readiness == nil) {
+				continue
+			}
+			mu.Lock()
+			if !probing[c.Name] {
+				probing[c.Name] = true
+				go func(name string) {
+					probeContainer(name)
+					mu.Lock()
+					delete(probing, name)
+					mu.Unlock()
+				}(c.Name)
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// probeContainer probes one container until its record is gone. It sleeps
+// until the next probe is due, or a second while the container isn't running.
+func probeContainer(name string) {
+	var live, ready probeState
+	started := time.Now()
+	wait := time.Second
+	for {
+		time.Sleep(wait)
+		wait = time.Second
+		c, err := loadRecord(name)
+		if err != nil || !hosts.IsLocal(c.Host) {
+			return
+		}
+		if c.State != "running" {
+			started = time.Now()
+			live, ready = probeState{}, probeState{}
+			continue
+		}
+		now := time.Now()
+		if c.Liveness != nil && now.Sub(started) >= time.Duration(c.Liveness.InitialDelay)*time.Second {
+			if _, failed := live.check(c, *c.Liveness, now); failed {
+				log.Println(1, "probeContainer: liveness probe failed, restarting "+name)
+				err := restartContainer(c)
+				if err != nil {
+					log.Println(1, "probeContainer: restart error")
+					log.Println(1, err)
+				}
+				started = time.Now()
+				live, ready = probeState{}, probeState{}
+				continue
+			}
+		}
+		isReady := c.Ready
+		if c.Readiness == nil {
+			isReady = true
+		} else if now.Sub(started) >= time.Duration(c.Readiness.InitialDelay)*time.Second {
+			passed, failed := ready.check(c, *c.Readiness, now)
+			if passed {
+				isReady = true
+			} else if failed {
+				isReady = false
+			}
+		}
+		if isReady != c.Ready {
+			log.Println(1, "probeContainer: "+name+" ready: "+strconv.FormatBool(isReady))
+			setReady(c.ID, name, isReady)
+		}
+		var next time.Time
+		if c.Liveness != nil {
+			next = live.due(*c.Liveness, started)
+		}
+		if c.Readiness != nil {
+			if d := ready.due(*c.Readiness, started); next.IsZero() || d.Before(next) {
+				next = d
+			}
+		}
+		if next.IsZero() {
+			return
+		}
+		wait = next.Sub(time.Now())
+		if wait < 0 {
+			wait = 0
+		}
+	}
+}
+
+// setReady re-reads the record so only Ready is changed, a container
+// that isn't running anymore doesn't become ready.
+func setReady(id, name string, ready bool) {
+	c, err := loadRecord(name)
+	if err != nil || c.ID != id || c.Ready == ready || (ready && c.State != "running") {
+		return
+	}
+	c.Ready = ready
+	b, err2 := json.Marshal(c)
+	if err2 != nil {
+		return
+	}
+	err3 := etcd.SetKey("/rws/containers/"+name, string(b))
+	if err3 != nil {
+		log.Println(1, "setReady: etcd.SetKey error")
+		log.Println(1, err3)
+		return
+	}
+	stateChanged(c)
+}
+
+func restartContainer(c Container) error {
+	c.preStop()
+	err := runtimes.Get().Stop(context.Background(), c.ID)
+	if err != nil {
+		return err
+	}
+	return startAgain(c)
+}
+
+// startAgain starts an exited container and counts the restart.
+func startAgain(c Container) error {
+	err := runtimes.Get().Start(context.Background(), c.ID)
+	if err != nil {
+		return err
+	}
+	c, err2 := GetContainer(c.Name)
+	if err2 != nil {
+		return err2
+	}
+	c.RestartCount += 1
+	c.State = "running"
+	c.Ready = c.Readiness == nil
+	b, err3 := json.Marshal(c)
+	if err3 != nil {
+		return err3
+	}
+	err4 := etcd.SetKey("/rws/containers/"+c.Name, string(b))
+	if err4 != nil {
+		return err4
+	}
+	c.postStart()
+	return nil
+}
@@ -0,0 +1,121 @@
+package containers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/registries"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"golang.org/x/net/context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Image pull policies. The default is PullAlways for untagged and :latest
+// images and PullIfNotPresent otherwise.
+const (
+	PullAlways       = "always"
+	PullIfNotPresent = "if-not-present"
+	PullNever        = "never"
+)
+
+// pullProgressInterval limits how often pull progress is written to etcd.
+const pullProgressInterval = 2 * time.Second
+
+func (c Container) pullPolicy() string {
+	if c.ImagePullPolicy != "" {
+		return c.ImagePullPolicy
+	}
+	image := c.Image
+	if strings.Contains(image, "@") {
+		return PullIfNotPresent
+	}
+	tag := ""
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		tag = image[i+1:]
+	}
+	if tag == "" || tag == "latest" {
+		return PullAlways
+	}
+	return PullIfNotPresent
+}
+
+// saveRecord writes the container record, used while the container is
+// being pulled and created.
+func saveRecord(c Container) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return etcd.SetKey("/rws/containers/"+c.Name, string(b))
+}
+
+// loadRecord reads the container record straight from its key.
+func loadRecord(name string) (Container, error) {
+	s, err := etcd.GetKey("/rws/containers/" + name)
+	if err != nil {
+		return Container{}, err
+	}
+	var c Container
+	err2 := json.Unmarshal([]byte(s), &c)
+	return c, err2
+}
+
+// pullImage makes sure the image of the container is present according to
+// its pull policy, recording progress in PullStatus.
+func pullImage(ctx context.Context, c *Container) error {
+	rt := runtimes.Get()
+	policy := c.pullPolicy()
+	switch policy {
+	case PullAlways, PullIfNotPresent, PullNever:
+	default:
+		return errors.New("unknown image pull policy " + policy)
+	}
+	if policy != PullAlways {
+		has, err := rt.HasImage(ctx, c.Image)
+		if err != nil {
+			return err
+		}
+		if has {
+			c.PullStatus = "present"
+			return nil
+		}
+		if policy == PullNever {
+			return errors.New("image " + c.Image + " is not present and pull policy is never")
+		}
+	}
+	var opts runtimes.PullOptions
+	if c.RegistryCredential != "" {
+		auth, err := registries.Auth(c.RegistryCredential, c.Namespace)
+		if err != nil {
+			return err
+		}
+		opts.Auth = auth
+	}
+	var mu sync.Mutex
+	last := time.Time{}
+	opts.Progress = func(status string) {
+		mu.Lock()
+		defer mu.Unlock()
+		c.PullStatus = status
+		if time.Since(last) < pullProgressInterval {
+			return
+		}
+		last = time.Now()
+		err := saveRecord(*c)
+		if err != nil {
+			log.Println(1, "pullImage: record update error")
+			log.Println(1, err)
+		}
+	}
+	err := rt.Pull(ctx, c.Image, opts)
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		return err
+	}
+	c.PullStatus = "pulled"
+	return nil
+}
@@ -0,0 +1,73 @@
+package containers
+
+import (
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"github.com/loqutus/rws/pkg/server/secrets"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// SecretRef injects Key of Secret as the Env variable, as a read-only
+// file at Path, or both. Only the reference is stored in the record.
+type SecretRef struct {
+	Secret string
+	Key    string
+	Env    string
+	Path   string
+}
+
+func secretsDir(containerName string) string {
+	return filepath.Join(conf.DataDir, conf.StateDir, "secrets", containerName)
+}
+
+func envList(env map[string]string) []string {
+	var result []string
+	for k, v := range env {
+		result = append(result, k+"="+v)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// injectSecrets resolves the container's secret references and adds them
+// to spec as env vars and bind-mounted files under secretsDir.
+func injectSecrets(spec *runtimes.Spec, c Container) error {
+	if len(c.Secrets) == 0 {
+		return nil
+	}
+	dir := secretsDir(c.Name)
+	for i, ref := range c.Secrets {
+		if ref.Env == "" && ref.Path == "" {
+			return errors.New("secret " + ref.Secret + " reference needs Env or Path")
+		}
+		v, err := secrets.Value(ref.Secret, c.Namespace, ref.Key)
+		if err != nil {
+			return err
+		}
+		if ref.Env != "" {
+			spec.Env = append(spec.Env, ref.Env+"="+v)
+		}
+		if ref.Path != "" {
+			err2 := os.MkdirAll(dir, 0700)
+			if err2 != nil {
+				return err2
+			}
+			file := filepath.Join(dir, ref.Secret+"-"+strconv.Itoa(i))
+			err3 := ioutil.WriteFile(file, []byte(v), 0400)
+			if err3 != nil {
+				return err3
+			}
+			spec.Mounts = append(spec.Mounts, runtimes.Mount{Source: hostPath(file), Target: ref.Path, ReadOnly: true})
+		}
+	}
+	return nil
+}
+
+func removeSecrets(containerName string) error {
+	return os.RemoveAll(secretsDir(containerName))
+}
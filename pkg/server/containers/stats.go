@@ -0,0 +1,143 @@
+package containers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"golang.org/x/net/context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// ContainerStats is the resource usage of one container.
+type ContainerStats struct {
+	Name string
+	Host string
+	ID   string
+	runtimes.Stats
+}
+
+// StatsRequest is the body of container_stats. An empty Name asks for
+// all containers running on the host that receives the request.
+type StatsRequest struct {
+	Name string
+}
+
+// LocalStats samples all containers running on this host concurrently,
+// the containerd runtime takes a second per container.
+func LocalStats() ([]ContainerStats, error) {
+	records, err := localRecords()
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var l []ContainerStats
+	for _, c := range records {
+		if c.State != "running" {
+			continue
+		}
+		wg.Add(1)
+		go func(c Container) {
+			defer wg.Done()
+			s, err := runtimes.Get().Stats(context.Background(), c.ID)
+			if err != nil {
+				log.Println(1, "LocalStats: Stats error for container "+c.Name)
+				log.Println(1, err)
+				return
+			}
+			mu.Lock()
+			l = append(l, ContainerStats{Name: c.Name, Host: c.Host, ID: c.ID, Stats: s})
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	return l, nil
+}
+
+// HostStats asks the rws server at addr for the stats of its containers.
+func HostStats(addr string) ([]ContainerStats, error) {
+	return postStats(addr, StatsRequest{})
+}
+
+// GetStats returns the stats of a container from the host running it.
+func GetStats(name string) (ContainerStats, error) {
+	cont, err := GetContainer(name)
+	if err != nil {
+		return ContainerStats{}, err
+	}
+	if hosts.IsLocal(cont.Host) {
+		s, err2 := runtimes.Get().Stats(context.Background(), cont.ID)
+		if err2 != nil {
+			return ContainerStats{}, err2
+		}
+		return ContainerStats{Name: cont.Name, Host: cont.Host, ID: cont.ID, Stats: s}, nil
+	}
+	l, err3 := postStats(hosts.Addr(cont.Host), StatsRequest{Name: name})
+	if err3 != nil {
+		return ContainerStats{}, err3
+	}
+	if len(l) != 1 {
+		return ContainerStats{}, errors.New("no stats for container " + name)
+	}
+	return l[0], nil
+}
+
+func postStats(addr string, req StatsRequest) ([]ContainerStats, error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err2 := http.Post("http://"+addr+"/container_stats", "application/json", bytes.NewBuffer(b))
+	if err2 != nil {
+		return nil, err2
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("container_stats: " + addr + " returned " + strconv.Itoa(resp.StatusCode))
+	}
+	var l []ContainerStats
+	err3 := json.NewDecoder(resp.Body).Decode(&l)
+	if err3 != nil {
+		return nil, err3
+	}
+	return l, nil
+}
+
+func ContainerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "ContainerStatsHandler")
+	var req StatsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		utils.Fail("ContainerStatsHandler: json decode error", err, w)
+		return
+	}
+	var l []ContainerStats
+	if req.Name == "" {
+		l, err = LocalStats()
+		if err != nil {
+			utils.Fail("ContainerStatsHandler: LocalStats error", err, w)
+			return
+		}
+	} else {
+		s, err2 := GetStats(req.Name)
+		if err2 != nil {
+			utils.Fail("ContainerStatsHandler: GetStats error", err2, w)
+			return
+		}
+		l = append(l, s)
+	}
+	b, err3 := json.Marshal(l)
+	if err3 != nil {
+		utils.Fail("ContainerStatsHandler: json.Marshal error", err3, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
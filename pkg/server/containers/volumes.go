@@ -0,0 +1,132 @@
+package containers
+
+import (
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"github.com/loqutus/rws/pkg/server/storage"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Volume mounts the storage file File at Path in the container.
+// Read-write volumes are written back to storage when the container stops.
+type Volume struct {
+	File     string
+	Path     string
+	ReadOnly bool
+}
+
+func volumesDir(containerName string) string {
+	return filepath.Join(conf.DataDir, conf.StateDir, "volumes", containerName)
+}
+
+// prepareVolumes fetches the container's volume files into volumesDir
+// and adds bind mounts for them to spec.
+func prepareVolumes(spec *runtimes.Spec, c Container) error {
+	if len(c.Volumes) == 0 {
+		return nil
+	}
+	dir := volumesDir(c.Name)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, v := range c.Volumes {
+		if v.File == "" || v.Path == "" {
+			return errors.New("volume needs File and Path")
+		}
+		data, err := storage.Fetch(v.File)
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(dir, filepath.Base(v.File))
+		err2 := ioutil.WriteFile(file, data, 0644)
+		if err2 != nil {
+			return err2
+		}
+		spec.Mounts = append(spec.Mounts, runtimes.Mount{Source: hostPath(file), Target: v.Path, ReadOnly: v.ReadOnly})
+	}
+	return nil
+}
+
+// writeBackVolumes stores the local copies of read-write volumes.
+func writeBackVolumes(c Container) error {
+	var result error
+	for _, v := range c.Volumes {
+		if v.ReadOnly {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(volumesDir(c.Name), filepath.Base(v.File)))
+		if err != nil {
+			log.Println(1, "writeBackVolumes: read error for "+v.File)
+			result = err
+			continue
+		}
+		err2 := storage.Store(v.File, data)
+		if err2 != nil {
+			log.Println(1, "writeBackVolumes: store error for "+v.File)
+			result = err2
+		}
+	}
+	return result
+}
+
+func removeVolumes(containerName string) error {
+	return os.RemoveAll(volumesDir(containerName))
+}
+
+// SharedVolume is an empty directory shared by the containers of one pod
+// replica, mounted at Path. It is removed with the last of them.
+type SharedVolume struct {
+	Name     string
+	Path     string
+	ReadOnly bool
+}
+
+func sharedDir(replica string) string {
+	return filepath.Join(conf.DataDir, conf.StateDir, "shared", replica)
+}
+
+// prepareSharedVolumes creates the replica's shared directories and adds
+// bind mounts for them to spec.
+func prepareSharedVolumes(spec *runtimes.Spec, c Container) error {
+	if len(c.SharedVolumes) == 0 {
+		return nil
+	}
+	if c.Replica == "" {
+		return errors.New("shared volumes are only available in pods")
+	}
+	for _, v := range c.SharedVolumes {
+		if v.Name == "" || v.Path == "" || filepath.Base(v.Name) != v.Name {
+			return errors.New("shared volume needs a plain Name and Path")
+		}
+		dir := filepath.Join(sharedDir(c.Replica), v.Name)
+		err := os.MkdirAll(dir, 0777)
+		if err != nil {
+			return err
+		}
+		spec.Mounts = append(spec.Mounts, runtimes.Mount{Source: hostPath(dir), Target: v.Path, ReadOnly: v.ReadOnly})
+	}
+	return nil
+}
+
+// removeSharedVolumes removes the replica's shared directories unless
+// another container of the replica still uses them.
+func removeSharedVolumes(c Container) error {
+	if c.Replica == "" || len(c.SharedVolumes) == 0 {
+		return nil
+	}
+	records, err := localRecords()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.Replica == c.Replica && r.Name != c.Name {
+			return nil
+		}
+	}
+	return os.RemoveAll(sharedDir(c.Replica))
+}
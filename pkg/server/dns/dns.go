@@ -0,0 +1,486 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names answered by the agent, relative to conf.DNSDomain:
+//
+//	<pod>.<namespace>                    A of the hosts of ready replicas, SRV of their ports
+//	<replica>.<pod>.<namespace>          A of the host running the replica
+//	_<port>._<proto>.<pod>.<namespace>   SRV of one container port
+//
+// Addresses are those of the hosts, SRV records carry the published host
+// ports.
+
+type service struct {
+	ContainerPort uint64
+	HostPort      uint64
+	Protocol      string
+	Target        string
+}
+
+// zone is a snapshot of the pods and their ready containers.
+type zone struct {
+	pods     map[string]bool
+	replicas map[string]net.IP
+	services map[string][]service
+	updated  time.Time
+}
+
+var current struct {
+	sync.Mutex
+	z *zone
+}
+
+func podKey(name, namespace string) string {
+	if namespace == "" {
+		namespace = conf.DNSDefaultNamespace
+	}
+	return strings.ToLower(name + "." + namespace)
+}
+
+// hostIP resolves the Host field of a container record.
+func hostIP(name string) (net.IP, error) {
+	if hosts.IsLocal(name) {
+		return hosts.AdvertisedIP()
+	}
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		return ip, nil
+	}
+	ips, err := net.LookupIP(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("host " + name + " has no IPv4 address")
+}
+
+func loadZone() (*zone, error) {
+	podsDir, err := etcd.ListDir("/rws/pods")
+	if err != nil {
+		return nil, err
+	}
+	pods := make(map[string]bool)
+	for _, node := range podsDir {
+		var p struct{ Name, Namespace string }
+		if json.Unmarshal([]byte(node.Value), &p) == nil {
+			pods[podKey(p.Name, p.Namespace)] = true
+		}
+	}
+	containersDir, err2 := etcd.ListDir("/rws/containers")
+	if err2 != nil {
+		return nil, err2
+	}
+	var conts []containers.Container
+	for _, node := range containersDir {
+		var c containers.Container
+		if json.Unmarshal([]byte(node.Value), &c) == nil {
+			conts = append(conts, c)
+		}
+	}
+	return buildZone(pods, conts), nil
+}
+
+// buildZone makes the zone of the pods, keyed by podKey, from the ready
+// containers.
+func buildZone(pods map[string]bool, conts []containers.Container) *zone {
+	z := &zone{
+		pods:     pods,
+		replicas: make(map[string]net.IP),
+		services: make(map[string][]service),
+		updated:  time.Now(),
+	}
+	ips := make(map[string]net.IP)
+	for _, c := range conts {
+		if c.Pod == "" || c.Init || c.State != "running" || !c.Ready {
+			continue
+		}
+		ip, ok := ips[c.Host]
+		if !ok {
+			var err error
+			ip, err = hostIP(c.Host)
+			if err != nil {
+				log.Println(1, "dns: hostIP error for host "+c.Host)
+				log.Println(1, err)
+			}
+			ips[c.Host] = ip
+		}
+		if ip == nil {
+			continue
+		}
+		key := podKey(c.Pod, c.Namespace)
+		replica := c.Replica
+		if replica == "" {
+			replica = c.Name
+		}
+		target := strings.ToLower(replica) + "." + key
+		z.replicas[target] = ip
+		for _, port := range c.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			z.services[key] = append(z.services[key], service{
+				ContainerPort: port.ContainerPort,
+				HostPort:      port.HostPort,
+				Protocol:      strings.ToLower(protocol),
+				Target:        target,
+			})
+		}
+	}
+	return z
+}
+
+// getZone returns the snapshot, loading it again once it is older than
+// conf.DNSTTL. The old one is kept if etcd can't be read.
+func getZone() *zone {
+	current.Lock()
+	defer current.Unlock()
+	if current.z != nil && time.Since(current.z.updated) < conf.DNSTTL*time.Second {
+		return current.z
+	}
+	z, err := loadZone()
+	if err != nil {
+		log.Println(1, "dns: loadZone error")
+		log.Println(1, err)
+		if current.z == nil {
+			return &zone{}
+		}
+		return current.z
+	}
+	current.z = z
+	return z
+}
+
+type answer struct {
+	a   []net.IP
+	srv []service
+}
+
+// lookup answers a name relative to conf.DNSDomain, found is false for
+// names that don't exist.
+func (z *zone) lookup(name string) (answer, bool) {
+	labels := strings.Split(name, ".")
+	if len(labels) == 4 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+		key := labels[2] + "." + labels[3]
+		if !z.pods[key] {
+			return answer{}, false
+		}
+		var ans answer
+		for _, s := range z.services[key] {
+			if strconv.FormatUint(s.ContainerPort, 10) == labels[0][1:] && s.Protocol == labels[1][1:] {
+				ans.srv = append(ans.srv, s)
+			}
+		}
+		return ans, true
+	}
+	if z.pods[name] {
+		ans := answer{srv: z.services[name]}
+		seen := make(map[string]bool)
+		for target, ip := range z.replicas {
+			if strings.HasSuffix(target, "."+name) && !seen[ip.String()] {
+				seen[ip.String()] = true
+				ans.a = append(ans.a, ip)
+			}
+		}
+		return ans, true
+	}
+	if ip, ok := z.replicas[name]; ok {
+		return answer{a: []net.IP{ip}}, true
+	}
+	return answer{}, false
+}
+
+// reply builds the answer to a query for a name under conf.DNSDomain.
+// local is false for other names, which are forwarded.
+func reply(query []byte, maxSize int) ([]byte, bool, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, false, err
+	}
+	q, err2 := p.Question()
+	if err2 != nil {
+		return nil, false, err2
+	}
+	name := strings.ToLower(q.Name.String())
+	suffix := "." + conf.DNSDomain + "."
+	if !strings.HasSuffix(name, suffix) || q.Class != dnsmessage.ClassINET {
+		return nil, false, nil
+	}
+	z := getZone()
+	ans, found := z.lookup(strings.TrimSuffix(name, suffix))
+	rh := dnsmessage.Header{
+		ID:               h.ID,
+		Response:         true,
+		Authoritative:    true,
+		RecursionDesired: h.RecursionDesired,
+	}
+	if !found {
+		rh.RCode = dnsmessage.RCodeNameError
+	}
+	b, err3 := z.build(rh, q, ans)
+	if err3 == nil && len(b) > maxSize {
+		rh.Truncated = true
+		b, err3 = z.build(rh, q, answer{})
+	}
+	return b, true, err3
+}
+
+// build encodes the answer, SRV targets are added as additional records.
+func (z *zone) build(h dnsmessage.Header, q dnsmessage.Question, ans answer) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, h)
+	b.EnableCompression()
+	err := b.StartQuestions()
+	if err == nil {
+		err = b.Question(q)
+	}
+	if err == nil {
+		err = b.StartAnswers()
+	}
+	if err != nil {
+		return nil, err
+	}
+	rh := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: conf.DNSTTL}
+	}
+	var targets []service
+	switch q.Type {
+	case dnsmessage.TypeA:
+		for _, ip := range ans.a {
+			err2 := b.AResource(rh(q.Name), aResource(ip))
+			if err2 != nil {
+				return nil, err2
+			}
+		}
+	case dnsmessage.TypeSRV:
+		for _, s := range ans.srv {
+			target, err2 := dnsmessage.NewName(s.Target + "." + conf.DNSDomain + ".")
+			if err2 != nil {
+				return nil, err2
+			}
+			err3 := b.SRVResource(rh(q.Name), dnsmessage.SRVResource{Priority: 0, Weight: 10, Port: uint16(s.HostPort), Target: target})
+			if err3 != nil {
+				return nil, err3
+			}
+			targets = append(targets, s)
+		}
+	}
+	err4 := b.StartAdditionals()
+	if err4 != nil {
+		return nil, err4
+	}
+	seen := make(map[string]bool)
+	for _, s := range targets {
+		ip, ok := z.replicas[s.Target]
+		if !ok || seen[s.Target] {
+			continue
+		}
+		seen[s.Target] = true
+		target, err5 := dnsmessage.NewName(s.Target + "." + conf.DNSDomain + ".")
+		if err5 != nil {
+			return nil, err5
+		}
+		err6 := b.AResource(rh(target), aResource(ip))
+		if err6 != nil {
+			return nil, err6
+		}
+	}
+	return b.Finish()
+}
+
+func aResource(ip net.IP) dnsmessage.AResource {
+	var a dnsmessage.AResource
+	copy(a.A[:], ip.To4())
+	return a
+}
+
+// upstream returns the first nameserver of /etc/resolv.conf that isn't
+// this agent.
+func upstream() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	localIP, _ := hosts.AdvertisedIP()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		ip := net.ParseIP(fields[1])
+		if ip == nil || ip.Equal(localIP) {
+			continue
+		}
+		return net.JoinHostPort(ip.String(), "53"), nil
+	}
+	return "", errors.New("no upstream nameserver in /etc/resolv.conf")
+}
+
+// forward sends the query to the upstream nameserver over network, udp
+// or tcp, and returns its answer.
+func forward(network string, query []byte) ([]byte, error) {
+	addr, err := upstream()
+	if err != nil {
+		return nil, err
+	}
+	conn, err2 := net.DialTimeout(network, addr, 5*time.Second)
+	if err2 != nil {
+		return nil, err2
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if network == "tcp" {
+		err3 := writeTCP(conn, query)
+		if err3 != nil {
+			return nil, err3
+		}
+		return readTCP(conn)
+	}
+	_, err4 := conn.Write(query)
+	if err4 != nil {
+		return nil, err4
+	}
+	buf := make([]byte, 65535)
+	n, err5 := conn.Read(buf)
+	if err5 != nil {
+		return nil, err5
+	}
+	return buf[:n], nil
+}
+
+func handle(network string, query []byte, maxSize int) []byte {
+	b, local, err := reply(query, maxSize)
+	if err != nil {
+		log.Println(1, "dns: bad query")
+		log.Println(1, err)
+		return nil
+	}
+	if local {
+		return b
+	}
+	b, err = forward(network, query)
+	if err != nil {
+		log.Println(1, "dns: forward error")
+		log.Println(1, err)
+		return nil
+	}
+	return b
+}
+
+func readTCP(r io.Reader) ([]byte, error) {
+	var size uint16
+	err := binary.Read(r, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	_, err2 := io.ReadFull(r, b)
+	return b, err2
+}
+
+func writeTCP(w io.Writer, b []byte) error {
+	err := binary.Write(w, binary.BigEndian, uint16(len(b)))
+	if err != nil {
+		return err
+	}
+	_, err2 := w.Write(b)
+	return err2
+}
+
+func serveUDP(conn net.PacketConn) {
+	for {
+		buf := make([]byte, 4096)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Println(1, "dns: udp read error")
+			log.Println(1, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go func(query []byte, addr net.Addr) {
+			b := handle("udp", query, 512)
+			if b != nil {
+				conn.WriteTo(b, addr)
+			}
+		}(buf[:n], addr)
+	}
+}
+
+func serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Println(1, "dns: tcp accept error")
+			log.Println(1, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				query, err := readTCP(conn)
+				if err != nil {
+					return
+				}
+				b := handle("tcp", query, 65535)
+				if b == nil || writeTCP(conn, b) != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+// Server answers DNS queries over UDP and TCP on all addresses of this
+// host, containers get its advertised address as their nameserver.
+func Server() {
+	addr := net.JoinHostPort("0.0.0.0", conf.DNSPort)
+	for {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			log.Println(1, "dns: udp listen error")
+			log.Println(1, err)
+			time.Sleep(60 * time.Second)
+			continue
+		}
+		l, err2 := net.Listen("tcp", addr)
+		if err2 != nil {
+			log.Println(1, "dns: tcp listen error")
+			log.Println(1, err2)
+			conn.Close()
+			time.Sleep(60 * time.Second)
+			continue
+		}
+		log.Println(1, "dns: listening on "+addr)
+		go serveTCP(l)
+		serveUDP(conn)
+	}
+}
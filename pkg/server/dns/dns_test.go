@@ -0,0 +1,188 @@
+package dns
+
+import (
+	"github.com/loqutus/rws/pkg/server/containers"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// testZone has pod web in the default namespace with two ready replicas
+// on two hosts, pod db in namespace prod with one and pod idle in
+// namespace dev with none.
+func testZone() *zone {
+	pods := map[string]bool{
+		podKey("web", ""):     true,
+		podKey("db", "prod"):  true,
+		podKey("idle", "dev"): true,
+	}
+	conts := []containers.Container{
+		{Name: "web-0-app", Pod: "web", Replica: "web-0", Host: "10.0.0.2:8888", State: "running", Ready: true,
+			Ports: []containers.Port{{ContainerPort: 80, HostPort: 30001}, {ContainerPort: 53, HostPort: 30002, Protocol: "UDP"}}},
+		{Name: "web-0-sidecar", Pod: "web", Replica: "web-0", Host: "10.0.0.2:8888", State: "running", Ready: true},
+		{Name: "web-1-app", Pod: "web", Replica: "web-1", Host: "10.0.0.3:8888", State: "running", Ready: true,
+			Ports: []containers.Port{{ContainerPort: 80, HostPort: 30003}}},
+		{Name: "web-2-app", Pod: "web", Replica: "web-2", Host: "10.0.0.4:8888", State: "running", Ready: false,
+			Ports: []containers.Port{{ContainerPort: 80, HostPort: 30004}}},
+		{Name: "web-3-init", Pod: "web", Replica: "web-3", Host: "10.0.0.4:8888", State: "running", Ready: true, Init: true},
+		{Name: "web-4-app", Pod: "web", Replica: "web-4", Host: "10.0.0.4:8888", State: "exited", Ready: true},
+		{Name: "db0", Pod: "db", Namespace: "prod", Host: "10.0.0.3:8888", State: "running", Ready: true,
+			Ports: []containers.Port{{ContainerPort: 5432, HostPort: 30005}}},
+		{Name: "standalone", Host: "10.0.0.2:8888", State: "running", Ready: true},
+	}
+	return buildZone(pods, conts)
+}
+
+func TestBuildZone(t *testing.T) {
+	z := testZone()
+	wantReplicas := map[string]string{
+		"web-0.web.default": "10.0.0.2",
+		"web-1.web.default": "10.0.0.3",
+		"db0.db.prod":       "10.0.0.3",
+	}
+	if len(z.replicas) != len(wantReplicas) {
+		t.Errorf("got replicas %v, want %v", z.replicas, wantReplicas)
+	}
+	for name, ip := range wantReplicas {
+		if !z.replicas[name].Equal(net.ParseIP(ip)) {
+			t.Errorf("replica %s at %v, want %s", name, z.replicas[name], ip)
+		}
+	}
+	wantServices := map[string][]service{
+		"web.default": {
+			{ContainerPort: 80, HostPort: 30001, Protocol: "tcp", Target: "web-0.web.default"},
+			{ContainerPort: 53, HostPort: 30002, Protocol: "udp", Target: "web-0.web.default"},
+			{ContainerPort: 80, HostPort: 30003, Protocol: "tcp", Target: "web-1.web.default"},
+		},
+		"db.prod": {
+			{ContainerPort: 5432, HostPort: 30005, Protocol: "tcp", Target: "db0.db.prod"},
+		},
+	}
+	if !reflect.DeepEqual(z.services, wantServices) {
+		t.Errorf("got services %v, want %v", z.services, wantServices)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	z := testZone()
+	tests := []struct {
+		name  string
+		found bool
+		a     []string
+		srv   []uint64
+	}{
+		{name: "web.default", found: true, a: []string{"10.0.0.2", "10.0.0.3"}, srv: []uint64{30001, 30002, 30003}},
+		{name: "web-1.web.default", found: true, a: []string{"10.0.0.3"}},
+		{name: "_80._tcp.web.default", found: true, srv: []uint64{30001, 30003}},
+		{name: "_53._udp.web.default", found: true, srv: []uint64{30002}},
+		{name: "_53._tcp.web.default", found: true},
+		{name: "_5432._tcp.db.prod", found: true, srv: []uint64{30005}},
+		{name: "idle.dev", found: true},
+		{name: "web-2.web.default", found: false},
+		{name: "web.prod", found: false},
+		{name: "_80._tcp.web.prod", found: false},
+		{name: "standalone", found: false},
+	}
+	for _, tt := range tests {
+		ans, found := z.lookup(tt.name)
+		if found != tt.found {
+			t.Errorf("%s: found %v, want %v", tt.name, found, tt.found)
+			continue
+		}
+		var a []string
+		for _, ip := range ans.a {
+			a = append(a, ip.String())
+		}
+		sort.Strings(a)
+		var srv []uint64
+		for _, s := range ans.srv {
+			srv = append(srv, s.HostPort)
+		}
+		if !reflect.DeepEqual(a, tt.a) || !reflect.DeepEqual(srv, tt.srv) {
+			t.Errorf("%s: got A %v SRV %v, want A %v SRV %v", tt.name, a, srv, tt.a, tt.srv)
+		}
+	}
+}
+
+func query(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestReply(t *testing.T) {
+	current.Lock()
+	current.z = testZone()
+	current.Unlock()
+	tests := []struct {
+		name       string
+		qtype      dnsmessage.Type
+		rcode      dnsmessage.RCode
+		answers    []string
+		additional []string
+	}{
+		{
+			name:    "web.default.rws.",
+			qtype:   dnsmessage.TypeA,
+			answers: []string{"10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name:       "_80._tcp.web.default.rws.",
+			qtype:      dnsmessage.TypeSRV,
+			answers:    []string{"web-0.web.default.rws.:30001", "web-1.web.default.rws.:30003"},
+			additional: []string{"web-0.web.default.rws.=10.0.0.2", "web-1.web.default.rws.=10.0.0.3"},
+		},
+		{
+			name:  "nothing.default.rws.",
+			qtype: dnsmessage.TypeA,
+			rcode: dnsmessage.RCodeNameError,
+		},
+	}
+	for _, tt := range tests {
+		b, local, err := reply(query(t, tt.name, tt.qtype), 512)
+		if err != nil || !local {
+			t.Errorf("%s: local %v, error %v", tt.name, local, err)
+			continue
+		}
+		var m dnsmessage.Message
+		err2 := m.Unpack(b)
+		if err2 != nil {
+			t.Errorf("%s: %v", tt.name, err2)
+			continue
+		}
+		if m.Header.ID != 42 || !m.Header.Response || !m.Header.Authoritative || m.Header.RCode != tt.rcode {
+			t.Errorf("%s: bad header %v", tt.name, m.Header)
+		}
+		var answers, additional []string
+		for _, r := range m.Answers {
+			switch body := r.Body.(type) {
+			case *dnsmessage.AResource:
+				answers = append(answers, net.IP(body.A[:]).String())
+			case *dnsmessage.SRVResource:
+				answers = append(answers, body.Target.String()+":"+strconv.Itoa(int(body.Port)))
+			}
+		}
+		for _, r := range m.Additionals {
+			if body, ok := r.Body.(*dnsmessage.AResource); ok {
+				additional = append(additional, r.Header.Name.String()+"="+net.IP(body.A[:]).String())
+			}
+		}
+		sort.Strings(answers)
+		sort.Strings(additional)
+		if !reflect.DeepEqual(answers, tt.answers) || !reflect.DeepEqual(additional, tt.additional) {
+			t.Errorf("%s: got %v %v, want %v %v", tt.name, answers, additional, tt.answers, tt.additional)
+		}
+	}
+	_, local, _ := reply(query(t, "example.com.", dnsmessage.TypeA), 512)
+	if local {
+		t.Errorf("example.com. answered locally, it should be forwarded")
+	}
+}
@@ -0,0 +1,165 @@
+package gc
+
+import (
+	"encoding/json"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"log"
+	"strings"
+	"time"
+)
+
+// Collector is the garbage collector of containers. Every agent removes
+// its own containers whose pod is gone or that exited more than
+// conf.ContainerRetention seconds ago, deletes records that have no
+// container behind them or whose image pull failed or got stuck, and
+// removes unused images when the disk fills up.
+func Collector() {
+	for {
+		time.Sleep(conf.GCInterval * time.Second)
+		collect()
+		collectImages()
+	}
+}
+
+// keyNames returns the last path element of every key in the etcd dir.
+func keyNames(dirName string) (map[string]bool, error) {
+	dir, err := etcd.ListDir(dirName)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, node := range dir {
+		keySplit := strings.Split(node.Key, "/")
+		names[keySplit[len(keySplit)-1]] = true
+	}
+	return names, nil
+}
+
+// hostNames returns the names the hosts report in their records.
+func hostNames() (map[string]bool, error) {
+	dir, err := etcd.ListDir("/rws/hosts")
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, node := range dir {
+		var h hosts.Host
+		err := json.Unmarshal([]byte(node.Value), &h)
+		if err != nil {
+			return nil, err
+		}
+		names[h.Name] = true
+	}
+	return names, nil
+}
+
+func collect() {
+	// Containers and pod statuses are listed before pods, those of a pod
+	// created in between would otherwise look orphaned.
+	dir, err := etcd.ListDir("/rws/containers")
+	if err != nil {
+		log.Println(1, "gc: etcd.ListDir error")
+		log.Println(1, err)
+		return
+	}
+	statuses, err2 := keyNames("/rws/podstatus")
+	if err2 != nil {
+		log.Println(1, "gc: etcd.ListDir error")
+		log.Println(1, err2)
+		return
+	}
+	pods, err3 := keyNames("/rws/pods")
+	if err3 != nil {
+		log.Println(1, "gc: etcd.ListDir error")
+		log.Println(1, err3)
+		return
+	}
+	knownHosts, err4 := hostNames()
+	if err4 != nil {
+		log.Println(1, "gc: hosts list error")
+		log.Println(1, err4)
+		return
+	}
+	for _, node := range dir {
+		var c containers.Container
+		err := json.Unmarshal([]byte(node.Value), &c)
+		if err != nil {
+			log.Println(1, "gc: json.Unmarshal error")
+			log.Println(1, err)
+			continue
+		}
+		local := hosts.IsLocal(c.Host)
+		switch {
+		case !local && len(knownHosts) > 0 && !knownHosts[c.Host] && c.Host != conf.LocalHostName:
+			log.Println(1, "gc: host "+c.Host+" of container "+c.Name+" was removed")
+			deleteRecord(node.Key)
+		case !local:
+			continue
+		case c.State == "removed":
+			log.Println(1, "gc: container "+c.Name+" was removed from the runtime")
+			deleteRecord(node.Key)
+		case c.Pod != "" && !pods[c.Pod]:
+			log.Println(1, "gc: pod "+c.Pod+" of container "+c.Name+" was removed")
+			removeContainer(c)
+		case c.State == "failed" && expired(c.FinishedAt):
+			log.Println(1, "gc: image pull of container "+c.Name+" failed at "+c.FinishedAt.String())
+			deleteRecord(node.Key)
+		case c.State == "pulling" && expired(c.PullStartedAt):
+			log.Println(1, "gc: image pull of container "+c.Name+" is stuck since "+c.PullStartedAt.String())
+			deleteRecord(node.Key)
+		case dead(c):
+			log.Println(1, "gc: container "+c.Name+" exited at "+c.FinishedAt.String())
+			removeContainer(c)
+		}
+	}
+	for name := range statuses {
+		if !pods[name] {
+			log.Println(1, "gc: removing status of pod "+name)
+			deleteRecord("/rws/podstatus/" + name)
+		}
+	}
+}
+
+// dead reports whether the container exited longer than the retention
+// time ago and its restart policy doesn't bring it back.
+func dead(c containers.Container) bool {
+	if c.State != "exited" && c.State != "dead" {
+		return false
+	}
+	if c.ShouldRestart() {
+		return false
+	}
+	return expired(c.FinishedAt)
+}
+
+// expired reports whether t is set and older than the retention time.
+func expired(t time.Time) bool {
+	return !t.IsZero() && time.Since(t) > conf.ContainerRetention*time.Second
+}
+
+func removeContainer(c containers.Container) {
+	if c.State == "running" {
+		err := containers.StopContainer(c.Name)
+		if err != nil {
+			log.Println(1, "gc: StopContainer error")
+			log.Println(1, err)
+			return
+		}
+	}
+	err2 := containers.RemoveContainer(c.Name)
+	if err2 != nil {
+		log.Println(1, "gc: RemoveContainer error")
+		log.Println(1, err2)
+	}
+}
+
+func deleteRecord(key string) {
+	err := etcd.DeleteKey(key)
+	if err != nil {
+		log.Println(1, "gc: etcd.DeleteKey error")
+		log.Println(1, err)
+	}
+}
@@ -0,0 +1,90 @@
+package gc
+
+import (
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/images"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"github.com/shirou/gopsutil/disk"
+	"golang.org/x/net/context"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// collectImages removes images no container uses, oldest first, while
+// the disk is fuller than conf.ImageGCHighPercent and until it is below
+// conf.ImageGCLowPercent.
+func collectImages() {
+	usage, err := disk.Usage("/")
+	if err != nil {
+		log.Println(1, "gc: disk.Usage error")
+		log.Println(1, err)
+		return
+	}
+	if usage.UsedPercent < conf.ImageGCHighPercent {
+		return
+	}
+	log.Println(1, "gc: disk "+strconv.FormatFloat(usage.UsedPercent, 'f', 1, 64)+"% full, removing unused images")
+	ctx := context.Background()
+	rt := runtimes.Get()
+	conts, err2 := rt.List(ctx, true)
+	if err2 != nil {
+		log.Println(1, "gc: runtime List error")
+		log.Println(1, err2)
+		return
+	}
+	used := make(map[string]bool)
+	for _, c := range conts {
+		used[c.Image] = true
+		if name, err := runtimes.NormalizeImage(c.Image); err == nil {
+			used[name] = true
+		}
+	}
+	l, err3 := rt.ListImages(ctx)
+	if err3 != nil {
+		log.Println(1, "gc: runtime ListImages error")
+		log.Println(1, err3)
+		return
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Created.Before(l[j].Created)
+	})
+	for _, img := range l {
+		if inUse(img, used) {
+			continue
+		}
+		refs := img.Names
+		if len(refs) == 0 {
+			refs = []string{img.ID}
+		}
+		for _, ref := range refs {
+			log.Println(1, "gc: removing image "+ref)
+			err := rt.RemoveImage(ctx, ref)
+			if err != nil {
+				log.Println(1, "gc: RemoveImage error")
+				log.Println(1, err)
+			}
+		}
+		usage, err = disk.Usage("/")
+		if err != nil || usage.UsedPercent < conf.ImageGCLowPercent {
+			break
+		}
+	}
+	err4 := images.Report()
+	if err4 != nil {
+		log.Println(1, "gc: image report error")
+		log.Println(1, err4)
+	}
+}
+
+func inUse(img runtimes.Image, used map[string]bool) bool {
+	if used[img.ID] {
+		return true
+	}
+	for _, name := range img.Names {
+		if used[name] {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/loqutus/rws/pkg/server/conf"
 	"github.com/loqutus/rws/pkg/server/etcd"
 	"github.com/loqutus/rws/pkg/server/utils"
 	"github.com/shirou/gopsutil/cpu"
@@ -11,6 +12,7 @@ import (
 	"github.com/shirou/gopsutil/mem"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -199,6 +201,89 @@ func HostListHandler(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+// LocalName returns the name this host reports in host_info, which is
+// the name stored in its /rws/hosts record.
+func LocalName() (string, error) {
+	nameBytes, err := ioutil.ReadFile("/etc/hostname")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(nameBytes)), nil
+}
+
+// IsLocal reports whether a container or file Host field refers to this host.
+func IsLocal(name string) bool {
+	if name == conf.LocalHostName {
+		return true
+	}
+	name = strings.Split(name, ":")[0]
+	if name == "localhost" || name == "127.0.0.1" {
+		return true
+	}
+	localName, err := LocalName()
+	return err == nil && name == localName
+}
+
+// Addr returns host:port of the rws server on the named host.
+func Addr(name string) string {
+	if strings.Contains(name, ":") {
+		return name
+	}
+	return name + ":" + conf.LocalPort
+}
+
+// LocalIP returns the IPv4 address of this host in the cluster network,
+// the one starting with conf.LocalIPPrefix, or else the first one that
+// isn't a loopback address.
+func LocalIP() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if strings.HasPrefix(ipNet.IP.String(), conf.LocalIPPrefix) {
+			return ipNet.IP.To4(), nil
+		}
+		if found == nil {
+			found = ipNet.IP.To4()
+		}
+	}
+	if found == nil {
+		return nil, errors.New("no IPv4 address found")
+	}
+	return found, nil
+}
+
+// AdvertisedIP returns conf.AdvertiseIP, or else the IPv4 address the
+// host name resolves to. LocalIP is the last resort, in a container it
+// is the address of the container and not the host's.
+func AdvertisedIP() (net.IP, error) {
+	if conf.AdvertiseIP != "" {
+		ip := net.ParseIP(conf.AdvertiseIP)
+		if ip == nil || ip.To4() == nil {
+			return nil, errors.New("bad AdvertiseIP " + conf.AdvertiseIP)
+		}
+		return ip.To4(), nil
+	}
+	name, err := LocalName()
+	if err == nil {
+		ips, err2 := net.LookupIP(name)
+		if err2 == nil {
+			for _, ip := range ips {
+				if ip.To4() != nil && !ip.IsLoopback() {
+					return ip.To4(), nil
+				}
+			}
+		}
+	}
+	return LocalIP()
+}
+
 func HostInfo() (string, error) {
 	ci, err1 := cpu.Info()
 	if err1 != nil {
@@ -212,11 +297,10 @@ func HostInfo() (string, error) {
 	if err3 != nil {
 		return "", err3
 	}
-	nameBytes, err := ioutil.ReadFile("/etc/hostname")
+	name, err := LocalName()
 	if err != nil {
 		return "", err
 	}
-	name := strings.TrimSpace(string(nameBytes))
 	var c = Host{name, 0, di.Free, mi.Available, uint64(len(ci))}
 	b, err := json.Marshal(c)
 	return string(b), err
@@ -0,0 +1,81 @@
+package hosts
+
+import (
+	"encoding/json"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/mem"
+	"log"
+	"net/http"
+	"time"
+)
+
+// HostStats is the current resource usage of a host, unlike Host which
+// is the free capacity recorded when the host was added.
+type HostStats struct {
+	Name        string
+	Cores       uint64
+	CPUPercent  float64
+	Load1       float64
+	Load5       float64
+	Load15      float64
+	MemoryUsed  uint64
+	MemoryTotal uint64
+	DiskUsed    uint64
+	DiskTotal   uint64
+}
+
+// Stats samples the local host, CPUPercent is measured over one second.
+func Stats() (HostStats, error) {
+	name, err := LocalName()
+	if err != nil {
+		return HostStats{}, err
+	}
+	s := HostStats{Name: name}
+	cores, err2 := cpu.Counts(true)
+	if err2 != nil {
+		return HostStats{}, err2
+	}
+	s.Cores = uint64(cores)
+	percent, err3 := cpu.Percent(time.Second, false)
+	if err3 != nil {
+		return HostStats{}, err3
+	}
+	if len(percent) > 0 {
+		s.CPUPercent = percent[0]
+	}
+	avg, err4 := load.Avg()
+	if err4 != nil {
+		return HostStats{}, err4
+	}
+	s.Load1, s.Load5, s.Load15 = avg.Load1, avg.Load5, avg.Load15
+	mi, err5 := mem.VirtualMemory()
+	if err5 != nil {
+		return HostStats{}, err5
+	}
+	s.MemoryUsed, s.MemoryTotal = mi.Total-mi.Available, mi.Total
+	di, err6 := disk.Usage("/")
+	if err6 != nil {
+		return HostStats{}, err6
+	}
+	s.DiskUsed, s.DiskTotal = di.Used, di.Total
+	return s, nil
+}
+
+func HostStatsHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println(1, "HostStatsHandler")
+	s, err := Stats()
+	if err != nil {
+		utils.Fail("HostStatsHandler: Stats error", err, w)
+		return
+	}
+	b, err2 := json.Marshal(s)
+	if err2 != nil {
+		utils.Fail("HostStatsHandler: json.Marshal error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,290 @@
+package images
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/registries"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HostImages is the image list an agent reports for its host under
+// /rws/images/<host>.
+type HostImages struct {
+	Host    string
+	Images  []runtimes.Image
+	Updated time.Time
+}
+
+// PullRequest asks for Image to be pulled on Hosts, on every host if
+// Hosts is empty.
+type PullRequest struct {
+	Image              string
+	Namespace          string
+	RegistryCredential string
+	Hosts              []string
+}
+
+type PullResult struct {
+	Host  string
+	Error string
+}
+
+// Report writes the local image list to etcd.
+func Report() error {
+	name, err := hosts.LocalName()
+	if err != nil {
+		return err
+	}
+	l, err2 := runtimes.Get().ListImages(context.Background())
+	if err2 != nil {
+		return err2
+	}
+	b, err3 := json.Marshal(HostImages{Host: name, Images: l, Updated: time.Now()})
+	if err3 != nil {
+		return err3
+	}
+	return etcd.SetKey("/rws/images/"+name, string(b))
+}
+
+// Reporter reports the local image list every conf.ImageReportInterval
+// seconds.
+func Reporter() {
+	for {
+		err := Report()
+		if err != nil {
+			log.Println(1, "Reporter: image report error")
+			log.Println(1, err)
+		}
+		time.Sleep(conf.ImageReportInterval * time.Second)
+	}
+}
+
+// List returns the image lists of all hosts.
+func List() ([]HostImages, error) {
+	dir, err := etcd.ListDir("/rws/images")
+	if err != nil {
+		return nil, err
+	}
+	var l []HostImages
+	for _, node := range dir {
+		var h HostImages
+		err := json.Unmarshal([]byte(node.Value), &h)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, h)
+	}
+	return l, nil
+}
+
+// Inventory maps host names to the normalized names of their images.
+type Inventory map[string]map[string]bool
+
+func GetInventory() (Inventory, error) {
+	l, err := List()
+	if err != nil {
+		return nil, err
+	}
+	inv := make(Inventory)
+	for _, h := range l {
+		names := make(map[string]bool)
+		for _, img := range h.Images {
+			for _, name := range img.Names {
+				names[name] = true
+			}
+		}
+		inv[h.Host] = names
+	}
+	return inv, nil
+}
+
+// Count returns how many of the images the host already has.
+func (inv Inventory) Count(host string, images []string) int {
+	n := 0
+	for _, image := range images {
+		name, err := runtimes.NormalizeImage(image)
+		if err == nil && inv[host][name] {
+			n++
+		}
+	}
+	return n
+}
+
+// Prefer sorts the hosts so the ones holding most of the images come
+// first, keeping the order of the others. Without an inventory the hosts
+// are returned as they are.
+func Prefer(hs []hosts.Host, images []string) []hosts.Host {
+	inv, err := GetInventory()
+	if err != nil {
+		log.Println(1, "Prefer: GetInventory error")
+		log.Println(1, err)
+		return hs
+	}
+	sorted := make([]hosts.Host, len(hs))
+	copy(sorted, hs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return inv.Count(sorted[i].Name, images) > inv.Count(sorted[j].Name, images)
+	})
+	return sorted
+}
+
+// Pull pulls the image on this host and reports the new image list.
+func Pull(req PullRequest) error {
+	if req.Image == "" {
+		return errors.New("image required")
+	}
+	var opts runtimes.PullOptions
+	if req.RegistryCredential != "" {
+		auth, err := registries.Auth(req.RegistryCredential, req.Namespace)
+		if err != nil {
+			return err
+		}
+		opts.Auth = auth
+	}
+	err2 := runtimes.Get().Pull(context.Background(), req.Image, opts)
+	if err2 != nil {
+		return err2
+	}
+	err3 := Report()
+	if err3 != nil {
+		log.Println(1, "Pull: image report error")
+		log.Println(1, err3)
+	}
+	return nil
+}
+
+// PullOn pulls the image on every host of the request in parallel.
+func PullOn(req PullRequest) ([]PullResult, error) {
+	dir, err := etcd.ListDir("/rws/hosts")
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]hosts.Host)
+	var all []string
+	for _, node := range dir {
+		var h hosts.Host
+		err := json.Unmarshal([]byte(node.Value), &h)
+		if err != nil {
+			return nil, err
+		}
+		known[h.Name] = h
+		all = append(all, h.Name)
+	}
+	names := req.Hosts
+	if len(names) == 0 {
+		names = all
+	}
+	results := make([]PullResult, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		results[i].Host = name
+		h, ok := known[name]
+		if !ok {
+			results[i].Error = "unknown host"
+			continue
+		}
+		wg.Add(1)
+		go func(i int, h hosts.Host) {
+			defer wg.Done()
+			err := pullOnHost(h, req)
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, h)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func pullOnHost(h hosts.Host, req PullRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	url := "http://" + h.Name + ":" + strconv.FormatUint(h.Port, 10) + "/image_pull_local"
+	resp, err2 := http.Post(url, "application/json", bytes.NewBuffer(b))
+	if err2 != nil {
+		return err2
+	}
+	defer resp.Body.Close()
+	body, err3 := ioutil.ReadAll(resp.Body)
+	if err3 != nil {
+		return err3
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+func ImageListHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println(1, "ImageListHandler")
+	l, err := List()
+	if err != nil {
+		utils.Fail("ImageListHandler: List error", err, w)
+		return
+	}
+	b, err2 := json.Marshal(l)
+	if err2 != nil {
+		utils.Fail("ImageListHandler: json.Marshal error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func ImagePullHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "ImagePullHandler")
+	var req PullRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.Fail("ImagePullHandler: json decode error", err, w)
+		return
+	}
+	if req.Image == "" {
+		utils.Fail("ImagePullHandler: no image", errors.New("image required"), w)
+		return
+	}
+	l, err2 := PullOn(req)
+	if err2 != nil {
+		utils.Fail("ImagePullHandler: PullOn error", err2, w)
+		return
+	}
+	b, err3 := json.Marshal(l)
+	if err3 != nil {
+		utils.Fail("ImagePullHandler: json.Marshal error", err3, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func ImagePullLocalHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "ImagePullLocalHandler")
+	var req PullRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.Fail("ImagePullLocalHandler: json decode error", err, w)
+		return
+	}
+	err2 := Pull(req)
+	if err2 != nil {
+		utils.Fail("ImagePullLocalHandler: Pull error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,228 @@
+package ingress
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/services"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Ingress routes HTTP requests whose Host and path match a rule to the
+// ready containers of the rule's pods, TLS terminates HTTPS for Hosts
+// with the certificate of a secret.
+type Ingress struct {
+	Name      string
+	Namespace string
+	Owner     string
+	Rules     []Rule
+	TLS       []TLS
+	Balancer  string
+}
+
+// Rule matches requests for Host, any host if empty or a subdomain for
+// *.domain, with a path starting with Path. They go to ContainerPort of
+// the pod named Pod or of the pods whose Labels have all of Selector.
+// With StripPath the Path prefix is removed before proxying.
+type Rule struct {
+	Host          string
+	Path          string
+	Pod           string
+	Selector      map[string]string
+	ContainerPort uint64
+	StripPath     bool
+}
+
+// TLS names the secret with the tls.crt and tls.key PEM files of Hosts,
+// the secret is in the namespace of the ingress. Hosts no rule of the
+// ingress routes are ignored.
+type TLS struct {
+	Hosts  []string
+	Secret string
+}
+
+func (ing Ingress) validate() error {
+	if ing.Name == "" {
+		return errors.New("ingress name required")
+	}
+	if len(ing.Rules) == 0 {
+		return errors.New("ingress " + ing.Name + " needs Rules")
+	}
+	switch ing.Balancer {
+	case "", services.BalancerRoundRobin, services.BalancerLeastConnections:
+	default:
+		return errors.New("unknown balancer " + ing.Balancer)
+	}
+	for _, r := range ing.Rules {
+		if r.Pod == "" && len(r.Selector) == 0 {
+			return errors.New("ingress " + ing.Name + " rules need a Pod or a Selector")
+		}
+		if r.ContainerPort == 0 {
+			return errors.New("ingress " + ing.Name + " rules need a ContainerPort")
+		}
+		if strings.Contains(r.Host, ":") || strings.Contains(r.Host, "/") {
+			return errors.New("bad ingress host " + r.Host)
+		}
+		if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+			return errors.New("ingress path " + r.Path + " has to start with /")
+		}
+	}
+	for _, t := range ing.TLS {
+		if t.Secret == "" || len(t.Hosts) == 0 {
+			return errors.New("ingress " + ing.Name + " TLS needs a Secret and Hosts")
+		}
+	}
+	return nil
+}
+
+func save(ing Ingress, create bool) error {
+	err := ing.validate()
+	if err != nil {
+		return err
+	}
+	b, err2 := json.Marshal(ing)
+	if err2 != nil {
+		return err2
+	}
+	if create {
+		return etcd.CreateKey("/rws/ingresses/"+ing.Name, string(b))
+	}
+	return etcd.SetKey("/rws/ingresses/"+ing.Name, string(b))
+}
+
+// sameOwner rejects changes to the ingress current from another
+// namespace or owner, ingress names are unique across namespaces.
+func sameOwner(current, ing Ingress) error {
+	if current.Namespace != ing.Namespace || current.Owner != ing.Owner {
+		return errors.New("ingress " + current.Name + " exists in namespace " + current.Namespace + " of owner " + current.Owner)
+	}
+	return nil
+}
+
+func AddIngress(ing Ingress) error {
+	log.Println(1, "AddIngress")
+	current, err := GetIngress(ing.Name)
+	if err == nil {
+		return errors.New("ingress " + ing.Name + " exists in namespace " + current.Namespace)
+	}
+	return save(ing, true)
+}
+
+func UpdateIngress(ing Ingress) error {
+	log.Println(1, "UpdateIngress")
+	current, err := GetIngress(ing.Name)
+	if err != nil {
+		return err
+	}
+	err2 := sameOwner(current, ing)
+	if err2 != nil {
+		return err2
+	}
+	return save(ing, false)
+}
+
+func GetIngress(name string) (Ingress, error) {
+	ingressString, err := etcd.GetKey("/rws/ingresses/" + name)
+	if err != nil {
+		return Ingress{}, errors.New("ingress " + name + " not found")
+	}
+	var ing Ingress
+	err2 := json.Unmarshal([]byte(ingressString), &ing)
+	return ing, err2
+}
+
+func RemoveIngress(name string) error {
+	log.Println(1, "RemoveIngress")
+	_, err := GetIngress(name)
+	if err != nil {
+		return err
+	}
+	return etcd.DeleteKey("/rws/ingresses/" + name)
+}
+
+func ListIngresses() ([]Ingress, error) {
+	dir, err := etcd.ListDir("/rws/ingresses")
+	if err != nil {
+		return nil, err
+	}
+	var l []Ingress
+	for _, node := range dir {
+		var ing Ingress
+		err := json.Unmarshal([]byte(node.Value), &ing)
+		if err != nil {
+			log.Println(1, "ListIngresses: json.Unmarshal error")
+			return nil, err
+		}
+		l = append(l, ing)
+	}
+	return l, nil
+}
+
+func IngressAddHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "IngressAddHandler")
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		utils.Fail("IngressAddHandler: request read error", err, w)
+		return
+	}
+	var ing Ingress
+	err2 := json.Unmarshal(bodyBytes, &ing)
+	if err2 != nil {
+		utils.Fail("IngressAddHandler: json.Unmarshal error", err2, w)
+		return
+	}
+	err3 := AddIngress(ing)
+	if err3 != nil {
+		utils.Fail("IngressAddHandler: AddIngress error", err3, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func IngressRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "IngressRemoveHandler")
+	var ing Ingress
+	err := json.NewDecoder(r.Body).Decode(&ing)
+	if err != nil {
+		utils.Fail("IngressRemoveHandler: json decode error", err, w)
+		return
+	}
+	current, err2 := GetIngress(ing.Name)
+	if err2 != nil {
+		utils.Fail("IngressRemoveHandler: GetIngress error", err2, w)
+		return
+	}
+	err3 := sameOwner(current, ing)
+	if err3 != nil {
+		utils.Fail("IngressRemoveHandler: namespace or owner mismatch", err3, w)
+		return
+	}
+	err4 := RemoveIngress(ing.Name)
+	if err4 != nil {
+		utils.Fail("IngressRemoveHandler: RemoveIngress error", err4, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func IngressListHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println(1, "IngressListHandler")
+	l, err := ListIngresses()
+	if err != nil {
+		utils.Fail("IngressListHandler: ListIngresses error", err, w)
+		return
+	}
+	b, err2 := json.Marshal(l)
+	if err2 != nil {
+		utils.Fail("IngressListHandler: json.Marshal error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,299 @@
+package ingress
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/secrets"
+	"github.com/loqutus/rws/pkg/server/services"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// route is a rule of an ingress with the endpoints it proxies to.
+type route struct {
+	ingress string
+	host    string
+	path    string
+	strip   bool
+	pool    *services.Pool
+}
+
+// table is what the router serves, it is replaced as a whole on reload.
+type table struct {
+	routes []route
+	certs  map[string]*tls.Certificate
+}
+
+var current struct {
+	sync.RWMutex
+	t *table
+}
+
+// pools keeps the state of the balancers of the routes between reloads.
+var pools = make(map[string]*services.Pool)
+
+func getTable() *table {
+	current.RLock()
+	defer current.RUnlock()
+	return current.t
+}
+
+// rank orders exact hosts before wildcards before rules for any host.
+func rank(host string) int {
+	switch {
+	case host == "":
+		return 2
+	case strings.HasPrefix(host, "*."):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func hostMatches(pattern, host string) bool {
+	switch rank(pattern) {
+	case 2:
+		return true
+	case 1:
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	default:
+		return host == pattern
+	}
+}
+
+func pathMatches(prefix, path string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// sortRoutes orders the routes by rank of their host, longer paths first.
+func sortRoutes(routes []route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		a, b := routes[i], routes[j]
+		if rank(a.host) != rank(b.host) {
+			return rank(a.host) < rank(b.host)
+		}
+		return len(a.path) > len(b.path)
+	})
+}
+
+// stripPath removes the route's path prefix from the request path.
+func stripPath(prefix, path string) string {
+	if prefix == "/" {
+		return path
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(path, strings.TrimSuffix(prefix, "/")), "/")
+}
+
+// match returns the route of the most specific host with the longest
+// path prefix.
+func (t *table) match(host, path string) *route {
+	for i := range t.routes {
+		r := &t.routes[i]
+		if hostMatches(r.host, host) && pathMatches(r.path, path) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (t *table) certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(hello.ServerName)
+	if c, ok := t.certs[name]; ok {
+		return c, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if c, ok := t.certs["*"+name[i:]]; ok {
+			return c, nil
+		}
+	}
+	return nil, errors.New("no certificate for " + name)
+}
+
+// routesHost reports whether one of the rule hosts routes h, a rule for
+// any host doesn't, so an ingress can't take over certificates of hosts
+// other ingresses route.
+func routesHost(ruleHosts []string, h string) bool {
+	for _, rh := range ruleHosts {
+		if rh != "" && (rh == h || hostMatches(rh, h)) {
+			return true
+		}
+	}
+	return false
+}
+
+// load builds the table from the ingresses, the ready containers and
+// the certificate secrets.
+func load() (*table, error) {
+	l, err := ListIngresses()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+	podsList, conts, err2 := services.Snapshot()
+	if err2 != nil {
+		return nil, err2
+	}
+	t := &table{certs: make(map[string]*tls.Certificate)}
+	seen := make(map[string]string)
+	newPools := make(map[string]*services.Pool)
+	for _, ing := range l {
+		var routed []string
+		for _, r := range ing.Rules {
+			host := strings.ToLower(r.Host)
+			path := r.Path
+			if path == "" {
+				path = "/"
+			}
+			key := host + path
+			if owner, ok := seen[key]; ok {
+				log.Println(1, "ingress: "+ing.Name+" rule for "+key+" is shadowed by ingress "+owner)
+				continue
+			}
+			seen[key] = ing.Name
+			s := services.Service{
+				Namespace: ing.Namespace,
+				Pod:       r.Pod,
+				Selector:  r.Selector,
+				Ports:     []services.ServicePort{{ContainerPort: r.ContainerPort}},
+			}
+			var addrs []string
+			for _, e := range s.Resolve(podsList, conts) {
+				addrs = append(addrs, e.Addr)
+			}
+			pool, ok := pools[key]
+			if !ok {
+				pool = services.NewPool()
+			}
+			pool.Update(ing.Balancer, addrs)
+			newPools[key] = pool
+			t.routes = append(t.routes, route{ingress: ing.Name, host: host, path: path, strip: r.StripPath, pool: pool})
+			routed = append(routed, host)
+		}
+		for _, tl := range ing.TLS {
+			cert, err3 := secrets.Value(tl.Secret, ing.Namespace, "tls.crt")
+			key, err4 := secrets.Value(tl.Secret, ing.Namespace, "tls.key")
+			if err3 == nil {
+				err3 = err4
+			}
+			var pair tls.Certificate
+			if err3 == nil {
+				pair, err3 = tls.X509KeyPair([]byte(cert), []byte(key))
+			}
+			if err3 != nil {
+				log.Println(1, "ingress: certificate error for ingress "+ing.Name+" secret "+tl.Secret)
+				log.Println(1, err3)
+				continue
+			}
+			for _, h := range tl.Hosts {
+				h = strings.ToLower(h)
+				if !routesHost(routed, h) {
+					log.Println(1, "ingress: "+ing.Name+" has no rule for TLS host "+h)
+					continue
+				}
+				if _, ok := t.certs[h]; !ok {
+					t.certs[h] = &pair
+				}
+			}
+		}
+	}
+	sortRoutes(t.routes)
+	pools = newPools
+	return t, nil
+}
+
+func reload() {
+	t, err := load()
+	if err != nil {
+		log.Println(1, "ingress: load error")
+		log.Println(1, err)
+		return
+	}
+	current.Lock()
+	current.t = t
+	current.Unlock()
+}
+
+// serveHTTP proxies the request by the route of its Host and path.
+func serveHTTP(w http.ResponseWriter, r *http.Request) {
+	t := getTable()
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var rt *route
+	if t != nil {
+		rt = t.match(host, r.URL.Path)
+	}
+	if rt == nil {
+		http.NotFound(w, r)
+		return
+	}
+	addr, err := rt.pool.Pick(nil)
+	if err != nil {
+		http.Error(w, "ingress "+rt.ingress+": "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer rt.pool.Done(addr)
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	proxy := &httputil.ReverseProxy{Director: func(req *http.Request) {
+		req.URL.Scheme = "http"
+		req.URL.Host = addr
+		if rt.strip && rt.path != "/" {
+			req.URL.Path = stripPath(rt.path, req.URL.Path)
+			req.URL.RawPath = ""
+		}
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.Header.Set("X-Forwarded-Host", r.Host)
+	}}
+	proxy.ServeHTTP(w, r)
+}
+
+func serve(srv *http.Server, withTLS bool) {
+	for {
+		var err error
+		if withTLS {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		log.Println(1, "ingress: listen error on "+srv.Addr)
+		log.Println(1, err)
+		time.Sleep(60 * time.Second)
+	}
+}
+
+// Router serves the ingresses on conf.IngressHTTPAddr and, with the
+// certificates of their TLS secrets, on conf.IngressHTTPSAddr. Changes
+// to ingresses, certificates and containers are picked up every
+// conf.IngressSyncInterval seconds.
+func Router() {
+	reload()
+	handler := http.HandlerFunc(serveHTTP)
+	go serve(&http.Server{Addr: conf.IngressHTTPAddr, Handler: handler}, false)
+	go serve(&http.Server{
+		Addr:    conf.IngressHTTPSAddr,
+		Handler: handler,
+		TLSConfig: &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			t := getTable()
+			if t == nil {
+				return nil, errors.New("no ingresses loaded")
+			}
+			return t.certificate(hello)
+		}},
+	}, true)
+	for {
+		time.Sleep(conf.IngressSyncInterval * time.Second)
+		reload()
+	}
+}
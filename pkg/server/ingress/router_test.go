@@ -0,0 +1,198 @@
+package ingress
+
+import (
+	"github.com/loqutus/rws/pkg/server/services"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRank(t *testing.T) {
+	tests := []struct {
+		host string
+		want int
+	}{
+		{"example.com", 0},
+		{"*.example.com", 1},
+		{"", 2},
+	}
+	for _, tt := range tests {
+		if got := rank(tt.host); got != tt.want {
+			t.Errorf("rank(%q) = %d, want %d", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"", "example.com", true},
+		{"", "", true},
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.example.com", "badexample.com", false},
+	}
+	for _, tt := range tests {
+		if got := hostMatches(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("hostMatches(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRoutesHost(t *testing.T) {
+	ruleHosts := []string{"", "www.example.com", "*.example.org"}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"www.example.com", true},
+		{"*.example.org", true},
+		{"shop.example.org", true},
+		{"example.com", false},
+		{"*.example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := routesHost(ruleHosts, tt.host); got != tt.want {
+			t.Errorf("routesHost(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestPathMatches(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		{"/", "/", true},
+		{"/", "/api/users", true},
+		{"/api", "/api", true},
+		{"/api", "/api/users", true},
+		{"/api", "/apiv2", false},
+		{"/api", "/", false},
+		{"/api/", "/api", true},
+		{"/api/", "/api/users", true},
+		{"/api/v1", "/api/v2", false},
+	}
+	for _, tt := range tests {
+		if got := pathMatches(tt.prefix, tt.path); got != tt.want {
+			t.Errorf("pathMatches(%q, %q) = %v, want %v", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	routes := []route{
+		{ingress: "any", host: "", path: "/"},
+		{ingress: "any-api", host: "", path: "/api"},
+		{ingress: "wildcard", host: "*.example.com", path: "/"},
+		{ingress: "site", host: "www.example.com", path: "/"},
+		{ingress: "site-api", host: "www.example.com", path: "/api"},
+		{ingress: "site-api-v2", host: "www.example.com", path: "/api/v2"},
+	}
+	sortRoutes(routes)
+	var order []string
+	for _, r := range routes {
+		order = append(order, r.ingress)
+	}
+	wantOrder := []string{"site-api-v2", "site-api", "site", "wildcard", "any-api", "any"}
+	for i := range wantOrder {
+		if order[i] != wantOrder[i] {
+			t.Fatalf("routes sorted as %v, want %v", order, wantOrder)
+		}
+	}
+	tbl := &table{routes: routes}
+	tests := []struct {
+		host string
+		path string
+		want string
+	}{
+		{"www.example.com", "/", "site"},
+		{"www.example.com", "/api/users", "site-api"},
+		{"www.example.com", "/api/v2/users", "site-api-v2"},
+		{"www.example.com", "/apiv2", "site"},
+		{"shop.example.com", "/api", "wildcard"},
+		{"example.org", "/api/users", "any-api"},
+		{"example.org", "/", "any"},
+	}
+	for _, tt := range tests {
+		r := tbl.match(tt.host, tt.path)
+		if r == nil || r.ingress != tt.want {
+			t.Errorf("match(%q, %q) = %v, want %s", tt.host, tt.path, r, tt.want)
+		}
+	}
+	if r := (&table{routes: routes[:3]}).match("example.org", "/"); r != nil {
+		t.Errorf("match without a route for any host = %v, want nil", r)
+	}
+}
+
+func TestStripPath(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   string
+	}{
+		{"/", "/api/users", "/api/users"},
+		{"/api", "/api/users", "/users"},
+		{"/api", "/api", "/"},
+		{"/api/", "/api/users", "/users"},
+		{"/api/", "/api", "/"},
+		{"/api/v1", "/api/v1/users/1", "/users/1"},
+	}
+	for _, tt := range tests {
+		if got := stripPath(tt.prefix, tt.path); got != tt.want {
+			t.Errorf("stripPath(%q, %q) = %q, want %q", tt.prefix, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + " " + r.Header.Get("X-Forwarded-Host")))
+	}))
+	defer backend.Close()
+	pool := services.NewPool()
+	pool.Update("", []string{strings.TrimPrefix(backend.URL, "http://")})
+	routes := []route{
+		{ingress: "api", host: "www.example.com", path: "/api", strip: true, pool: pool},
+		{ingress: "site", host: "www.example.com", path: "/", pool: pool},
+		{ingress: "empty", host: "empty.example.com", path: "/", pool: services.NewPool()},
+	}
+	sortRoutes(routes)
+	current.Lock()
+	current.t = &table{routes: routes}
+	current.Unlock()
+	tests := []struct {
+		url  string
+		code int
+		want string
+	}{
+		{"http://www.example.com/api/users?id=1", http.StatusOK, "/users www.example.com"},
+		{"http://www.example.com:8080/api", http.StatusOK, "/ www.example.com:8080"},
+		{"http://WWW.example.com/index.html", http.StatusOK, "/index.html WWW.example.com"},
+		{"http://empty.example.com/", http.StatusServiceUnavailable, ""},
+		{"http://example.org/", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		serveHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		if w.Code != tt.code {
+			t.Errorf("%s: got status %d, want %d", tt.url, w.Code, tt.code)
+			continue
+		}
+		if tt.want != "" && string(body) != tt.want {
+			t.Errorf("%s: backend got %q, want %q", tt.url, body, tt.want)
+		}
+	}
+}
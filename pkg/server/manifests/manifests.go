@@ -0,0 +1,613 @@
+package manifests
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/ingress"
+	"github.com/loqutus/rws/pkg/server/pods"
+	"github.com/loqutus/rws/pkg/server/quotas"
+	"github.com/loqutus/rws/pkg/server/services"
+	"github.com/loqutus/rws/pkg/server/storage"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of objects a manifest can hold.
+const (
+	KindPod       = "Pod"
+	KindContainer = "Container"
+	KindHost      = "Host"
+	KindFile      = "File"
+	KindQuota     = "Quota"
+	KindService   = "Service"
+	KindIngress   = "Ingress"
+)
+
+// Actions reported for every object.
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionUnchanged = "unchanged"
+	ActionDelete    = "delete"
+	ActionNotFound  = "not found"
+)
+
+// Object is one object of a manifest, Spec has the fields of the object
+// type of Kind.
+type Object struct {
+	Kind string
+	Spec json.RawMessage
+}
+
+// Request is the body of apply and delete. With DryRun nothing is changed,
+// the results say what would be done.
+type Request struct {
+	Objects []Object
+	DryRun  bool
+}
+
+// Result is what was done to one object. Changes lists the fields that
+// differ from the current object as "Field: current -> desired".
+type Result struct {
+	Kind    string
+	Name    string
+	Action  string
+	Changes []string
+	Error   string
+}
+
+// kind is the implementation of one object kind. current returns nil if
+// the object doesn't exist, comparable returns the fields compared by
+// apply of the current and the desired object.
+type kind interface {
+	decode(spec json.RawMessage) (name string, desired interface{}, err error)
+	current(name string) (interface{}, error)
+	comparable(current, desired interface{}) (interface{}, interface{})
+	create(desired interface{}) error
+	update(current, desired interface{}) error
+	remove(name string) error
+}
+
+var kinds = map[string]kind{
+	KindPod:       podKind{},
+	KindContainer: containerKind{},
+	KindHost:      hostKind{},
+	KindFile:      fileKind{},
+	KindQuota:     quotaKind{},
+	KindService:   serviceKind{},
+	KindIngress:   ingressKind{},
+}
+
+// kindOf returns the implementation of a kind, matched in any case.
+func kindOf(name string) (kind, error) {
+	for n, k := range kinds {
+		if strings.EqualFold(n, name) {
+			return k, nil
+		}
+	}
+	return nil, errors.New("unknown kind " + name)
+}
+
+// changes compares the objects field by field.
+func changes(current, desired interface{}) ([]string, error) {
+	a, err := fields(current)
+	if err != nil {
+		return nil, err
+	}
+	b, err2 := fields(desired)
+	if err2 != nil {
+		return nil, err2
+	}
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var l []string
+	for _, k := range keys {
+		if string(a[k]) != string(b[k]) {
+			l = append(l, k+": "+string(a[k])+" -> "+string(b[k]))
+		}
+	}
+	return l, nil
+}
+
+func fields(v interface{}) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]json.RawMessage)
+	err2 := json.Unmarshal(b, &m)
+	return m, err2
+}
+
+// Apply creates the objects that don't exist and updates those that
+// differ from their manifest, in order.
+func Apply(req Request) []Result {
+	var results []Result
+	for _, o := range req.Objects {
+		r := Result{Kind: o.Kind}
+		err := apply(o, req.DryRun, &r)
+		if err != nil {
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func apply(o Object, dryRun bool, r *Result) error {
+	k, err0 := kindOf(o.Kind)
+	if err0 != nil {
+		return err0
+	}
+	name, desired, err := k.decode(o.Spec)
+	if err != nil {
+		return err
+	}
+	r.Name = name
+	current, err2 := k.current(name)
+	if err2 != nil {
+		return err2
+	}
+	if current == nil {
+		r.Action = ActionCreate
+		if dryRun {
+			return nil
+		}
+		return k.create(desired)
+	}
+	a, b := k.comparable(current, desired)
+	l, err3 := changes(a, b)
+	if err3 != nil {
+		return err3
+	}
+	if len(l) == 0 {
+		r.Action = ActionUnchanged
+		return nil
+	}
+	r.Action = ActionUpdate
+	r.Changes = l
+	if dryRun {
+		return nil
+	}
+	return k.update(current, desired)
+}
+
+// Delete removes the objects of the manifest, in reverse order so objects
+// are removed before those they depend on.
+func Delete(req Request) []Result {
+	var results []Result
+	for i := len(req.Objects) - 1; i >= 0; i-- {
+		o := req.Objects[i]
+		r := Result{Kind: o.Kind}
+		err := remove(o, req.DryRun, &r)
+		if err != nil {
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func remove(o Object, dryRun bool, r *Result) error {
+	k, err0 := kindOf(o.Kind)
+	if err0 != nil {
+		return err0
+	}
+	name, _, err := k.decode(o.Spec)
+	if err != nil {
+		return err
+	}
+	r.Name = name
+	current, err2 := k.current(name)
+	if err2 != nil {
+		return err2
+	}
+	if current == nil {
+		r.Action = ActionNotFound
+		return nil
+	}
+	r.Action = ActionDelete
+	if dryRun {
+		return nil
+	}
+	return k.remove(name)
+}
+
+// getRecord reads the record name in the etcd dir into v, it returns
+// false if there is none.
+func getRecord(dirName, name string, v interface{}) (bool, error) {
+	dir, err := etcd.ListDir(dirName)
+	if err != nil {
+		return false, err
+	}
+	for _, node := range dir {
+		if node.Key == dirName+"/"+name {
+			return true, json.Unmarshal([]byte(node.Value), v)
+		}
+	}
+	return false, nil
+}
+
+// post sends v to an action of this host, the handlers of the actions
+// do the quota checks and the placement.
+func post(action string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err2 := http.Post("http://"+conf.LocalHostName+"/"+action, "application/json", bytes.NewBuffer(b))
+	if err2 != nil {
+		return err2
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(action + " returned " + strconv.Itoa(resp.StatusCode) + ": " + string(body))
+	}
+	return nil
+}
+
+func decodeName(spec json.RawMessage, v interface{}, name func() string) (string, error) {
+	err := json.Unmarshal(spec, v)
+	if err != nil {
+		return "", err
+	}
+	if name() == "" {
+		return "", errors.New("name required")
+	}
+	return name(), nil
+}
+
+type podKind struct{}
+
+func (podKind) decode(spec json.RawMessage) (string, interface{}, error) {
+	var p pods.Pod
+	name, err := decodeName(spec, &p, func() string { return p.Name })
+	p.Containers = nil
+	p.Status = nil
+	p.Deleting = false
+	return name, p, err
+}
+
+func (podKind) current(name string) (interface{}, error) {
+	var p pods.Pod
+	found, err := getRecord("/rws/pods", name, &p)
+	if !found || err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (podKind) comparable(current, desired interface{}) (interface{}, interface{}) {
+	p := current.(pods.Pod)
+	p.Containers = nil
+	return p, desired
+}
+
+func (podKind) create(desired interface{}) error {
+	return post("pod_add", desired)
+}
+
+func (podKind) update(_, desired interface{}) error {
+	return pods.UpdatePod(desired.(pods.Pod))
+}
+
+func (podKind) remove(name string) error {
+	r, err := pods.RemovePod(name)
+	if err != nil {
+		return err
+	}
+	return r.Err()
+}
+
+type containerKind struct{}
+
+func (containerKind) decode(spec json.RawMessage) (string, interface{}, error) {
+	var c containers.Container
+	name, err := decodeName(spec, &c, func() string { return c.Name })
+	return name, c.Spec(), err
+}
+
+func (containerKind) current(name string) (interface{}, error) {
+	var c containers.Container
+	found, err := getRecord("/rws/containers", name, &c)
+	if !found || err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// comparable takes over automatically allocated host ports, a manifest
+// without a host port doesn't ask for a different one.
+func (containerKind) comparable(current, desired interface{}) (interface{}, interface{}) {
+	c := current.(containers.Container).Spec()
+	d := desired.(containers.Container)
+	allocated := make(map[uint64]uint64)
+	for _, p := range c.Ports {
+		allocated[p.ContainerPort] = p.HostPort
+	}
+	var ports []containers.Port
+	for _, p := range d.Ports {
+		if p.HostPort == 0 {
+			p.HostPort = allocated[p.ContainerPort]
+		}
+		ports = append(ports, p)
+	}
+	d.Ports = ports
+	return c, d
+}
+
+func (containerKind) create(desired interface{}) error {
+	return post("container_run", desired)
+}
+
+// update replaces the container, containers can't be changed in place.
+func (containerKind) update(current, desired interface{}) error {
+	err := containers.Delete(current.(containers.Container).Name)
+	if err != nil {
+		return err
+	}
+	return post("container_run", desired)
+}
+
+func (containerKind) remove(name string) error {
+	return containers.Delete(name)
+}
+
+// hostSpec is the part of a host record a manifest sets, the rest is
+// measured on the host.
+type hostSpec struct {
+	Name string
+	Port uint64
+}
+
+type hostKind struct{}
+
+func (hostKind) decode(spec json.RawMessage) (string, interface{}, error) {
+	var h hostSpec
+	name, err := decodeName(spec, &h, func() string { return h.Name })
+	if h.Port == 0 {
+		port, _ := strconv.ParseUint(conf.LocalPort, 10, 64)
+		h.Port = port
+	}
+	return name, h, err
+}
+
+func (hostKind) current(name string) (interface{}, error) {
+	var h hosts.Host
+	found, err := getRecord("/rws/hosts", name, &h)
+	if !found || err != nil {
+		return nil, err
+	}
+	return hostSpec{Name: name, Port: h.Port}, nil
+}
+
+func (hostKind) comparable(current, desired interface{}) (interface{}, interface{}) {
+	return current, desired
+}
+
+func (hostKind) create(desired interface{}) error {
+	h := desired.(hostSpec)
+	return hosts.AddHost(h.Name, h.Port)
+}
+
+func (hostKind) update(_, desired interface{}) error {
+	h := desired.(hostSpec)
+	err := hosts.RemoveHost(h.Name)
+	if err != nil {
+		return err
+	}
+	return hosts.AddHost(h.Name, h.Port)
+}
+
+func (hostKind) remove(name string) error {
+	return hosts.RemoveHost(name)
+}
+
+// fileSpec is the metadata of a stored file a manifest sets, the content
+// is uploaded with storage_upload.
+type fileSpec struct {
+	Name      string
+	Namespace string
+	Owner     string
+}
+
+type fileKind struct{}
+
+func (fileKind) decode(spec json.RawMessage) (string, interface{}, error) {
+	var f fileSpec
+	name, err := decodeName(spec, &f, func() string { return f.Name })
+	return name, f, err
+}
+
+func (fileKind) current(name string) (interface{}, error) {
+	var f storage.File
+	found, err := getRecord("/rws/storage", name, &f)
+	if !found || err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fileKind) comparable(current, desired interface{}) (interface{}, interface{}) {
+	f := current.(storage.File)
+	return fileSpec{Name: f.Name, Namespace: f.Namespace, Owner: f.Owner}, desired
+}
+
+func (fileKind) create(desired interface{}) error {
+	return errors.New("file " + desired.(fileSpec).Name + " doesn't exist, upload it with storage_upload first")
+}
+
+func (fileKind) update(current, desired interface{}) error {
+	f := current.(storage.File)
+	d := desired.(fileSpec)
+	f.Namespace = d.Namespace
+	f.Owner = d.Owner
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return etcd.SetKey("/rws/storage/"+f.Name, string(b))
+}
+
+func (fileKind) remove(name string) error {
+	resp, err := http.Get("http://" + conf.LocalHostName + "/storage_remove/" + name)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("storage_remove returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type quotaKind struct{}
+
+func (quotaKind) decode(spec json.RawMessage) (string, interface{}, error) {
+	var q quotas.Quota
+	name, err := decodeName(spec, &q, func() string { return q.Name })
+	return name, q, err
+}
+
+func (quotaKind) current(name string) (interface{}, error) {
+	var q quotas.Quota
+	found, err := getRecord("/rws/quotas", name, &q)
+	if !found || err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (quotaKind) comparable(current, desired interface{}) (interface{}, interface{}) {
+	return current, desired
+}
+
+func (quotaKind) create(desired interface{}) error {
+	return quotas.AddQuota(desired.(quotas.Quota))
+}
+
+func (quotaKind) update(_, desired interface{}) error {
+	q := desired.(quotas.Quota)
+	err := quotas.RemoveQuota(q.Name)
+	if err != nil {
+		return err
+	}
+	return quotas.AddQuota(q)
+}
+
+func (quotaKind) remove(name string) error {
+	return quotas.RemoveQuota(name)
+}
+
+type serviceKind struct{}
+
+func (serviceKind) decode(spec json.RawMessage) (string, interface{}, error) {
+	var s services.Service
+	name, err := decodeName(spec, &s, func() string { return s.Name })
+	s.Endpoints = nil
+	return name, s, err
+}
+
+func (serviceKind) current(name string) (interface{}, error) {
+	var s services.Service
+	found, err := getRecord("/rws/services", name, &s)
+	if !found || err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// comparable gives desired ports without a Port the allocated ones.
+func (serviceKind) comparable(current, desired interface{}) (interface{}, interface{}) {
+	return current, services.KeepPorts(current.(services.Service), desired.(services.Service))
+}
+
+func (serviceKind) create(desired interface{}) error {
+	return services.AddService(desired.(services.Service))
+}
+
+func (serviceKind) update(_, desired interface{}) error {
+	return services.UpdateService(desired.(services.Service))
+}
+
+func (serviceKind) remove(name string) error {
+	return services.RemoveService(name)
+}
+
+type ingressKind struct{}
+
+func (ingressKind) decode(spec json.RawMessage) (string, interface{}, error) {
+	var ing ingress.Ingress
+	name, err := decodeName(spec, &ing, func() string { return ing.Name })
+	return name, ing, err
+}
+
+func (ingressKind) current(name string) (interface{}, error) {
+	var ing ingress.Ingress
+	found, err := getRecord("/rws/ingresses", name, &ing)
+	if !found || err != nil {
+		return nil, err
+	}
+	return ing, nil
+}
+
+func (ingressKind) comparable(current, desired interface{}) (interface{}, interface{}) {
+	return current, desired
+}
+
+func (ingressKind) create(desired interface{}) error {
+	return ingress.AddIngress(desired.(ingress.Ingress))
+}
+
+func (ingressKind) update(_, desired interface{}) error {
+	return ingress.UpdateIngress(desired.(ingress.Ingress))
+}
+
+func (ingressKind) remove(name string) error {
+	return ingress.RemoveIngress(name)
+}
+
+func handle(w http.ResponseWriter, r *http.Request, name string, do func(Request) []Result) {
+	log.Println(1, name)
+	var req Request
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.Fail(name+": json decode error", err, w)
+		return
+	}
+	b, err2 := json.Marshal(do(req))
+	if err2 != nil {
+		utils.Fail(name+": json.Marshal error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func ApplyHandler(w http.ResponseWriter, r *http.Request) {
+	handle(w, r, "ApplyHandler", Apply)
+}
+
+func DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	handle(w, r, "DeleteHandler", Delete)
+}
@@ -0,0 +1,176 @@
+package manifests
+
+import (
+	"encoding/json"
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/pods"
+	"github.com/loqutus/rws/pkg/server/services"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		current interface{}
+		desired interface{}
+		want    []string
+	}{
+		{
+			name:    "same",
+			current: pods.Pod{Name: "web", Image: "nginx", Count: 2},
+			desired: pods.Pod{Name: "web", Image: "nginx", Count: 2},
+		},
+		{
+			name:    "fields in order",
+			current: pods.Pod{Name: "web", Image: "nginx", Count: 2},
+			desired: pods.Pod{Name: "web", Image: "nginx:1.19", Count: 3},
+			want:    []string{`Count: 2 -> 3`, `Image: "nginx" -> "nginx:1.19"`},
+		},
+		{
+			name:    "nested",
+			current: pods.Pod{Name: "web", Labels: map[string]string{"app": "web"}},
+			desired: pods.Pod{Name: "web", Labels: map[string]string{"app": "web", "tier": "front"}},
+			want:    []string{`Labels: {"app":"web"} -> {"app":"web","tier":"front"}`},
+		},
+		{
+			name:    "added and removed fields",
+			current: map[string]interface{}{"Name": "a", "Old": 1},
+			desired: map[string]interface{}{"Name": "a", "New": true},
+			want:    []string{`New:  -> true`, `Old: 1 -> `},
+		},
+	}
+	for _, tt := range tests {
+		got, err := changes(tt.current, tt.desired)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContainerComparable(t *testing.T) {
+	current := containers.Container{
+		Name:       "web",
+		Image:      "nginx",
+		Host:       "pi1:8888",
+		ID:         "abcdef",
+		State:      "running",
+		Ready:      true,
+		StartedAt:  time.Now(),
+		SpecHash:   "1234",
+		Endpoints:  []string{"pi1:30001"},
+		PullStatus: "done",
+		Ports: []containers.Port{
+			{ContainerPort: 80, HostPort: 30001},
+			{ContainerPort: 443, HostPort: 8443},
+		},
+	}
+	tests := []struct {
+		name    string
+		desired containers.Container
+		want    []string
+	}{
+		{
+			name: "allocated host ports carried over",
+			desired: containers.Container{Name: "web", Image: "nginx",
+				Ports: []containers.Port{{ContainerPort: 80}, {ContainerPort: 443, HostPort: 8443}}},
+		},
+		{
+			name: "explicit host port differs",
+			desired: containers.Container{Name: "web", Image: "nginx",
+				Ports: []containers.Port{{ContainerPort: 80, HostPort: 8080}, {ContainerPort: 443}}},
+			want: []string{`Ports: [{"ContainerPort":80,"HostPort":30001,"Protocol":""},{"ContainerPort":443,"HostPort":8443,"Protocol":""}]` +
+				` -> [{"ContainerPort":80,"HostPort":8080,"Protocol":""},{"ContainerPort":443,"HostPort":8443,"Protocol":""}]`},
+		},
+		{
+			name: "new container port",
+			desired: containers.Container{Name: "web", Image: "nginx",
+				Ports: []containers.Port{{ContainerPort: 80}, {ContainerPort: 443}, {ContainerPort: 8080}}},
+			want: []string{`Ports: [{"ContainerPort":80,"HostPort":30001,"Protocol":""},{"ContainerPort":443,"HostPort":8443,"Protocol":""}]` +
+				` -> [{"ContainerPort":80,"HostPort":30001,"Protocol":""},{"ContainerPort":443,"HostPort":8443,"Protocol":""},{"ContainerPort":8080,"HostPort":0,"Protocol":""}]`},
+		},
+		{
+			name: "other image",
+			desired: containers.Container{Name: "web", Image: "httpd",
+				Ports: []containers.Port{{ContainerPort: 80}, {ContainerPort: 443}}},
+			want: []string{`Image: "nginx" -> "httpd"`},
+		},
+	}
+	for _, tt := range tests {
+		a, b := containerKind{}.comparable(current, tt.desired)
+		got, err := changes(a, b)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if tt := tests[0]; tt.desired.Ports[0].HostPort != 0 {
+		t.Errorf("comparable changed the desired container")
+	}
+}
+
+func TestPodComparable(t *testing.T) {
+	current := pods.Pod{Name: "web", Image: "nginx", Count: 2,
+		Containers: []containers.Container{{Name: "web-0"}, {Name: "web-1"}}}
+	_, desired, err := podKind{}.decode(json.RawMessage(`{"Name": "web", "Image": "nginx", "Count": 2,
+		"Containers": [{"Name": "other"}], "Deleting": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := podKind{}.comparable(current, desired)
+	got, err2 := changes(a, b)
+	if err2 != nil || len(got) != 0 {
+		t.Errorf("got changes %q, %v, want none", got, err2)
+	}
+}
+
+func TestServiceComparable(t *testing.T) {
+	current := services.Service{Name: "web", Pod: "web",
+		Ports: []services.ServicePort{{Port: 29000, ContainerPort: 80}}}
+	tests := []struct {
+		name  string
+		ports []services.ServicePort
+		want  []string
+	}{
+		{
+			name:  "allocated port carried over",
+			ports: []services.ServicePort{{ContainerPort: 80}},
+		},
+		{
+			name:  "explicit port differs",
+			ports: []services.ServicePort{{Port: 29005, ContainerPort: 80}},
+			want:  []string{`Ports: [{"Port":29000,"ContainerPort":80,"Protocol":""}] -> [{"Port":29005,"ContainerPort":80,"Protocol":""}]`},
+		},
+	}
+	for _, tt := range tests {
+		_, desired, err := serviceKind{}.decode(mustMarshal(t, services.Service{Name: "web", Pod: "web", Ports: tt.ports}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, b := serviceKind{}.comparable(current, desired)
+		got, err2 := changes(a, b)
+		if err2 != nil {
+			t.Errorf("%s: %v", tt.name, err2)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -1,31 +1,69 @@
 package pods
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/dchest/uniuri"
 	"github.com/loqutus/rws/pkg/server/containers"
 	"github.com/loqutus/rws/pkg/server/etcd"
 	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/images"
+	"github.com/loqutus/rws/pkg/server/quotas"
 	"github.com/loqutus/rws/pkg/server/utils"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type Pod struct {
-	Name       string
-	Image      string
-	Count      uint64
-	Cores      uint64
-	Memory     uint64
-	Disk       uint64
-	Cmd        []string
-	Containers []containers.Container
+	Name          string
+	Image         string
+	Count         uint64
+	Cores         uint64
+	Memory        uint64
+	Disk          uint64
+	Cmd           []string
+	Containers    []containers.Container
+	Namespace     string
+	Owner         string
+	CoresLimit    uint64
+	MemoryLimit   uint64
+	DiskLimit     uint64
+	Ports         []containers.Port
+	Env           map[string]string
+	Secrets       []containers.SecretRef
+	Volumes       []containers.Volume
+	Liveness      *containers.Probe
+	Readiness     *containers.Probe
+	RestartPolicy containers.RestartPolicy
+	StopSignal    string
+	StopTimeout   uint64
+	Lifecycle     *containers.Lifecycle
+	// ImagePullPolicy and RegistryCredential apply to every container.
+	ImagePullPolicy    string
+	RegistryCredential string
+	// ContainerSpecs replaces Image and the other container fields above
+	// with several containers that run together as one replica, the
+	// requests of a replica are the sum of theirs.
+	ContainerSpecs []containers.Container
+	// InitContainers run to completion one after another on the chosen
+	// host before the containers of a replica start.
+	InitContainers []containers.Container
+	// Status is filled in by pod_list from /rws/podstatus, it isn't
+	// stored in the pod record.
+	Status *PodStatus
+	// Deleting is set by pod_remove until all containers are removed.
+	Deleting bool
+	// DNSPolicy of the container of single-container pods.
+	DNSPolicy string
+	// Labels are selected by services.
+	Labels map[string]string
 }
 
 func GetHostPods(host string) ([]Pod, error) {
@@ -80,24 +118,64 @@ func PodAddHandler(w http.ResponseWriter, r *http.Request) {
 		utils.Fail("PodAddHandler: pod already exists", errors.New("pod already exists"), w)
 		return
 	}
+	err = p.validate()
+	if err != nil {
+		utils.Fail("PodAddHandler: bad pod", err, w)
+		return
+	}
+	p.Status = nil
+	p.Deleting = false
+	cores, memory, disk := p.requests()
+	specs := p.containerSpecs()
+	requested := quotas.Usage{
+		Cores:      cores * p.Count,
+		Memory:     memory * p.Count,
+		Disk:       disk * p.Count,
+		Containers: uint64(len(specs)+len(p.InitContainers)) * p.Count,
+	}
+	for _, c := range append(specs, p.InitContainers...) {
+		if err == nil {
+			err = quotas.CheckContainer(p.Namespace, p.Owner, c.Cores, c.Memory, c.Disk)
+		}
+	}
+	if err == nil {
+		err = quotas.Check(p.Namespace, p.Owner, requested)
+	}
+	if err != nil {
+		utils.Forbidden("PodAddHandler: quota check failed", err, w)
+		return
+	}
+	// the pod record has to exist before its containers, otherwise the
+	// garbage collector takes them for orphans
+	podBytes, err := json.Marshal(p)
+	if err == nil {
+		err = etcd.CreateKey("/rws/pods/"+p.Name, string(podBytes))
+	}
+	if err != nil {
+		utils.Fail("PodAddHandler: etcd.CreateKey error", err, w)
+		return
+	}
 	hostsDir, err := etcd.ListDir("/rws/hosts/")
 	if err != nil {
 		utils.Fail("PodAddHandler: Etcd.ListDir error", err, w)
 		return
 	}
-	var i uint64
-	for _, h := range hostsDir {
-		if i >= p.Count {
-			break
-		}
-		hostString, err := etcd.GetKey(h.Key)
-		if err != nil {
-			utils.Fail("PodAddHandler: etcdctl.GetKey error", err, w)
-		}
+	var hostsSlice []hosts.Host
+	for _, node := range hostsDir {
 		var h hosts.Host
-		err = json.Unmarshal([]byte(hostString), &h)
+		err = json.Unmarshal([]byte(node.Value), &h)
 		if err != nil {
 			utils.Fail("PodAddHandler: json.Unmarshal error", err, w)
+			return
+		}
+		hostsSlice = append(hostsSlice, h)
+	}
+	// hosts that already have the images skip the slow pull
+	hostsSlice = images.Prefer(hostsSlice, p.Images())
+	var i uint64
+	for _, h := range hostsSlice {
+		if i >= p.Count {
+			break
 		}
 		url := fmt.Sprintf("http://" + h.Name + ":" + strconv.FormatUint(h.Port, 10) + "/host_info")
 		resp, err := http.Get(url)
@@ -117,40 +195,17 @@ func PodAddHandler(w http.ResponseWriter, r *http.Request) {
 			utils.Fail("PodAddHandler: json.Unmarshal error", err3, w)
 			continue
 		}
-		if ThatHost.Disk >= p.Disk &&
-			ThatHost.Cores >= p.Cores &&
-			ThatHost.Memory >= p.Memory {
-			url := "http://" + h.Name + ":" + strconv.FormatUint(h.Port, 10) + "/container_run"
-			s := uniuri.New()
-			pName := p.Name + "_" + s
-			c := containers.Container{p.Image, pName, p.Disk, p.Memory, p.Cores, h.Name, "", p.Cmd}
-			b, err2 := json.Marshal(c)
-			if err2 != nil {
-				log.Println("PodAddHandler: json.Marshal error")
-				log.Println(err2)
-				continue
-			}
-			buf := bytes.NewBuffer(b)
-			resp, err1 := http.Post(url, "application/json", buf)
+		if ThatHost.Disk >= disk &&
+			ThatHost.Cores >= cores &&
+			ThatHost.Memory >= memory {
+			// all containers of a replica run on this host
+			replica, err1 := RunReplica(h, p)
 			if err1 != nil {
-				log.Println("PodAddHandler: http.Post error")
+				log.Println("PodAddHandler: RunReplica error")
 				log.Println(err1)
 				continue
 			}
-			if resp.StatusCode != 200 {
-				log.Println("PodAddHandler: request status code error")
-				log.Println(resp.StatusCode)
-				log.Println(resp)
-				continue
-			}
-			body, err2 := ioutil.ReadAll(resp.Body)
-			if err2 != nil {
-				log.Println("PodAddHandler: response read error")
-				log.Println(err2)
-				continue
-			}
-			c.ID = string(body)
-			p.Containers = append(p.Containers, c)
+			p.Containers = append(p.Containers, replica...)
 			i += 1
 		}
 	}
@@ -158,90 +213,27 @@ func PodAddHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		utils.Fail("PodAddHandler: json.Marshal error", err, w)
 	}
-	err7 := etcd.CreateKey("/rws/pods/"+p.Name, string(s))
+	err7 := etcd.SetKey("/rws/pods/"+p.Name, string(s))
 	if err7 != nil {
 		utils.Fail("PodAddHandler: etcd.SetKey error", err7, w)
 	}
+	err8 := UpdateStatus(p.Name)
+	if err8 != nil {
+		log.Println("PodAddHandler: UpdateStatus error")
+		log.Println(err8)
+	}
 	log.Println("PodAddHandler: all pod containers running")
 	w.Write([]byte("OK"))
 	return
 }
 
-func PodStopHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("PodStopHandler")
-	bodyBytes, err2 := ioutil.ReadAll(r.Body)
-	if err2 != nil {
-		utils.Fail("PodAdHandler: response read error", err2, w)
-		return
-	}
-	var p Pod
-	err := json.Unmarshal(bodyBytes, &p)
-	if err != nil {
-		utils.Fail("PodAddHandler: json.Unmarshal error", err, w)
-		return
-	}
-	dir, err2 := etcd.ListDir("/rws/hosts")
-	if err2 != nil {
-		utils.Fail("PodStopHandler: Etcd.ListDir error", err2, w)
-		return
-	}
-	for _, c := range p.Containers {
-		for _, host := range dir {
-			url := "http://" + host.Key + "/container_list"
-			body, err := http.Get(url)
-			if err != nil {
-				log.Println("get error")
-				log.Println(body)
-				continue
-			}
-			if body.StatusCode != 200 {
-				log.Println("status code error")
-				log.Println(body.StatusCode)
-				continue
-			}
-			b, err2 := ioutil.ReadAll(body.Body)
-			if err2 != nil {
-				log.Println("response read error")
-				log.Println(err2)
-			}
-			var RemoteContainers []containers.Container
-			err3 := json.Unmarshal(b, &RemoteContainers)
-			if err != nil {
-				log.Println("json unmarshal error")
-				log.Println(err3)
-				continue
-			}
-			for _, RemoteContainer := range RemoteContainers {
-				if RemoteContainer.Name == c.ID {
-					b := new(bytes.Buffer)
-					json.NewEncoder(b).Encode(c)
-					url := "http://" + host.Key + "/container_stop"
-					resp, err1 := http.Post(url, "application/json", b)
-					if err1 != nil {
-						log.Println("request error")
-						log.Println(err1)
-						continue
-					}
-					if resp.StatusCode != 200 {
-						log.Println("request status code error")
-						log.Println(resp.StatusCode)
-						log.Println(resp)
-						continue
-					}
-					_, err2 := ioutil.ReadAll(resp.Body)
-					if err2 != nil {
-						log.Println("response read error")
-						log.Println(err2)
-						continue
-					}
-				}
-			}
-		}
-	}
-	return
+func ListPods() (string, error) {
+	return ListPodsFiltered("", "")
 }
 
-func ListPods() (string, error) {
+// ListPodsFiltered lists the pods with their status, limited to a phase
+// and a namespace unless they are empty.
+func ListPodsFiltered(phase, namespace string) (string, error) {
 	log.Println("ListPods")
 	pods, err := etcd.ListDir("/rws/pods")
 	if err != nil {
@@ -256,6 +248,13 @@ func ListPods() (string, error) {
 			log.Println("ListPods: json.Unmarshal error")
 			return "", err
 		}
+		x.Status = getStatus(x.Name)
+		if phase != "" && (x.Status == nil || !strings.EqualFold(x.Status.Phase, phase)) {
+			continue
+		}
+		if namespace != "" && x.Namespace != namespace {
+			continue
+		}
 		l = append(l, x)
 	}
 	if len(l) < 0 {
@@ -268,28 +267,118 @@ func ListPods() (string, error) {
 	return string(sm), nil
 }
 
-func PodListHandler(w http.ResponseWriter, _ *http.Request) {
+// PodListHandler lists the pods, the phase of the Status and the
+// Namespace of a pod in the body filter them.
+func PodListHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("PodListHandler")
-	s, err := ListPods()
+	var filter Pod
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err == nil && len(bytes.TrimSpace(bodyBytes)) > 0 {
+		err = json.Unmarshal(bodyBytes, &filter)
+	}
+	if err != nil {
+		utils.Fail("PodListHandler: bad filter", err, w)
+		return
+	}
+	phase := ""
+	if filter.Status != nil {
+		phase = filter.Status.Phase
+	}
+	s, err := ListPodsFiltered(phase, filter.Namespace)
 	if err != nil {
 		utils.Fail("PodsList error", err, w)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(s))
 	return
 }
 
-func PodRemoveHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("pod remove")
-	var p Pod
-	err := json.NewDecoder(r.Body).Decode(&p)
+// containerNames returns the names of the pod's containers, init
+// containers first and including those of replicas that failed to start.
+func (p Pod) containerNames() []string {
+	seen := make(map[string]bool)
+	var initNames, names []string
+	dir, err := etcd.ListDir("/rws/containers")
+	if err != nil {
+		log.Println("containerNames: etcd.ListDir error")
+		log.Println(err)
+	}
+	for _, node := range dir {
+		var c containers.Container
+		if json.Unmarshal([]byte(node.Value), &c) != nil || c.Pod != p.Name {
+			continue
+		}
+		seen[c.Name] = true
+		if c.Init {
+			initNames = append(initNames, c.Name)
+		} else {
+			names = append(names, c.Name)
+		}
+	}
+	for _, c := range p.Containers {
+		if !seen[c.Name] {
+			names = append(names, c.Name)
+		}
+	}
+	return append(initNames, names...)
+}
+
+// PodLogsHandler merges the logs of all pod containers, every line is
+// prefixed with the container name.
+func PodLogsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("PodLogsHandler")
+	var req containers.LogsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		utils.Fail("PodLogsHandler: json decode error", err, w)
 		return
 	}
-	err2 := etcd.DeleteKey("/rws/pods/" + p.Name)
+	podString, err2 := etcd.GetKey("/rws/pods/" + req.Name)
 	if err2 != nil {
-		utils.Fail("etcd.DeleteKey error", err2, w)
+		utils.Fail("PodLogsHandler: pod not found", err2, w)
+		return
 	}
-	return
+	var p Pod
+	err3 := json.Unmarshal([]byte(podString), &p)
+	if err3 != nil {
+		utils.Fail("PodLogsHandler: json.Unmarshal error", err3, w)
+		return
+	}
+	var streams []io.ReadCloser
+	var names []string
+	for _, name := range p.containerNames() {
+		containerReq := req
+		containerReq.Name = name
+		logs, err := containers.OpenLogs(r.Context(), containerReq)
+		if err != nil {
+			log.Println("PodLogsHandler: OpenLogs error for " + name)
+			log.Println(err)
+			continue
+		}
+		streams = append(streams, logs)
+		names = append(names, name)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	out := containers.FlushWriter{W: w}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := range streams {
+		wg.Add(1)
+		go func(logs io.ReadCloser, name string) {
+			defer wg.Done()
+			defer logs.Close()
+			scanner := bufio.NewScanner(logs)
+			for scanner.Scan() {
+				mu.Lock()
+				_, err := out.Write([]byte("[" + name + "] " + scanner.Text() + "\n"))
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}(streams[i], names[i])
+	}
+	wg.Wait()
 }
@@ -0,0 +1,256 @@
+package pods
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/dchest/uniuri"
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Replica is one copy of a pod. Its containers run on the same host,
+// the first one owns the network namespace the others join.
+type Replica struct {
+	Name           string
+	Pod            string
+	InitContainers []containers.Container
+	Containers     []containers.Container
+}
+
+// containerSpecs returns the containers of one replica: ContainerSpecs,
+// or for single container pods a container built from the pod fields.
+func (p Pod) containerSpecs() []containers.Container {
+	if len(p.ContainerSpecs) > 0 {
+		return p.ContainerSpecs
+	}
+	return []containers.Container{{
+		Image:              p.Image,
+		Disk:               p.Disk,
+		Memory:             p.Memory,
+		Cores:              p.Cores,
+		Cmd:                p.Cmd,
+		CoresLimit:         p.CoresLimit,
+		MemoryLimit:        p.MemoryLimit,
+		DiskLimit:          p.DiskLimit,
+		Ports:              p.Ports,
+		Env:                p.Env,
+		Secrets:            p.Secrets,
+		Volumes:            p.Volumes,
+		Liveness:           p.Liveness,
+		Readiness:          p.Readiness,
+		RestartPolicy:      p.RestartPolicy,
+		StopSignal:         p.StopSignal,
+		StopTimeout:        p.StopTimeout,
+		Lifecycle:          p.Lifecycle,
+		ImagePullPolicy:    p.ImagePullPolicy,
+		RegistryCredential: p.RegistryCredential,
+		DNSPolicy:          p.DNSPolicy,
+	}}
+}
+
+// Images returns the images of the init containers and containers of
+// one replica.
+func (p Pod) Images() []string {
+	var l []string
+	for _, c := range p.InitContainers {
+		l = append(l, c.Image)
+	}
+	for _, c := range p.containerSpecs() {
+		l = append(l, c.Image)
+	}
+	return l
+}
+
+// requests sums the resource requests of the containers of one replica,
+// or takes those of the largest init container if they are higher.
+func (p Pod) requests() (cores, memory, disk uint64) {
+	return replicaRequests(p.InitContainers, p.containerSpecs())
+}
+
+func replicaRequests(initContainers, conts []containers.Container) (cores, memory, disk uint64) {
+	for _, c := range conts {
+		cores += c.Cores
+		memory += c.Memory
+		disk += c.Disk
+	}
+	for _, c := range initContainers {
+		if c.Cores > cores {
+			cores = c.Cores
+		}
+		if c.Memory > memory {
+			memory = c.Memory
+		}
+		if c.Disk > disk {
+			disk = c.Disk
+		}
+	}
+	return cores, memory, disk
+}
+
+func (p Pod) validate() error {
+	names := make(map[string]bool)
+	for i, c := range p.ContainerSpecs {
+		if c.Name == "" || c.Image == "" {
+			return errors.New("pod containers need a Name and an Image")
+		}
+		if names[c.Name] {
+			return errors.New("pod container name " + c.Name + " is used twice")
+		}
+		names[c.Name] = true
+		if i > 0 && len(c.Ports) > 0 {
+			return errors.New("only the first pod container can publish ports, " + c.Name + " shares its network")
+		}
+	}
+	for _, c := range p.InitContainers {
+		if c.Name == "" || c.Image == "" {
+			return errors.New("init containers need a Name and an Image")
+		}
+		if names[c.Name] {
+			return errors.New("pod container name " + c.Name + " is used twice")
+		}
+		names[c.Name] = true
+		if len(c.Ports) > 0 {
+			return errors.New("init container " + c.Name + " can't publish ports")
+		}
+	}
+	if len(p.ContainerSpecs) == 0 && p.Image == "" {
+		return errors.New("pod needs an Image or ContainerSpecs")
+	}
+	return nil
+}
+
+// newReplica names the containers of a new replica and fills in the
+// fields they take from the pod.
+func (p Pod) newReplica() Replica {
+	r := Replica{Name: p.Name + "_" + uniuri.New(), Pod: p.Name}
+	for _, c := range p.InitContainers {
+		c.Name = r.Name + "_" + c.Name
+		c.Pod = p.Name
+		c.Replica = r.Name
+		c.Namespace = p.Namespace
+		c.Owner = p.Owner
+		r.InitContainers = append(r.InitContainers, c)
+	}
+	for i, c := range p.containerSpecs() {
+		if len(p.ContainerSpecs) == 0 {
+			c.Name = r.Name
+		} else {
+			c.Name = r.Name + "_" + c.Name
+		}
+		c.Pod = p.Name
+		c.Replica = r.Name
+		c.Namespace = p.Namespace
+		c.Owner = p.Owner
+		if i > 0 {
+			c.NetworkContainer = r.Containers[0].Name
+		}
+		r.Containers = append(r.Containers, c)
+	}
+	return r
+}
+
+// RunReplica runs a new replica of the pod on host h and returns the
+// records of its containers.
+func RunReplica(h hosts.Host, p Pod) ([]containers.Container, error) {
+	b, err := json.Marshal(p.newReplica())
+	if err != nil {
+		return nil, err
+	}
+	url := "http://" + h.Name + ":" + strconv.FormatUint(h.Port, 10) + "/pod_replica_run"
+	resp, err2 := http.Post(url, "application/json", bytes.NewBuffer(b))
+	if err2 != nil {
+		return nil, err2
+	}
+	defer resp.Body.Close()
+	body, err3 := ioutil.ReadAll(resp.Body)
+	if err3 != nil {
+		return nil, err3
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("pod_replica_run on " + h.Name + " returned " + strconv.Itoa(resp.StatusCode) + ": " + string(body))
+	}
+	var l []containers.Container
+	err4 := json.Unmarshal(body, &l)
+	return l, err4
+}
+
+// runReplica runs the init containers of the replica to completion and
+// then starts its containers in order. If one of them fails the ones
+// already started are removed again, exited init containers are kept
+// for their status and logs.
+func runReplica(r Replica) ([]containers.Container, error) {
+	var initialized []containers.Container
+	for _, c := range r.InitContainers {
+		record, err := containers.RunToCompletion(c)
+		if err != nil {
+			return nil, errors.New("init container " + c.Name + ": " + err.Error())
+		}
+		initialized = append(initialized, record)
+	}
+	var started []containers.Container
+	for _, c := range r.Containers {
+		_, err := containers.RunContainer(c)
+		var record containers.Container
+		if err == nil {
+			record, err = containers.GetContainer(c.Name)
+		}
+		if err != nil {
+			for i := len(started) - 1; i >= 0; i-- {
+				containers.StopContainer(started[i].Name)
+				containers.RemoveContainer(started[i].Name)
+			}
+			return nil, errors.New("container " + c.Name + ": " + err.Error())
+		}
+		started = append(started, record)
+	}
+	return append(initialized, started...), nil
+}
+
+func PodReplicaRunHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "PodReplicaRunHandler")
+	var rep Replica
+	err := json.NewDecoder(r.Body).Decode(&rep)
+	if err != nil {
+		utils.Fail("PodReplicaRunHandler: json decode error", err, w)
+		return
+	}
+	hostInfo, err2 := hosts.HostInfo()
+	if err2 != nil {
+		utils.Fail("PodReplicaRunHandler: HostInfo error", err2, w)
+		return
+	}
+	var thisHost hosts.Host
+	err3 := json.Unmarshal([]byte(hostInfo), &thisHost)
+	if err3 != nil {
+		utils.Fail("PodReplicaRunHandler: json.Unmarshal error", err3, w)
+		return
+	}
+	cores, memory, disk := replicaRequests(rep.InitContainers, rep.Containers)
+	if thisHost.Cores < cores || thisHost.Memory < memory || thisHost.Disk < disk {
+		utils.Fail("PodReplicaRunHandler: this host can't run this replica", errors.New("not enough resources for replica "+rep.Name), w)
+		return
+	}
+	l, err4 := runReplica(rep)
+	if err4 != nil {
+		utils.Fail("PodReplicaRunHandler: runReplica error", err4, w)
+		return
+	}
+	err6 := UpdateStatus(rep.Pod)
+	if err6 != nil {
+		log.Println("PodReplicaRunHandler: UpdateStatus error")
+		log.Println(err6)
+	}
+	b, err5 := json.Marshal(l)
+	if err5 != nil {
+		utils.Fail("PodReplicaRunHandler: json.Marshal error", err5, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,242 @@
+package pods
+
+import (
+	"encoding/json"
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Pod phases. A pod is Running when all its replicas run, Failed when
+// some of them can't start without help, Terminating while pod_remove
+// tears it down and Pending otherwise.
+const (
+	PhasePending     = "Pending"
+	PhaseRunning     = "Running"
+	PhaseFailed      = "Failed"
+	PhaseTerminating = "Terminating"
+)
+
+// Container states in ContainerStatus.
+const (
+	StateWaiting    = "waiting"
+	StateRunning    = "running"
+	StateTerminated = "terminated"
+)
+
+// Pod conditions.
+const (
+	ConditionScheduled   = "Scheduled"
+	ConditionInitialized = "Initialized"
+	ConditionReady       = "Ready"
+)
+
+// PodStatus is kept under /rws/podstatus/<pod> by the scheduler and the
+// agents, apart from the pod record so it never overwrites the spec.
+type PodStatus struct {
+	Phase      string
+	Desired    uint64
+	Running    uint64
+	Ready      uint64
+	Containers []ContainerStatus
+	Conditions []Condition
+	Updated    time.Time
+}
+
+type ContainerStatus struct {
+	Name         string
+	Replica      string
+	Host         string
+	Init         bool
+	State        string
+	Reason       string
+	Message      string
+	ExitCode     int
+	RestartCount uint64
+	Ready        bool
+}
+
+// Condition is a named aspect of the pod that is true or not, Since is
+// when Status last changed.
+type Condition struct {
+	Type    string
+	Status  bool
+	Reason  string
+	Message string
+	Since   time.Time
+}
+
+// containerStatus derives the state of a container from its record.
+func containerStatus(c containers.Container) ContainerStatus {
+	s := ContainerStatus{
+		Name:         c.Name,
+		Replica:      c.Replica,
+		Host:         c.Host,
+		Init:         c.Init,
+		ExitCode:     c.ExitCode,
+		RestartCount: c.RestartCount,
+		Ready:        c.Ready,
+	}
+	switch c.State {
+	case "running":
+		s.State = StateRunning
+		if !c.Ready {
+			s.Reason = "NotReady"
+		}
+	case "exited", "dead":
+		s.State = StateTerminated
+		switch {
+		case c.ShouldRestart():
+			s.State = StateWaiting
+			s.Reason = "CrashLoopBackOff"
+		case c.OOMKilled:
+			s.Reason = "OOMKilled"
+		case c.ExitCode == 0:
+			s.Reason = "Completed"
+		default:
+			s.Reason = "Error"
+		}
+	case "removed":
+		s.State = StateTerminated
+		s.Reason = "Removed"
+	case "failed":
+		s.State = StateWaiting
+		s.Reason = "ImagePullFailed"
+		s.Message = c.PullError
+	case "pulling":
+		s.State = StateWaiting
+		s.Reason = "Pulling"
+		s.Message = c.PullStatus
+	default:
+		s.State = StateWaiting
+		s.Reason = "Creating"
+	}
+	return s
+}
+
+// failed reports whether the container won't run or complete by itself.
+func (s ContainerStatus) failed() bool {
+	switch s.Reason {
+	case "ImagePullFailed", "Error", "OOMKilled", "Removed":
+		return s.State != StateRunning
+	}
+	return false
+}
+
+// status computes the status of the pod from its container records.
+// Conditions keep their Since from previous if they didn't change.
+func (p Pod) status(previous *PodStatus) (PodStatus, error) {
+	byReplica, names, err := p.replicas()
+	if err != nil {
+		return PodStatus{}, err
+	}
+	s := PodStatus{Desired: p.Count, Updated: time.Now()}
+	failed := false
+	initialized := true
+	for _, name := range names {
+		running, ready := true, true
+		for _, c := range byReplica[name] {
+			cs := containerStatus(c)
+			s.Containers = append(s.Containers, cs)
+			failed = failed || cs.failed()
+			if cs.Init {
+				if cs.Reason != "Completed" {
+					initialized = false
+				}
+				continue
+			}
+			running = running && cs.State == StateRunning
+			ready = ready && cs.Ready
+		}
+		if running {
+			s.Running++
+			if ready {
+				s.Ready++
+			}
+		}
+	}
+	switch {
+	case p.Deleting:
+		s.Phase = PhaseTerminating
+	case s.Desired > 0 && s.Running >= s.Desired:
+		s.Phase = PhaseRunning
+	case failed:
+		s.Phase = PhaseFailed
+	default:
+		s.Phase = PhasePending
+	}
+	placed := uint64(len(names))
+	counts := func(n uint64) string {
+		return strconv.FormatUint(n, 10) + " of " + strconv.FormatUint(s.Desired, 10) + " replicas"
+	}
+	s.Conditions = []Condition{
+		{Type: ConditionScheduled, Status: placed >= s.Desired, Message: counts(placed) + " placed"},
+		{Type: ConditionInitialized, Status: initialized},
+		{Type: ConditionReady, Status: s.Ready >= s.Desired, Message: counts(s.Ready) + " ready"},
+	}
+	if placed < s.Desired {
+		s.Conditions[0].Reason = "Unschedulable"
+	}
+	if !initialized {
+		s.Conditions[1].Reason = "InitContainersNotCompleted"
+	}
+	if s.Ready < s.Desired {
+		s.Conditions[2].Reason = "ReplicasNotReady"
+	}
+	for i := range s.Conditions {
+		s.Conditions[i].Since = s.Updated
+		if previous == nil {
+			continue
+		}
+		for _, old := range previous.Conditions {
+			if old.Type == s.Conditions[i].Type && old.Status == s.Conditions[i].Status {
+				s.Conditions[i].Since = old.Since
+			}
+		}
+	}
+	return s, nil
+}
+
+func getStatus(name string) *PodStatus {
+	statusString, err := etcd.GetKey("/rws/podstatus/" + name)
+	if err != nil {
+		return nil
+	}
+	var s PodStatus
+	if json.Unmarshal([]byte(statusString), &s) != nil {
+		return nil
+	}
+	return &s
+}
+
+// UpdateStatus recomputes the status of the pod and stores it.
+func UpdateStatus(name string) error {
+	p, err := GetPod(name)
+	if err != nil {
+		return err
+	}
+	s, err2 := p.status(getStatus(name))
+	if err2 != nil {
+		return err2
+	}
+	b, err3 := json.Marshal(s)
+	if err3 != nil {
+		return err3
+	}
+	return etcd.SetKey("/rws/podstatus/"+name, string(b))
+}
+
+// ContainerChanged updates the status of the pod of a container whose
+// state changed, agents call it from the container monitor.
+func ContainerChanged(c containers.Container) {
+	if c.Pod == "" {
+		return
+	}
+	err := UpdateStatus(c.Pod)
+	if err != nil {
+		log.Println("ContainerChanged: UpdateStatus error for pod " + c.Pod)
+		log.Println(err)
+	}
+}
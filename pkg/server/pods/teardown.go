@@ -0,0 +1,183 @@
+package pods
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type ContainerResult struct {
+	Name  string
+	Host  string
+	Error string
+}
+
+// TeardownResult is the answer of pod_stop and pod_remove. Done is false
+// if some containers are left, the scheduler retries them.
+type TeardownResult struct {
+	Pod        string
+	Containers []ContainerResult
+	Done       bool
+}
+
+// Err returns an error naming the containers that weren't torn down.
+func (r TeardownResult) Err() error {
+	failed := 0
+	for _, c := range r.Containers {
+		if c.Error != "" {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return errors.New(strconv.Itoa(failed) + " of " + strconv.Itoa(len(r.Containers)) + " containers of pod " + r.Pod + " are left")
+}
+
+// teardown stops and removes every container of the pod on every host.
+// Records of containers that are gone from the runtime are deleted.
+func (p Pod) teardown() (TeardownResult, error) {
+	r := TeardownResult{Pod: p.Name}
+	byReplica, names, err := p.replicas()
+	if err != nil {
+		return r, err
+	}
+	for _, name := range names {
+		for _, c := range byReplica[name] {
+			res := ContainerResult{Name: c.Name, Host: c.Host}
+			var err2 error
+			if c.State == "removed" {
+				err2 = etcd.DeleteKey("/rws/containers/" + c.Name)
+			} else {
+				err2 = containers.Delete(c.Name)
+			}
+			if err2 != nil {
+				log.Println("teardown: error for container " + c.Name)
+				log.Println(err2)
+				res.Error = err2.Error()
+			}
+			r.Containers = append(r.Containers, res)
+		}
+	}
+	r.Done = r.Err() == nil
+	return r, nil
+}
+
+// save stores the pod record without the containers that are gone.
+func (p Pod) save() error {
+	var left []containers.Container
+	for _, c := range p.Containers {
+		_, err := containers.GetContainer(c.Name)
+		if err == nil {
+			left = append(left, c)
+		}
+	}
+	p.Containers = left
+	p.Status = nil
+	b, err2 := json.Marshal(p)
+	if err2 != nil {
+		return err2
+	}
+	return etcd.SetKey("/rws/pods/"+p.Name, string(b))
+}
+
+// StopPod scales the pod to zero, its spec is kept and the containers of
+// all replicas are stopped and removed.
+func StopPod(name string) (TeardownResult, error) {
+	log.Println("StopPod")
+	p, err := GetPod(name)
+	if err != nil {
+		return TeardownResult{Pod: name}, err
+	}
+	p.Count = 0
+	err2 := p.save()
+	if err2 != nil {
+		return TeardownResult{Pod: name}, err2
+	}
+	r, err3 := p.teardown()
+	if err3 != nil {
+		return r, err3
+	}
+	err4 := p.save()
+	if err4 != nil {
+		return r, err4
+	}
+	return r, UpdateStatus(name)
+}
+
+// RemovePod marks the pod as Deleting, so the scheduler doesn't start
+// replicas, tears down its containers and deletes the record once none
+// are left.
+func RemovePod(name string) (TeardownResult, error) {
+	log.Println("RemovePod")
+	p, err := GetPod(name)
+	if err != nil {
+		return TeardownResult{Pod: name}, err
+	}
+	if !p.Deleting {
+		p.Deleting = true
+		err2 := p.save()
+		if err2 != nil {
+			return TeardownResult{Pod: name}, err2
+		}
+	}
+	r, err3 := p.teardown()
+	if err3 != nil {
+		return r, err3
+	}
+	if !r.Done {
+		err4 := p.save()
+		if err4 != nil {
+			return r, err4
+		}
+		return r, UpdateStatus(name)
+	}
+	err5 := etcd.DeleteKey("/rws/pods/" + name)
+	if err5 != nil {
+		return r, err5
+	}
+	err6 := etcd.DeleteKey("/rws/podstatus/" + name)
+	if err6 != nil {
+		log.Println("RemovePod: status delete error")
+		log.Println(err6)
+	}
+	return r, nil
+}
+
+func teardownHandler(w http.ResponseWriter, r *http.Request, teardown func(string) (TeardownResult, error)) {
+	var p Pod
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		utils.Fail("json decode error", err, w)
+		return
+	}
+	res, err2 := teardown(p.Name)
+	if err2 != nil {
+		utils.Fail("pod "+p.Name+" teardown error", err2, w)
+		return
+	}
+	b, err3 := json.Marshal(res)
+	if err3 != nil {
+		utils.Fail("json.Marshal error", err3, w)
+		return
+	}
+	w.Write(b)
+}
+
+// PodStopHandler stops all replicas of the pod and keeps its spec.
+func PodStopHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("PodStopHandler")
+	teardownHandler(w, r, StopPod)
+}
+
+// PodRemoveHandler removes the containers of the pod on every host and
+// then the pod.
+func PodRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("PodRemoveHandler")
+	teardownHandler(w, r, RemovePod)
+}
@@ -0,0 +1,144 @@
+package pods
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/quotas"
+	"log"
+	"sort"
+)
+
+func GetPod(name string) (Pod, error) {
+	podString, err := etcd.GetKey("/rws/pods/" + name)
+	if err != nil {
+		return Pod{}, errors.New("pod " + name + " not found")
+	}
+	var p Pod
+	err2 := json.Unmarshal([]byte(podString), &p)
+	return p, err2
+}
+
+// replicaSpec is the pod without Count, Labels and the records of its
+// replicas, pods with equal replicaSpecs run the same replicas.
+func (p Pod) replicaSpec() Pod {
+	p.Count = 0
+	p.Labels = nil
+	p.Containers = nil
+	p.Status = nil
+	return p
+}
+
+// replicas returns the container records of the pod grouped by replica
+// and the replica names in order.
+func (p Pod) replicas() (map[string][]containers.Container, []string, error) {
+	dir, err := etcd.ListDir("/rws/containers")
+	if err != nil {
+		return nil, nil, err
+	}
+	byReplica := make(map[string][]containers.Container)
+	var names []string
+	for _, node := range dir {
+		var c containers.Container
+		if json.Unmarshal([]byte(node.Value), &c) != nil || c.Pod != p.Name {
+			continue
+		}
+		replica := c.Replica
+		if replica == "" {
+			replica = c.Name
+		}
+		if _, ok := byReplica[replica]; !ok {
+			names = append(names, replica)
+		}
+		byReplica[replica] = append(byReplica[replica], c)
+	}
+	sort.Strings(names)
+	return byReplica, names, nil
+}
+
+// UpdatePod replaces the spec of an existing pod. If the replica spec
+// changed all replicas are removed, otherwise only those above Count;
+// the scheduler starts the missing ones from the new spec.
+func UpdatePod(p Pod) error {
+	log.Println("UpdatePod")
+	current, err := GetPod(p.Name)
+	if err != nil {
+		return err
+	}
+	if current.Deleting {
+		return errors.New("pod " + p.Name + " is being deleted")
+	}
+	p.Deleting = false
+	err2 := p.validate()
+	if err2 != nil {
+		return err2
+	}
+	for _, c := range append(p.containerSpecs(), p.InitContainers...) {
+		err3 := quotas.CheckContainer(p.Namespace, p.Owner, c.Cores, c.Memory, c.Disk)
+		if err3 != nil {
+			return err3
+		}
+	}
+	if p.Count > current.Count {
+		cores, memory, disk := p.requests()
+		extra := p.Count - current.Count
+		requested := quotas.Usage{
+			Cores:      cores * extra,
+			Memory:     memory * extra,
+			Disk:       disk * extra,
+			Containers: uint64(len(p.containerSpecs())+len(p.InitContainers)) * extra,
+		}
+		err4 := quotas.Check(p.Namespace, p.Owner, requested)
+		if err4 != nil {
+			return err4
+		}
+	}
+	oldSpec, err5 := json.Marshal(current.replicaSpec())
+	if err5 != nil {
+		return err5
+	}
+	newSpec, err6 := json.Marshal(p.replicaSpec())
+	if err6 != nil {
+		return err6
+	}
+	changed := string(oldSpec) != string(newSpec)
+	p.Containers = nil
+	byReplica, names, err7 := current.replicas()
+	if err7 != nil {
+		return err7
+	}
+	removed := make(map[string]bool)
+	var kept uint64
+	for _, name := range names {
+		if !changed && kept < p.Count {
+			kept++
+			continue
+		}
+		log.Println("UpdatePod: removing replica " + name)
+		for _, c := range byReplica[name] {
+			err8 := containers.Delete(c.Name)
+			if err8 != nil {
+				log.Println("UpdatePod: Delete error for container " + c.Name)
+				log.Println(err8)
+				continue
+			}
+			removed[c.Name] = true
+		}
+	}
+	for _, c := range current.Containers {
+		if !removed[c.Name] {
+			p.Containers = append(p.Containers, c)
+		}
+	}
+	p.Status = nil
+	b, err9 := json.Marshal(p)
+	if err9 != nil {
+		return err9
+	}
+	err10 := etcd.SetKey("/rws/pods/"+p.Name, string(b))
+	if err10 != nil {
+		return err10
+	}
+	return UpdateStatus(p.Name)
+}
@@ -0,0 +1,335 @@
+package quotas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Quota caps the resources used by a namespace, an owner or both.
+// Max* fields are a limit range for a single container.
+// Zero limits are not enforced.
+type Quota struct {
+	Name       string
+	Namespace  string
+	Owner      string
+	Cores      uint64
+	Memory     uint64
+	Disk       uint64
+	Containers uint64
+	Storage    uint64
+	MaxCores   uint64
+	MaxMemory  uint64
+	MaxDisk    uint64
+}
+
+type Usage struct {
+	Cores      uint64
+	Memory     uint64
+	Disk       uint64
+	Containers uint64
+	Storage    uint64
+}
+
+type QuotaUsage struct {
+	Quota Quota
+	Used  Usage
+}
+
+// resources is the part of container and storage records counted against quotas.
+// It is decoded straight from etcd so this package doesn't depend on them.
+type resources struct {
+	Namespace string
+	Owner     string
+	Cores     uint64
+	Memory    uint64
+	Disk      uint64
+	Size      uint64
+	State     string
+}
+
+// live reports whether a container record holds resources. Failed,
+// exited and removed containers don't count against quotas, pulling
+// ones do since they are about to be created.
+func (r resources) live() bool {
+	switch r.State {
+	case "pulling", "creating", "running", "restarting", "paused":
+		return true
+	}
+	return false
+}
+
+func (q Quota) Matches(namespace, owner string) bool {
+	if q.Namespace == "" && q.Owner == "" {
+		return false
+	}
+	if q.Namespace != "" && q.Namespace != namespace {
+		return false
+	}
+	if q.Owner != "" && q.Owner != owner {
+		return false
+	}
+	return true
+}
+
+func AddQuota(q Quota) error {
+	log.Println(1, "AddQuota")
+	if q.Name == "" {
+		return errors.New("quota name required")
+	}
+	if q.Namespace == "" && q.Owner == "" {
+		return errors.New("quota namespace or owner required")
+	}
+	dir, err := etcd.ListDir("/rws/quotas")
+	if err != nil {
+		return err
+	}
+	for _, node := range dir {
+		keySplit := strings.Split(node.Key, "/")
+		keyName := keySplit[len(keySplit)-1]
+		if keyName == q.Name {
+			return errors.New("quota already exists")
+		}
+	}
+	b, err2 := json.Marshal(q)
+	if err2 != nil {
+		return err2
+	}
+	err3 := etcd.CreateKey("/rws/quotas/"+q.Name, string(b))
+	if err3 != nil {
+		log.Println(1, "AddQuota: etcd.CreateKey error")
+		return err3
+	}
+	log.Println(1, "AddQuota: quota "+q.Name+" added")
+	return nil
+}
+
+func RemoveQuota(name string) error {
+	log.Println(1, "RemoveQuota")
+	dir, err := etcd.ListDir("/rws/quotas")
+	if err != nil {
+		return err
+	}
+	for _, node := range dir {
+		keySplit := strings.Split(node.Key, "/")
+		keyName := keySplit[len(keySplit)-1]
+		if keyName == name {
+			return etcd.DeleteKey("/rws/quotas/" + name)
+		}
+	}
+	return errors.New("quota not found")
+}
+
+func ListQuotas() ([]Quota, error) {
+	log.Println(1, "ListQuotas")
+	dir, err := etcd.ListDir("/rws/quotas")
+	if err != nil {
+		log.Println(1, "ListQuotas: etcd.ListDir error")
+		return nil, err
+	}
+	var l []Quota
+	for _, node := range dir {
+		var q Quota
+		err := json.Unmarshal([]byte(node.Value), &q)
+		if err != nil {
+			log.Println(1, "ListQuotas: json.Unmarshal error")
+			return nil, err
+		}
+		l = append(l, q)
+	}
+	return l, nil
+}
+
+func listResources(dirName string) ([]resources, error) {
+	dir, err := etcd.ListDir(dirName)
+	if err != nil {
+		return nil, err
+	}
+	var l []resources
+	for _, node := range dir {
+		var r resources
+		err := json.Unmarshal([]byte(node.Value), &r)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, r)
+	}
+	return l, nil
+}
+
+// GetUsage sums the live containers and storage files accounted to the
+// quota.
+func GetUsage(q Quota) (Usage, error) {
+	var u Usage
+	conts, err := listResources("/rws/containers")
+	if err != nil {
+		log.Println(1, "GetUsage: containers list error")
+		return u, err
+	}
+	for _, c := range conts {
+		if q.Matches(c.Namespace, c.Owner) && c.live() {
+			u.Cores += c.Cores
+			u.Memory += c.Memory
+			u.Disk += c.Disk
+			u.Containers += 1
+		}
+	}
+	files, err2 := listResources("/rws/storage")
+	if err2 != nil {
+		log.Println(1, "GetUsage: storage list error")
+		return u, err2
+	}
+	for _, f := range files {
+		if q.Matches(f.Namespace, f.Owner) {
+			u.Storage += f.Size
+		}
+	}
+	return u, nil
+}
+
+func exceeded(resource string, used, requested, limit uint64) error {
+	if limit == 0 || used+requested <= limit {
+		return nil
+	}
+	return fmt.Errorf("%s: used %d, requested %d, limit %d", resource, used, requested, limit)
+}
+
+// Check returns an error if adding requested to the current usage
+// would exceed any quota that applies to namespace and owner.
+func Check(namespace, owner string, requested Usage) error {
+	l, err := ListQuotas()
+	if err != nil {
+		return err
+	}
+	for _, q := range l {
+		if !q.Matches(namespace, owner) {
+			continue
+		}
+		u, err := GetUsage(q)
+		if err != nil {
+			return err
+		}
+		for _, e := range []error{
+			exceeded("cores", u.Cores, requested.Cores, q.Cores),
+			exceeded("memory", u.Memory, requested.Memory, q.Memory),
+			exceeded("disk", u.Disk, requested.Disk, q.Disk),
+			exceeded("containers", u.Containers, requested.Containers, q.Containers),
+			exceeded("storage", u.Storage, requested.Storage, q.Storage),
+		} {
+			if e != nil {
+				return errors.New("quota " + q.Name + " exceeded: " + e.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// CheckContainer returns an error if a single container asks for more
+// than the limit range of any quota that applies to namespace and owner.
+func CheckContainer(namespace, owner string, cores, memory, disk uint64) error {
+	l, err := ListQuotas()
+	if err != nil {
+		return err
+	}
+	for _, q := range l {
+		if !q.Matches(namespace, owner) {
+			continue
+		}
+		for _, e := range []error{
+			exceeded("container cores", 0, cores, q.MaxCores),
+			exceeded("container memory", 0, memory, q.MaxMemory),
+			exceeded("container disk", 0, disk, q.MaxDisk),
+		} {
+			if e != nil {
+				return errors.New("quota " + q.Name + " limit range exceeded: " + e.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func QuotaAddHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "QuotaAddHandler")
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		utils.Fail("QuotaAddHandler: request read error", err, w)
+		return
+	}
+	var q Quota
+	err2 := json.Unmarshal(bodyBytes, &q)
+	if err2 != nil {
+		utils.Fail("QuotaAddHandler: json.Unmarshal error", err2, w)
+		return
+	}
+	err3 := AddQuota(q)
+	if err3 != nil {
+		utils.Fail("QuotaAddHandler: AddQuota error", err3, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func QuotaRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "QuotaRemoveHandler")
+	var q Quota
+	err := json.NewDecoder(r.Body).Decode(&q)
+	if err != nil {
+		utils.Fail("QuotaRemoveHandler: json decode error", err, w)
+		return
+	}
+	err2 := RemoveQuota(q.Name)
+	if err2 != nil {
+		utils.Fail("QuotaRemoveHandler: RemoveQuota error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func QuotaListHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println(1, "QuotaListHandler")
+	l, err := ListQuotas()
+	if err != nil {
+		utils.Fail("QuotaListHandler: ListQuotas error", err, w)
+		return
+	}
+	b, err2 := json.Marshal(l)
+	if err2 != nil {
+		utils.Fail("QuotaListHandler: json.Marshal error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func QuotaUsageHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println(1, "QuotaUsageHandler")
+	l, err := ListQuotas()
+	if err != nil {
+		utils.Fail("QuotaUsageHandler: ListQuotas error", err, w)
+		return
+	}
+	var result []QuotaUsage
+	for _, q := range l {
+		u, err := GetUsage(q)
+		if err != nil {
+			utils.Fail("QuotaUsageHandler: GetUsage error", err, w)
+			return
+		}
+		result = append(result, QuotaUsage{q, u})
+	}
+	b, err2 := json.Marshal(result)
+	if err2 != nil {
+		utils.Fail("QuotaUsageHandler: json.Marshal error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
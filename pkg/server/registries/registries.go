@@ -0,0 +1,176 @@
+package registries
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/runtimes"
+	"github.com/loqutus/rws/pkg/server/secrets"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Registry is a named credential for a private image registry, containers
+// reference it by name. The password is stored sealed with the secret key
+// and never returned by the list endpoint.
+type Registry struct {
+	Name      string
+	Namespace string
+	Server    string
+	Username  string
+	Password  string
+}
+
+// record is the etcd representation of a Registry.
+type record struct {
+	Name      string
+	Namespace string
+	Server    string
+	Username  string
+	Password  []byte
+}
+
+func AddRegistry(reg Registry) error {
+	log.Println(1, "AddRegistry")
+	if reg.Name == "" {
+		return errors.New("registry name required")
+	}
+	if reg.Server == "" || reg.Username == "" {
+		return errors.New("registry server and username required")
+	}
+	sealed, err := secrets.Seal("registry/"+reg.Name, []byte(reg.Password))
+	if err != nil {
+		log.Println(1, "AddRegistry: secrets.Seal error")
+		return err
+	}
+	r := record{Name: reg.Name, Namespace: reg.Namespace, Server: reg.Server, Username: reg.Username, Password: sealed}
+	b, err2 := json.Marshal(r)
+	if err2 != nil {
+		return err2
+	}
+	err3 := etcd.CreateKey("/rws/registries/"+reg.Name, string(b))
+	if err3 != nil {
+		log.Println(1, "AddRegistry: etcd.CreateKey error")
+		return err3
+	}
+	log.Println(1, "AddRegistry: registry "+reg.Name+" added")
+	return nil
+}
+
+func RemoveRegistry(name string) error {
+	log.Println(1, "RemoveRegistry")
+	dir, err := etcd.ListDir("/rws/registries")
+	if err != nil {
+		return err
+	}
+	for _, node := range dir {
+		keySplit := strings.Split(node.Key, "/")
+		keyName := keySplit[len(keySplit)-1]
+		if keyName == name {
+			return etcd.DeleteKey("/rws/registries/" + name)
+		}
+	}
+	return errors.New("registry not found")
+}
+
+// ListRegistries returns the registries without passwords.
+func ListRegistries() ([]Registry, error) {
+	log.Println(1, "ListRegistries")
+	dir, err := etcd.ListDir("/rws/registries")
+	if err != nil {
+		log.Println(1, "ListRegistries: etcd.ListDir error")
+		return nil, err
+	}
+	var l []Registry
+	for _, node := range dir {
+		var r record
+		err := json.Unmarshal([]byte(node.Value), &r)
+		if err != nil {
+			log.Println(1, "ListRegistries: json.Unmarshal error")
+			return nil, err
+		}
+		l = append(l, Registry{Name: r.Name, Namespace: r.Namespace, Server: r.Server, Username: r.Username})
+	}
+	return l, nil
+}
+
+// Auth returns the decrypted credential for pulling images into a
+// container in namespace. It must not be exposed by any handler.
+func Auth(name, namespace string) (*runtimes.RegistryAuth, error) {
+	recordString, err := etcd.GetKey("/rws/registries/" + name)
+	if err != nil {
+		return nil, errors.New("registry " + name + " not found")
+	}
+	var r record
+	err2 := json.Unmarshal([]byte(recordString), &r)
+	if err2 != nil {
+		return nil, err2
+	}
+	if r.Namespace != "" && r.Namespace != namespace {
+		return nil, errors.New("registry " + name + " belongs to namespace " + r.Namespace)
+	}
+	password, err3 := secrets.Open("registry/"+r.Name, r.Password)
+	if err3 != nil {
+		log.Println(1, "Auth: secrets.Open error")
+		return nil, err3
+	}
+	return &runtimes.RegistryAuth{Server: r.Server, Username: r.Username, Password: string(password)}, nil
+}
+
+func RegistryAddHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "RegistryAddHandler")
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		utils.Fail("RegistryAddHandler: request read error", err, w)
+		return
+	}
+	var reg Registry
+	err2 := json.Unmarshal(bodyBytes, &reg)
+	if err2 != nil {
+		utils.Fail("RegistryAddHandler: json.Unmarshal error", err2, w)
+		return
+	}
+	err3 := AddRegistry(reg)
+	if err3 != nil {
+		utils.Fail("RegistryAddHandler: AddRegistry error", err3, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func RegistryRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "RegistryRemoveHandler")
+	var reg Registry
+	err := json.NewDecoder(r.Body).Decode(&reg)
+	if err != nil {
+		utils.Fail("RegistryRemoveHandler: json decode error", err, w)
+		return
+	}
+	err2 := RemoveRegistry(reg.Name)
+	if err2 != nil {
+		utils.Fail("RegistryRemoveHandler: RemoveRegistry error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func RegistryListHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println(1, "RegistryListHandler")
+	l, err := ListRegistries()
+	if err != nil {
+		utils.Fail("RegistryListHandler: ListRegistries error", err, w)
+		return
+	}
+	b, err2 := json.Marshal(l)
+	if err2 != nil {
+		utils.Fail("RegistryListHandler: json.Marshal error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,131 @@
+package runtimes
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// securePath joins name to root and makes sure no existing element of
+// the result below root is a symlink, which could point out of root when
+// root is the filesystem of a container.
+func securePath(root, name string) (string, error) {
+	clean := path.Clean("/" + name)
+	p := root
+	for _, elem := range strings.Split(clean, "/") {
+		if elem == "" {
+			continue
+		}
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", errors.New(clean + " goes through a symlink")
+		}
+	}
+	return filepath.Join(root, clean), nil
+}
+
+// tarPath writes name, a file or a directory tree below root, to w as a
+// tar archive. Entries are named relative to the parent of name, like
+// docker cp does.
+func tarPath(root, name string, w io.Writer) error {
+	src, err := securePath(root, name)
+	if err != nil {
+		return err
+	}
+	base := filepath.Dir(src)
+	tw := tar.NewWriter(w)
+	err2 := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err2 := tar.FileInfoHeader(fi, link)
+		if err2 != nil {
+			return err2
+		}
+		rel, err3 := filepath.Rel(base, p)
+		if err3 != nil {
+			return err3
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		err4 := tw.WriteHeader(hdr)
+		if err4 != nil {
+			return err4
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err5 := os.Open(p)
+		if err5 != nil {
+			return err5
+		}
+		defer f.Close()
+		_, err6 := io.Copy(tw, f)
+		return err6
+	})
+	if err2 != nil {
+		return err2
+	}
+	return tw.Close()
+}
+
+// untar extracts the tar archive r into dir below root, creating missing
+// parent directories. Only directories, regular files and symlinks are
+// created.
+func untar(root, dir string, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		dst, err2 := securePath(root, path.Join(dir, hdr.Name))
+		if err2 != nil {
+			return err2
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		err2 = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err2 != nil {
+			return err2
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err2 = os.MkdirAll(dst, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			var f *os.File
+			f, err2 = os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err2 == nil {
+				_, err2 = io.Copy(f, tr)
+				f.Close()
+			}
+		case tar.TypeSymlink:
+			os.Remove(dst)
+			err2 = os.Symlink(hdr.Linkname, dst)
+		default:
+			continue
+		}
+		if err2 != nil {
+			return err2
+		}
+	}
+}
@@ -0,0 +1,754 @@
+package runtimes
+
+import (
+	"bufio"
+	"errors"
+	"github.com/containerd/cgroups/v3/cgroup1/stats"
+	statsv2 "github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/containerd/containerd"
+	apievents "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	remotesdocker "github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/typeurl/v2"
+	"github.com/dchest/uniuri"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/net/context"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Containerd drives containerd directly. Container IDs are the rws
+// container names, and task output goes to a log file per container.
+type Containerd struct {
+	once sync.Once
+	cli  *containerd.Client
+	err  error
+}
+
+const containerdStopTimeout = 10 * time.Second
+
+// stopTimeoutLabel keeps the container's grace period in seconds for Stop.
+const stopTimeoutLabel = "rws.stop-timeout"
+
+// cfsPeriod is the CFS scheduler period in microseconds used for CPU limits.
+const cfsPeriod = 100000
+
+func NewContainerd() *Containerd {
+	return &Containerd{}
+}
+
+func (c *Containerd) client(ctx context.Context) (*containerd.Client, context.Context, error) {
+	c.once.Do(func() {
+		c.cli, c.err = containerd.New(conf.ContainerdAddress)
+		if c.err != nil {
+			log.Println(1, "Containerd: client create error")
+			log.Println(1, c.err)
+		}
+	})
+	return c.cli, namespaces.WithNamespace(ctx, conf.ContainerdNamespace), c.err
+}
+
+func containerdLogPath(id string) string {
+	return conf.DataDir + "/" + conf.StateDir + "/logs/" + id + ".log"
+}
+
+func notFound(err error) error {
+	if errdefs.IsNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (c *Containerd) Pull(ctx context.Context, image string, opts PullOptions) error {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+	ref, err2 := NormalizeImage(image)
+	if err2 != nil {
+		return err2
+	}
+	pullOpts := []containerd.RemoteOpt{containerd.WithPullUnpack}
+	if opts.Auth != nil {
+		auth := *opts.Auth
+		authorizer := remotesdocker.NewDockerAuthorizer(remotesdocker.WithAuthCreds(func(host string) (string, string, error) {
+			if auth.Server != "" && auth.Server != host {
+				return "", "", nil
+			}
+			return auth.Username, auth.Password, nil
+		}))
+		resolver := remotesdocker.NewResolver(remotesdocker.ResolverOptions{
+			Hosts: remotesdocker.ConfigureDefaultRegistries(remotesdocker.WithAuthorizer(authorizer)),
+		})
+		pullOpts = append(pullOpts, containerd.WithResolver(resolver))
+	}
+	if opts.Progress != nil {
+		opts.Progress("pulling")
+	}
+	_, err3 := cli.Pull(ctx, ref, pullOpts...)
+	if err3 == nil && opts.Progress != nil {
+		opts.Progress("pulled")
+	}
+	return err3
+}
+
+func (c *Containerd) HasImage(ctx context.Context, image string) (bool, error) {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return false, err
+	}
+	ref, err2 := NormalizeImage(image)
+	if err2 != nil {
+		return false, err2
+	}
+	_, err3 := cli.GetImage(ctx, ref)
+	if err3 != nil {
+		if errdefs.IsNotFound(err3) {
+			return false, nil
+		}
+		return false, err3
+	}
+	return true, nil
+}
+
+func (c *Containerd) ListImages(ctx context.Context) ([]Image, error) {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l, err2 := cli.ListImages(ctx)
+	if err2 != nil {
+		return nil, err2
+	}
+	var result []Image
+	for _, img := range l {
+		size, err3 := img.Size(ctx)
+		if err3 != nil {
+			log.Println(1, "containerd ListImages: size of "+img.Name()+" unknown")
+			log.Println(1, err3)
+		}
+		result = append(result, Image{
+			ID:      img.Target().Digest.String(),
+			Names:   []string{img.Name()},
+			Size:    size,
+			Created: img.Metadata().CreatedAt,
+		})
+	}
+	return result, nil
+}
+
+func (c *Containerd) RemoveImage(ctx context.Context, image string) error {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+	ref, err2 := NormalizeImage(image)
+	if err2 != nil {
+		return err2
+	}
+	l, err3 := cli.Containers(ctx)
+	if err3 != nil {
+		return err3
+	}
+	for _, cont := range l {
+		ci, err4 := cont.Info(ctx)
+		if err4 != nil {
+			return err4
+		}
+		if ci.Image == ref {
+			return errors.New("image " + image + " is used by container " + ci.ID)
+		}
+	}
+	return notFound(cli.ImageService().Delete(ctx, ref, images.SynchronousDelete()))
+}
+
+func (c *Containerd) Create(ctx context.Context, spec Spec) (string, error) {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(spec.Ports) > 0 {
+		return "", errors.New("containerd runtime can't publish ports without a CNI network")
+	}
+	if spec.DiskLimit > 0 {
+		return "", errors.New("containerd runtime can't limit the container filesystem size")
+	}
+	ref, err2 := NormalizeImage(spec.Image)
+	if err2 != nil {
+		return "", err2
+	}
+	image, err3 := cli.GetImage(ctx, ref)
+	if err3 != nil {
+		return "", err3
+	}
+	specOpts := []oci.SpecOpts{oci.WithImageConfig(image)}
+	if len(spec.Cmd) > 0 {
+		specOpts = append(specOpts, oci.WithProcessArgs(spec.Cmd...))
+	}
+	if len(spec.Env) > 0 {
+		specOpts = append(specOpts, oci.WithEnv(spec.Env))
+	}
+	if len(spec.Mounts) > 0 {
+		var mounts []specs.Mount
+		for _, m := range spec.Mounts {
+			options := []string{"rbind", "rw"}
+			if m.ReadOnly {
+				options = []string{"rbind", "ro"}
+			}
+			mounts = append(mounts, specs.Mount{Type: "bind", Source: m.Source, Destination: m.Target, Options: options})
+		}
+		specOpts = append(specOpts, oci.WithMounts(mounts))
+	}
+	if spec.NetworkContainer != "" {
+		netns, err := c.netnsPath(ctx, cli, spec.NetworkContainer)
+		if err != nil {
+			return "", err
+		}
+		specOpts = append(specOpts, oci.WithLinuxNamespace(specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: netns}))
+	}
+	if spec.CPUShares > 0 {
+		specOpts = append(specOpts, oci.WithCPUShares(spec.CPUShares))
+	}
+	if spec.NanoCPUs > 0 {
+		specOpts = append(specOpts, oci.WithCPUCFS(int64(spec.NanoCPUs*cfsPeriod/1e9), cfsPeriod))
+	}
+	if spec.MemoryLimit > 0 {
+		specOpts = append(specOpts, oci.WithMemoryLimit(spec.MemoryLimit))
+	}
+	labels := map[string]string{}
+	for k, v := range spec.Labels {
+		labels[k] = v
+	}
+	if spec.StopSignal != "" {
+		labels[containerd.StopSignalLabel] = spec.StopSignal
+	}
+	if spec.StopTimeout > 0 {
+		labels[stopTimeoutLabel] = strconv.FormatUint(spec.StopTimeout, 10)
+	}
+	cont, err4 := cli.NewContainer(ctx, spec.Name,
+		containerd.WithImage(image),
+		containerd.WithNewSnapshot(spec.Name+"-snapshot", image),
+		containerd.WithNewSpec(specOpts...),
+		containerd.WithContainerLabels(labels),
+	)
+	if err4 != nil {
+		return "", err4
+	}
+	return cont.ID(), nil
+}
+
+// procPath returns the /proc directory of the running task of id.
+func (c *Containerd) procPath(ctx context.Context, cli *containerd.Client, id string) (string, error) {
+	cont, err := cli.LoadContainer(ctx, id)
+	if err != nil {
+		return "", notFound(err)
+	}
+	task, err2 := cont.Task(ctx, nil)
+	if err2 != nil {
+		return "", notFound(err2)
+	}
+	return "/proc/" + strconv.FormatUint(uint64(task.Pid()), 10), nil
+}
+
+// netnsPath returns the network namespace of the running task of id.
+func (c *Containerd) netnsPath(ctx context.Context, cli *containerd.Client, id string) (string, error) {
+	p, err := c.procPath(ctx, cli, id)
+	if err != nil {
+		return "", err
+	}
+	return p + "/ns/net", nil
+}
+
+// CopyFrom archives the file from the root filesystem of the running
+// task, containerd has no archive API of its own.
+func (c *Containerd) CopyFrom(ctx context.Context, id, path string) (io.ReadCloser, error) {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p, err2 := c.procPath(ctx, cli, id)
+	if err2 != nil {
+		return nil, err2
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(tarPath(p+"/root", path, pw))
+	}()
+	return pr, nil
+}
+
+func (c *Containerd) CopyTo(ctx context.Context, id, dir string, content io.Reader) error {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+	p, err2 := c.procPath(ctx, cli, id)
+	if err2 != nil {
+		return err2
+	}
+	return untar(p+"/root", dir, content)
+}
+
+func (c *Containerd) Start(ctx context.Context, id string) error {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+	cont, err2 := cli.LoadContainer(ctx, id)
+	if err2 != nil {
+		return notFound(err2)
+	}
+	if task, err := cont.Task(ctx, nil); err == nil {
+		// a stopped task has to be deleted before the container can run again
+		if _, err := task.Delete(ctx, containerd.WithProcessKill); err != nil {
+			return err
+		}
+	}
+	err3 := os.MkdirAll(conf.DataDir+"/"+conf.StateDir+"/logs", 0755)
+	if err3 != nil {
+		return err3
+	}
+	task, err4 := cont.NewTask(ctx, cio.LogFile(containerdLogPath(id)))
+	if err4 != nil {
+		return err4
+	}
+	return task.Start(ctx)
+}
+
+func (c *Containerd) Stop(ctx context.Context, id string) error {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+	cont, err2 := cli.LoadContainer(ctx, id)
+	if err2 != nil {
+		return notFound(err2)
+	}
+	task, err3 := cont.Task(ctx, nil)
+	if err3 != nil {
+		if errdefs.IsNotFound(err3) {
+			return nil
+		}
+		return err3
+	}
+	exitCh, err4 := task.Wait(ctx)
+	if err4 != nil {
+		return err4
+	}
+	stopSignal, err5 := containerd.GetStopSignal(ctx, cont, syscall.SIGTERM)
+	if err5 != nil {
+		return err5
+	}
+	stopTimeout := containerdStopTimeout
+	if labels, err := cont.Labels(ctx); err == nil {
+		if seconds, err := strconv.ParseUint(labels[stopTimeoutLabel], 10, 64); err == nil {
+			stopTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+	err6 := task.Kill(ctx, stopSignal)
+	if err6 != nil && !errdefs.IsNotFound(err6) {
+		return err6
+	}
+	select {
+	case <-exitCh:
+	case <-time.After(stopTimeout):
+		err7 := task.Kill(ctx, syscall.SIGKILL)
+		if err7 != nil && !errdefs.IsNotFound(err7) {
+			return err7
+		}
+		<-exitCh
+	}
+	return nil
+}
+
+func (c *Containerd) Remove(ctx context.Context, id string) error {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return err
+	}
+	cont, err2 := cli.LoadContainer(ctx, id)
+	if err2 != nil {
+		return notFound(err2)
+	}
+	if task, err := cont.Task(ctx, nil); err == nil {
+		status, err := task.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if status.Status == containerd.Running {
+			return errors.New("container " + id + " is running")
+		}
+		if _, err := task.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	err3 := cont.Delete(ctx, containerd.WithSnapshotCleanup)
+	if err3 != nil {
+		return err3
+	}
+	os.Remove(containerdLogPath(id))
+	return nil
+}
+
+func (c *Containerd) List(ctx context.Context, all bool) ([]Info, error) {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l, err2 := cli.Containers(ctx)
+	if err2 != nil {
+		return nil, err2
+	}
+	var result []Info
+	for _, cont := range l {
+		info, err := c.inspect(ctx, cont)
+		if err != nil {
+			return nil, err
+		}
+		if all || info.Running {
+			result = append(result, info)
+		}
+	}
+	return result, nil
+}
+
+func (c *Containerd) Inspect(ctx context.Context, id string) (Info, error) {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return Info{}, err
+	}
+	cont, err2 := cli.LoadContainer(ctx, id)
+	if err2 != nil {
+		return Info{}, notFound(err2)
+	}
+	return c.inspect(ctx, cont)
+}
+
+func (c *Containerd) inspect(ctx context.Context, cont containerd.Container) (Info, error) {
+	ci, err := cont.Info(ctx)
+	if err != nil {
+		return Info{}, err
+	}
+	info := Info{ID: ci.ID, Name: ci.ID, Image: ci.Image, State: "created", Labels: ci.Labels}
+	task, err2 := cont.Task(ctx, nil)
+	if err2 != nil {
+		if errdefs.IsNotFound(err2) {
+			return info, nil
+		}
+		return Info{}, err2
+	}
+	status, err3 := task.Status(ctx)
+	if err3 != nil {
+		return Info{}, err3
+	}
+	switch status.Status {
+	case containerd.Running:
+		info.State = "running"
+		info.Running = true
+	case containerd.Stopped:
+		info.State = "exited"
+		info.ExitCode = int(status.ExitStatus)
+		info.FinishedAt = status.ExitTime
+	default:
+		info.State = string(status.Status)
+	}
+	return info, nil
+}
+
+// Events follows the task events of the rws namespace, exec processes
+// also show up as start and die of their container.
+func (c *Containerd) Events(ctx context.Context) (<-chan Event, <-chan error) {
+	events := make(chan Event)
+	errs := make(chan error, 1)
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		errs <- err
+		close(events)
+		return events, errs
+	}
+	envelopes, envelopeErrs := cli.Subscribe(ctx, `topic~="/tasks/"`, `topic=="/containers/create"`, `topic=="/containers/delete"`)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case e := <-envelopes:
+				if e == nil || e.Namespace != conf.ContainerdNamespace {
+					continue
+				}
+				v, err := typeurl.UnmarshalAny(e.Event)
+				if err != nil {
+					continue
+				}
+				var event Event
+				switch v := v.(type) {
+				case *apievents.ContainerCreate:
+					event = Event{ID: v.ID, Action: "create"}
+				case *apievents.TaskStart:
+					event = Event{ID: v.ContainerID, Action: "start"}
+				case *apievents.TaskExit:
+					event = Event{ID: v.ContainerID, Action: "die"}
+				case *apievents.TaskOOM:
+					event = Event{ID: v.ContainerID, Action: "oom"}
+				case *apievents.ContainerDelete:
+					event = Event{ID: v.ID, Action: "destroy"}
+				default:
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			case err := <-envelopeErrs:
+				if err != nil && ctx.Err() == nil {
+					errs <- err
+				}
+				return
+			}
+		}
+	}()
+	return events, errs
+}
+
+// Logs reads the task log file. Since and Timestamps are not supported
+// because containerd doesn't record when each line was written.
+func (c *Containerd) Logs(ctx context.Context, id string, opts LogsOptions) (io.ReadCloser, error) {
+	f, err := os.Open(containerdLogPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		defer f.Close()
+		err := tailFile(ctx, f, w, opts)
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+func tailFile(ctx context.Context, f *os.File, w io.Writer, opts LogsOptions) error {
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(opts.Tail); err == nil && n < len(lines) {
+		lines = lines[len(lines)-n:]
+	}
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	if !opts.Follow {
+		return nil
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+type containerdSample struct {
+	cpu        uint64
+	memory     uint64
+	limit      uint64
+	rx         uint64
+	tx         uint64
+	blockRead  uint64
+	blockWrite uint64
+}
+
+func (c *Containerd) sample(ctx context.Context, task containerd.Task) (containerdSample, error) {
+	var s containerdSample
+	m, err := task.Metrics(ctx)
+	if err != nil {
+		return s, err
+	}
+	v, err2 := typeurl.UnmarshalAny(m.Data)
+	if err2 != nil {
+		return s, err2
+	}
+	switch metrics := v.(type) {
+	case *stats.Metrics:
+		s.cpu = metrics.GetCPU().GetUsage().GetTotal()
+		s.memory = metrics.GetMemory().GetUsage().GetUsage()
+		s.limit = metrics.GetMemory().GetUsage().GetLimit()
+		for _, n := range metrics.GetNetwork() {
+			s.rx += n.GetRxBytes()
+			s.tx += n.GetTxBytes()
+		}
+		for _, b := range metrics.GetBlkio().GetIoServiceBytesRecursive() {
+			switch b.GetOp() {
+			case "Read", "read":
+				s.blockRead += b.GetValue()
+			case "Write", "write":
+				s.blockWrite += b.GetValue()
+			}
+		}
+	case *statsv2.Metrics:
+		s.cpu = metrics.GetCPU().GetUsageUsec() * 1000
+		s.memory = metrics.GetMemory().GetUsage()
+		s.limit = metrics.GetMemory().GetUsageLimit()
+		for _, e := range metrics.GetIo().GetUsage() {
+			s.blockRead += e.GetRbytes()
+			s.blockWrite += e.GetWbytes()
+		}
+	default:
+		return s, errors.New("unknown metrics type")
+	}
+	return s, nil
+}
+
+// Stats samples the task cgroup twice a second apart to compute CPU usage.
+func (c *Containerd) Stats(ctx context.Context, id string) (Stats, error) {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	cont, err2 := cli.LoadContainer(ctx, id)
+	if err2 != nil {
+		return Stats{}, notFound(err2)
+	}
+	task, err3 := cont.Task(ctx, nil)
+	if err3 != nil {
+		return Stats{}, notFound(err3)
+	}
+	first, err4 := c.sample(ctx, task)
+	if err4 != nil {
+		return Stats{}, err4
+	}
+	start := time.Now()
+	select {
+	case <-ctx.Done():
+		return Stats{}, ctx.Err()
+	case <-time.After(time.Second):
+	}
+	second, err5 := c.sample(ctx, task)
+	if err5 != nil {
+		return Stats{}, err5
+	}
+	elapsed := time.Since(start)
+	return Stats{
+		CPUPercent:  float64(second.cpu-first.cpu) / float64(elapsed.Nanoseconds()) * 100,
+		MemoryUsage: second.memory,
+		MemoryLimit: second.limit,
+		NetworkRx:   second.rx,
+		NetworkTx:   second.tx,
+		BlockRead:   second.blockRead,
+		BlockWrite:  second.blockWrite,
+	}, nil
+}
+
+func (c *Containerd) Exec(ctx context.Context, id string, opts ExecOptions, streams ExecStreams) (int, error) {
+	cli, ctx, err := c.client(ctx)
+	if err != nil {
+		return -1, err
+	}
+	cont, err2 := cli.LoadContainer(ctx, id)
+	if err2 != nil {
+		return -1, notFound(err2)
+	}
+	task, err3 := cont.Task(ctx, nil)
+	if err3 != nil {
+		return -1, notFound(err3)
+	}
+	spec, err4 := cont.Spec(ctx)
+	if err4 != nil {
+		return -1, err4
+	}
+	pspec := spec.Process
+	pspec.Args = opts.Cmd
+	pspec.Terminal = opts.Tty
+	started := make(chan containerd.Process, 1)
+	defer close(started)
+	var stdin io.Reader
+	if streams.Stdin != nil {
+		// containerd keeps the stdin fifo open until CloseIO is called
+		stdin = &closeIOReader{r: streams.Stdin, ctx: ctx, started: started}
+	}
+	ioOpts := []cio.Opt{cio.WithStreams(stdin, streams.Stdout, streams.Stderr)}
+	if opts.Tty {
+		ioOpts = append(ioOpts, cio.WithTerminal)
+	}
+	process, err5 := task.Exec(ctx, "exec-"+uniuri.NewLen(12), pspec, cio.NewCreator(ioOpts...))
+	if err5 != nil {
+		return -1, err5
+	}
+	defer process.Delete(ctx)
+	statusC, err6 := process.Wait(ctx)
+	if err6 != nil {
+		return -1, err6
+	}
+	err7 := process.Start(ctx)
+	if err7 != nil {
+		return -1, err7
+	}
+	started <- process
+	if streams.Resize != nil {
+		go func() {
+			for size := range streams.Resize {
+				err := process.Resize(ctx, uint32(size.Width), uint32(size.Height))
+				if err != nil {
+					log.Println(1, "Containerd: exec resize error")
+					log.Println(1, err)
+				}
+			}
+		}()
+	}
+	status := <-statusC
+	code, _, err8 := status.Result()
+	if err8 != nil {
+		return -1, err8
+	}
+	return int(code), nil
+}
+
+type closeIOReader struct {
+	r       io.Reader
+	ctx     context.Context
+	started chan containerd.Process
+	once    sync.Once
+}
+
+func (c *closeIOReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		c.once.Do(func() {
+			if process, ok := <-c.started; ok {
+				process.CloseIO(c.ctx, containerd.WithStdinCloser)
+			}
+		})
+	}
+	return n, err
+}
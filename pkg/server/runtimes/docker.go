@@ -0,0 +1,518 @@
+package runtimes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"golang.org/x/net/context"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Docker drives the local docker daemon through a single shared client.
+type Docker struct {
+	once sync.Once
+	cli  *client.Client
+	err  error
+}
+
+func NewDocker() *Docker {
+	return &Docker{}
+}
+
+func (d *Docker) client() (*client.Client, error) {
+	d.once.Do(func() {
+		d.cli, d.err = client.NewClientWithOpts(client.WithVersion(conf.DockerAPIVersion))
+		if d.err != nil {
+			log.Println(1, "Docker: client create error")
+			log.Println(1, d.err)
+		}
+	})
+	return d.cli, d.err
+}
+
+func (d *Docker) Pull(ctx context.Context, image string, opts PullOptions) error {
+	cli, err := d.client()
+	if err != nil {
+		return err
+	}
+	var pullOpts types.ImagePullOptions
+	if opts.Auth != nil {
+		authBytes, err := json.Marshal(types.AuthConfig{
+			Username:      opts.Auth.Username,
+			Password:      opts.Auth.Password,
+			ServerAddress: opts.Auth.Server,
+		})
+		if err != nil {
+			return err
+		}
+		pullOpts.RegistryAuth = base64.URLEncoding.EncodeToString(authBytes)
+	}
+	out, err2 := cli.ImagePull(ctx, image, pullOpts)
+	if err2 != nil {
+		return err2
+	}
+	defer out.Close()
+	return decodePullProgress(out, opts.Progress)
+}
+
+// pullMessage is the part of a docker pull stream message rws looks at.
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	Error          string `json:"error"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+// decodePullProgress reads the docker pull message stream, reports the
+// overall download percentage and returns the error message if any.
+func decodePullProgress(r io.Reader, progress func(string)) error {
+	type layer struct{ current, total int64 }
+	layers := make(map[string]*layer)
+	last := ""
+	decoder := json.NewDecoder(r)
+	for {
+		var m pullMessage
+		err := decoder.Decode(&m)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if m.Error != "" {
+			return errors.New(m.Error)
+		}
+		if progress == nil {
+			continue
+		}
+		if m.ID != "" && m.Status == "Downloading" && m.ProgressDetail.Total > 0 {
+			layers[m.ID] = &layer{m.ProgressDetail.Current, m.ProgressDetail.Total}
+		}
+		status := m.Status
+		var current, total int64
+		for _, l := range layers {
+			current += l.current
+			total += l.total
+		}
+		if total > 0 && m.Status == "Downloading" {
+			status = "downloading " + strconv.FormatInt(current*100/total, 10) + "%"
+		}
+		if status != last {
+			last = status
+			progress(status)
+		}
+	}
+}
+
+func (d *Docker) HasImage(ctx context.Context, image string) (bool, error) {
+	cli, err := d.client()
+	if err != nil {
+		return false, err
+	}
+	_, _, err2 := cli.ImageInspectWithRaw(ctx, image)
+	if err2 != nil {
+		if client.IsErrNotFound(err2) {
+			return false, nil
+		}
+		return false, err2
+	}
+	return true, nil
+}
+
+func (d *Docker) CopyFrom(ctx context.Context, id, path string) (io.ReadCloser, error) {
+	cli, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err2 := cli.CopyFromContainer(ctx, id, path)
+	if client.IsErrNotFound(err2) {
+		return nil, ErrNotFound
+	}
+	return rc, err2
+}
+
+func (d *Docker) CopyTo(ctx context.Context, id, dir string, content io.Reader) error {
+	cli, err := d.client()
+	if err != nil {
+		return err
+	}
+	err2 := cli.CopyToContainer(ctx, id, dir, content, types.CopyToContainerOptions{})
+	if client.IsErrNotFound(err2) {
+		return ErrNotFound
+	}
+	return err2
+}
+
+func (d *Docker) ListImages(ctx context.Context) ([]Image, error) {
+	cli, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+	l, err2 := cli.ImageList(ctx, types.ImageListOptions{})
+	if err2 != nil {
+		return nil, err2
+	}
+	var result []Image
+	for _, img := range l {
+		var names []string
+		for _, tag := range img.RepoTags {
+			name, err3 := NormalizeImage(tag)
+			if err3 != nil {
+				// <none>:<none> of untagged images
+				continue
+			}
+			names = append(names, name)
+		}
+		result = append(result, Image{
+			ID:      img.ID,
+			Names:   names,
+			Size:    img.Size,
+			Created: time.Unix(img.Created, 0),
+		})
+	}
+	return result, nil
+}
+
+func (d *Docker) RemoveImage(ctx context.Context, image string) error {
+	cli, err := d.client()
+	if err != nil {
+		return err
+	}
+	_, err2 := cli.ImageRemove(ctx, image, types.ImageRemoveOptions{PruneChildren: true})
+	if client.IsErrNotFound(err2) {
+		return ErrNotFound
+	}
+	return err2
+}
+
+func (d *Docker) Create(ctx context.Context, spec Spec) (string, error) {
+	cli, err := d.client()
+	if err != nil {
+		return "", err
+	}
+	config := &container.Config{
+		Image:  spec.Image,
+		Cmd:    spec.Cmd,
+		Env:    spec.Env,
+		Labels: spec.Labels,
+	}
+	if spec.StopSignal != "" {
+		config.StopSignal = spec.StopSignal
+	}
+	if spec.StopTimeout > 0 {
+		stopTimeout := int(spec.StopTimeout)
+		config.StopTimeout = &stopTimeout
+	}
+	hostConfig := &container.HostConfig{
+		Resources: container.Resources{
+			CPUShares:         int64(spec.CPUShares),
+			NanoCPUs:          int64(spec.NanoCPUs),
+			Memory:            int64(spec.MemoryLimit),
+			MemoryReservation: int64(spec.MemoryReservation),
+		},
+	}
+	if spec.NetworkContainer != "" {
+		hostConfig.NetworkMode = container.NetworkMode("container:" + spec.NetworkContainer)
+	}
+	if len(spec.Ports) > 0 {
+		config.ExposedPorts = nat.PortSet{}
+		hostConfig.PortBindings = nat.PortMap{}
+		for _, p := range spec.Ports {
+			port := nat.Port(strconv.FormatUint(p.ContainerPort, 10) + "/" + p.Protocol)
+			config.ExposedPorts[port] = struct{}{}
+			hostConfig.PortBindings[port] = append(hostConfig.PortBindings[port], nat.PortBinding{
+				HostPort: strconv.FormatUint(p.HostPort, 10),
+			})
+		}
+	}
+	for _, m := range spec.Mounts {
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+	if spec.DiskLimit > 0 {
+		hostConfig.StorageOpt = map[string]string{"size": strconv.FormatUint(spec.DiskLimit, 10)}
+	}
+	resp, err2 := cli.ContainerCreate(ctx, config, hostConfig, nil, spec.Name)
+	if err2 != nil && hostConfig.StorageOpt != nil && strings.Contains(err2.Error(), "storage-opt") {
+		// only some storage drivers can limit the container filesystem size
+		return "", errors.New("docker storage driver can't limit the container filesystem size: " + err2.Error())
+	}
+	if err2 != nil {
+		return "", err2
+	}
+	return resp.ID, nil
+}
+
+func (d *Docker) Start(ctx context.Context, id string) error {
+	cli, err := d.client()
+	if err != nil {
+		return err
+	}
+	return cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
+}
+
+func (d *Docker) Stop(ctx context.Context, id string) error {
+	cli, err := d.client()
+	if err != nil {
+		return err
+	}
+	// a nil timeout makes the daemon use the container's StopTimeout
+	return cli.ContainerStop(ctx, id, nil)
+}
+
+func (d *Docker) Remove(ctx context.Context, id string) error {
+	cli, err := d.client()
+	if err != nil {
+		return err
+	}
+	opts := types.ContainerRemoveOptions{RemoveVolumes: false, RemoveLinks: false, Force: false}
+	return cli.ContainerRemove(ctx, id, opts)
+}
+
+func (d *Docker) List(ctx context.Context, all bool) ([]Info, error) {
+	cli, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+	l, err2 := cli.ContainerList(ctx, types.ContainerListOptions{All: all})
+	if err2 != nil {
+		return nil, err2
+	}
+	var result []Info
+	for _, c := range l {
+		var name string
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		result = append(result, Info{
+			ID:      c.ID,
+			Name:    name,
+			Image:   c.Image,
+			State:   c.State,
+			Running: c.State == "running",
+			Labels:  c.Labels,
+		})
+	}
+	return result, nil
+}
+
+func (d *Docker) Inspect(ctx context.Context, id string) (Info, error) {
+	cli, err := d.client()
+	if err != nil {
+		return Info{}, err
+	}
+	c, err2 := cli.ContainerInspect(ctx, id)
+	if err2 != nil {
+		if client.IsErrNotFound(err2) {
+			return Info{}, ErrNotFound
+		}
+		return Info{}, err2
+	}
+	info := Info{
+		ID:     c.ID,
+		Name:   strings.TrimPrefix(c.Name, "/"),
+		Image:  c.Config.Image,
+		Labels: c.Config.Labels,
+	}
+	if c.State != nil {
+		info.State = c.State.Status
+		info.Running = c.State.Running
+		info.ExitCode = c.State.ExitCode
+		info.OOMKilled = c.State.OOMKilled
+		info.StartedAt, _ = time.Parse(time.RFC3339Nano, c.State.StartedAt)
+		info.FinishedAt, _ = time.Parse(time.RFC3339Nano, c.State.FinishedAt)
+	}
+	info.RestartCount = uint64(c.RestartCount)
+	if c.NetworkSettings != nil {
+		info.IP = c.NetworkSettings.IPAddress
+		for _, n := range c.NetworkSettings.Networks {
+			if info.IP == "" && n != nil {
+				info.IP = n.IPAddress
+			}
+		}
+	}
+	return info, nil
+}
+
+func (d *Docker) Events(ctx context.Context) (<-chan Event, <-chan error) {
+	events := make(chan Event)
+	errs := make(chan error, 1)
+	cli, err := d.client()
+	if err != nil {
+		errs <- err
+		close(events)
+		return events, errs
+	}
+	args := filters.NewArgs()
+	args.Add("type", "container")
+	messages, messageErrs := cli.Events(ctx, types.EventsOptions{Filters: args})
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case m := <-messages:
+				action := m.Action
+				if i := strings.Index(action, ":"); i >= 0 {
+					// exec_start: cmd and health_status: healthy
+					action = action[:i]
+				}
+				select {
+				case events <- Event{ID: m.Actor.ID, Action: action}:
+				case <-ctx.Done():
+					return
+				}
+			case err := <-messageErrs:
+				if ctx.Err() == nil {
+					errs <- err
+				}
+				return
+			}
+		}
+	}()
+	return events, errs
+}
+
+// Logs returns stdout and stderr of the container demultiplexed into one stream.
+func (d *Docker) Logs(ctx context.Context, id string, opts LogsOptions) (io.ReadCloser, error) {
+	cli, err := d.client()
+	if err != nil {
+		return nil, err
+	}
+	out, err2 := cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       opts.Tail,
+		Since:      opts.Since,
+		Timestamps: opts.Timestamps,
+		Follow:     opts.Follow,
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	r, w := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(w, w, out)
+		out.Close()
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+func (d *Docker) Stats(ctx context.Context, id string) (Stats, error) {
+	cli, err := d.client()
+	if err != nil {
+		return Stats{}, err
+	}
+	resp, err2 := cli.ContainerStats(ctx, id, false)
+	if err2 != nil {
+		return Stats{}, err2
+	}
+	defer resp.Body.Close()
+	var s types.StatsJSON
+	err3 := json.NewDecoder(resp.Body).Decode(&s)
+	if err3 != nil {
+		return Stats{}, err3
+	}
+	var result Stats
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		cpus := float64(s.CPUStats.OnlineCPUs)
+		if cpus == 0 {
+			cpus = float64(len(s.CPUStats.CPUUsage.PercpuUsage))
+		}
+		result.CPUPercent = cpuDelta / systemDelta * cpus * 100
+	}
+	result.MemoryUsage = s.MemoryStats.Usage
+	result.MemoryLimit = s.MemoryStats.Limit
+	for _, n := range s.Networks {
+		result.NetworkRx += n.RxBytes
+		result.NetworkTx += n.TxBytes
+	}
+	for _, b := range s.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(b.Op) {
+		case "read":
+			result.BlockRead += b.Value
+		case "write":
+			result.BlockWrite += b.Value
+		}
+	}
+	return result, nil
+}
+
+func (d *Docker) Exec(ctx context.Context, id string, opts ExecOptions, streams ExecStreams) (int, error) {
+	cli, err := d.client()
+	if err != nil {
+		return -1, err
+	}
+	config := types.ExecConfig{
+		Cmd:          opts.Cmd,
+		Tty:          opts.Tty,
+		AttachStdin:  streams.Stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	resp, err2 := cli.ContainerExecCreate(ctx, id, config)
+	if err2 != nil {
+		if client.IsErrNotFound(err2) {
+			return -1, ErrNotFound
+		}
+		return -1, err2
+	}
+	hr, err3 := cli.ContainerExecAttach(ctx, resp.ID, config)
+	if err3 != nil {
+		return -1, err3
+	}
+	defer hr.Close()
+	if streams.Resize != nil {
+		go func() {
+			for size := range streams.Resize {
+				err := cli.ContainerExecResize(ctx, resp.ID, types.ResizeOptions{Height: size.Height, Width: size.Width})
+				if err != nil {
+					log.Println(1, "Docker: exec resize error")
+					log.Println(1, err)
+				}
+			}
+		}()
+	}
+	if streams.Stdin != nil {
+		go func() {
+			io.Copy(hr.Conn, streams.Stdin)
+			hr.CloseWrite()
+		}()
+	}
+	var err4 error
+	if opts.Tty {
+		_, err4 = io.Copy(streams.Stdout, hr.Reader)
+	} else {
+		_, err4 = stdcopy.StdCopy(streams.Stdout, streams.Stderr, hr.Reader)
+	}
+	if err4 != nil {
+		return -1, err4
+	}
+	inspect, err5 := cli.ContainerExecInspect(ctx, resp.ID)
+	if err5 != nil {
+		return -1, err5
+	}
+	return inspect.ExitCode, nil
+}
@@ -0,0 +1,283 @@
+package runtimes
+
+import (
+	"bytes"
+	"errors"
+	"github.com/dchest/uniuri"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fake is an in-memory runtime for tests and hosts without a container engine.
+// Started containers "run" until stopped; their logs are the command line
+// and their filesystem is a temporary directory.
+type Fake struct {
+	mu         sync.Mutex
+	images     map[string]bool
+	containers map[string]*fakeContainer
+	watchers   []chan Event
+}
+
+type fakeContainer struct {
+	info Info
+	cmd  []string
+	// root is a temporary directory standing in for the filesystem
+	root string
+}
+
+func NewFake() *Fake {
+	return &Fake{images: map[string]bool{}, containers: map[string]*fakeContainer{}}
+}
+
+// emit sends an event to the watchers, dropping it for those that
+// don't keep up. It is called with f.mu held.
+func (f *Fake) emit(id, action string) {
+	for _, w := range f.watchers {
+		select {
+		case w <- Event{ID: id, Action: action}:
+		default:
+		}
+	}
+}
+
+func (f *Fake) Events(ctx context.Context) (<-chan Event, <-chan error) {
+	events := make(chan Event, 100)
+	f.mu.Lock()
+	f.watchers = append(f.watchers, events)
+	f.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i, w := range f.watchers {
+			if w == events {
+				f.watchers = append(f.watchers[:i], f.watchers[i+1:]...)
+				break
+			}
+		}
+		close(events)
+	}()
+	return events, make(chan error)
+}
+
+func (f *Fake) get(id string) (*fakeContainer, error) {
+	if c, ok := f.containers[id]; ok {
+		return c, nil
+	}
+	for _, c := range f.containers {
+		if c.info.Name == id {
+			return c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (f *Fake) Pull(_ context.Context, image string, opts PullOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images[image] = true
+	if opts.Progress != nil {
+		opts.Progress("pulled")
+	}
+	return nil
+}
+
+func (f *Fake) HasImage(_ context.Context, image string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.images[image], nil
+}
+
+func (f *Fake) ListImages(_ context.Context) ([]Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var l []Image
+	for image := range f.images {
+		l = append(l, Image{ID: image, Names: []string{image}})
+	}
+	return l, nil
+}
+
+func (f *Fake) RemoveImage(_ context.Context, image string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.images[image] {
+		return ErrNotFound
+	}
+	for _, c := range f.containers {
+		if c.info.Image == image {
+			return errors.New("image " + image + " is used by container " + c.info.ID)
+		}
+	}
+	delete(f.images, image)
+	return nil
+}
+
+func (f *Fake) Create(_ context.Context, spec Spec) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.images[spec.Image] {
+		return "", errors.New("image " + spec.Image + " not found")
+	}
+	for _, c := range f.containers {
+		if c.info.Name == spec.Name {
+			return "", errors.New("container name " + spec.Name + " already in use")
+		}
+	}
+	root, err := ioutil.TempDir("", "rws-fake-")
+	if err != nil {
+		return "", err
+	}
+	id := uniuri.NewLen(64)
+	f.containers[id] = &fakeContainer{
+		info: Info{ID: id, Name: spec.Name, Image: spec.Image, State: "created", Labels: spec.Labels},
+		cmd:  spec.Cmd,
+		root: root,
+	}
+	f.emit(id, "create")
+	return id, nil
+}
+
+func (f *Fake) Start(_ context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.get(id)
+	if err != nil {
+		return err
+	}
+	c.info.State = "running"
+	c.info.Running = true
+	c.info.StartedAt = time.Now()
+	f.emit(c.info.ID, "start")
+	return nil
+}
+
+func (f *Fake) Stop(_ context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.get(id)
+	if err != nil {
+		return err
+	}
+	if c.info.Running {
+		c.info.State = "exited"
+		c.info.Running = false
+		c.info.FinishedAt = time.Now()
+		f.emit(c.info.ID, "die")
+	}
+	return nil
+}
+
+func (f *Fake) Remove(_ context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.get(id)
+	if err != nil {
+		return err
+	}
+	if c.info.Running {
+		return errors.New("container " + id + " is running")
+	}
+	os.RemoveAll(c.root)
+	delete(f.containers, c.info.ID)
+	f.emit(c.info.ID, "destroy")
+	return nil
+}
+
+func (f *Fake) List(_ context.Context, all bool) ([]Info, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var result []Info
+	for _, c := range f.containers {
+		if all || c.info.Running {
+			result = append(result, c.info)
+		}
+	}
+	return result, nil
+}
+
+func (f *Fake) Inspect(_ context.Context, id string) (Info, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.get(id)
+	if err != nil {
+		return Info{}, err
+	}
+	return c.info, nil
+}
+
+func (f *Fake) Logs(_ context.Context, id string, _ LogsOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.get(id)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for i, arg := range c.cmd {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(arg)
+	}
+	b.WriteString("\n")
+	return ioutil.NopCloser(&b), nil
+}
+
+func (f *Fake) Stats(_ context.Context, id string) (Stats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.get(id)
+	if err != nil {
+		return Stats{}, err
+	}
+	return Stats{}, nil
+}
+
+// Exec echoes the command line to stdout.
+func (f *Fake) Exec(_ context.Context, id string, opts ExecOptions, streams ExecStreams) (int, error) {
+	f.mu.Lock()
+	c, err := f.get(id)
+	if err == nil && !c.info.Running {
+		err = errors.New("container " + id + " is not running")
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return -1, err
+	}
+	_, err2 := io.WriteString(streams.Stdout, strings.Join(opts.Cmd, " ")+"\n")
+	if err2 != nil {
+		return -1, err2
+	}
+	return 0, nil
+}
+
+func (f *Fake) CopyFrom(_ context.Context, id, path string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	c, err := f.get(id)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err2 := tarPath(c.root, path, &buf)
+	if err2 != nil {
+		return nil, err2
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+func (f *Fake) CopyTo(_ context.Context, id, dir string, content io.Reader) error {
+	f.mu.Lock()
+	c, err := f.get(id)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return untar(c.root, dir, content)
+}
@@ -0,0 +1,110 @@
+package runtimes
+
+import (
+	"archive/tar"
+	"bytes"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := NewFake()
+	events, _ := f.Events(ctx)
+	_, err := f.Create(ctx, Spec{Name: "test", Image: "alpine"})
+	if err == nil {
+		t.Errorf("create without pulled image should fail")
+	}
+	err = f.Pull(ctx, "alpine", PullOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	has, err := f.HasImage(ctx, "alpine")
+	if err != nil || !has {
+		t.Errorf("pulled image not found")
+	}
+	id, err := f.Create(ctx, Spec{Name: "test", Image: "alpine", Cmd: []string{"/bin/sleep", "60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Start(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{"create", "start"} {
+		e := <-events
+		if e.ID != id || e.Action != action {
+			t.Errorf("got event %v, want %s of %s", e, action, id)
+		}
+	}
+	l, err := f.List(ctx, false)
+	if err != nil || len(l) != 1 || l[0].ID != id || !l[0].Running {
+		t.Errorf("running container not listed: %v %v", l, err)
+	}
+	var out bytes.Buffer
+	code, err := f.Exec(ctx, id, ExecOptions{Cmd: []string{"echo", "hi"}}, ExecStreams{Stdout: &out})
+	if err != nil || code != 0 || out.String() != "echo hi\n" {
+		t.Errorf("exec output %q, code %d, error %v", out.String(), code, err)
+	}
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "dump.sql", Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+	tw.Write([]byte("hello"))
+	tw.Close()
+	err = f.CopyTo(ctx, id, "/tmp", &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := f.CopyFrom(ctx, id, "/tmp/dump.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "dump.sql" {
+		t.Fatalf("copied file not found: %v %v", hdr, err)
+	}
+	content, _ := ioutil.ReadAll(tr)
+	if string(content) != "hello" {
+		t.Errorf("copied file contains %q", content)
+	}
+	rc.Close()
+	err = f.Remove(ctx, id)
+	if err == nil {
+		t.Errorf("remove of running container should fail")
+	}
+	err = f.Stop(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Inspect(ctx, id)
+	if err != nil || info.State != "exited" {
+		t.Errorf("container not exited after stop: %v %v", info, err)
+	}
+	l, _ = f.List(ctx, false)
+	if len(l) != 0 {
+		t.Errorf("stopped container listed as running")
+	}
+	err = f.RemoveImage(ctx, "alpine")
+	if err == nil {
+		t.Errorf("remove of image used by a container should fail")
+	}
+	err = f.Remove(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Inspect(ctx, id)
+	if err != ErrNotFound {
+		t.Errorf("removed container still found")
+	}
+	err = f.RemoveImage(ctx, "alpine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, _ := f.ListImages(ctx)
+	if len(images) != 0 {
+		t.Errorf("removed image still listed: %v", images)
+	}
+}
@@ -0,0 +1,202 @@
+package runtimes
+
+import (
+	"errors"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"golang.org/x/net/context"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Spec describes a container to create.
+// CPUShares and MemoryReservation are soft guarantees derived from resource
+// requests, NanoCPUs, MemoryLimit and DiskLimit are hard limits. Zero means unset.
+// StopSignal and StopTimeout (seconds) are used by Stop.
+type Spec struct {
+	Name              string
+	Image             string
+	Cmd               []string
+	CPUShares         uint64
+	NanoCPUs          uint64
+	MemoryReservation uint64
+	MemoryLimit       uint64
+	DiskLimit         uint64
+	Ports             []PortBinding
+	Env               []string
+	Mounts            []Mount
+	StopSignal        string
+	StopTimeout       uint64
+	// NetworkContainer is the ID of a running container whose network
+	// namespace the new container joins, it can't publish Ports then.
+	NetworkContainer string
+	Labels           map[string]string
+}
+
+type PortBinding struct {
+	ContainerPort uint64
+	HostPort      uint64
+	Protocol      string
+}
+
+// Mount bind-mounts Source on the host to Target in the container.
+type Mount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// Image is an image present in the runtime. Names are normalized with
+// NormalizeImage, untagged images have none.
+type Image struct {
+	ID      string
+	Names   []string
+	Size    int64
+	Created time.Time
+}
+
+// NormalizeImage returns the fully qualified reference of an image name,
+// so redis and docker.io/library/redis:latest compare equal.
+func NormalizeImage(image string) (string, error) {
+	ref, err := docker.ParseDockerRef(image)
+	if err != nil {
+		return "", err
+	}
+	return ref.String(), nil
+}
+
+// Info is the runtime's view of a container.
+type Info struct {
+	ID         string
+	Name       string
+	Image      string
+	State      string
+	Running    bool
+	ExitCode   int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	OOMKilled  bool
+	IP         string
+	// RestartCount counts restarts done by the runtime itself.
+	RestartCount uint64
+	Labels       map[string]string
+}
+
+// Event is a container change reported by the runtime, Action is one of
+// create, start, die, oom or destroy. Consumers inspect the container ID
+// for the details.
+type Event struct {
+	ID     string
+	Action string
+}
+
+type RegistryAuth struct {
+	Server   string
+	Username string
+	Password string
+}
+
+// PullOptions are the credentials for a private registry and a callback
+// receiving human readable pull progress. Both may be unset.
+type PullOptions struct {
+	Auth     *RegistryAuth
+	Progress func(status string)
+}
+
+type LogsOptions struct {
+	Tail       string
+	Since      string
+	Timestamps bool
+	Follow     bool
+}
+
+type Stats struct {
+	CPUPercent  float64
+	MemoryUsage uint64
+	MemoryLimit uint64
+	NetworkRx   uint64
+	NetworkTx   uint64
+	BlockRead   uint64
+	BlockWrite  uint64
+}
+
+type ExecOptions struct {
+	Cmd []string
+	Tty bool
+}
+
+type TerminalSize struct {
+	Width  uint
+	Height uint
+}
+
+// ExecStreams are the streams of an exec session. Stdin may be nil,
+// Stderr is unused with a Tty, Resize may be nil.
+type ExecStreams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Resize <-chan TerminalSize
+}
+
+// Runtime is implemented by every container runtime rws can drive.
+type Runtime interface {
+	Pull(ctx context.Context, image string, opts PullOptions) error
+	HasImage(ctx context.Context, image string) (bool, error)
+	ListImages(ctx context.Context) ([]Image, error)
+	// RemoveImage removes an image by name, or by ID if it has none.
+	// It fails if a container uses the image.
+	RemoveImage(ctx context.Context, image string) error
+	// Events streams container events until ctx is done or the
+	// connection to the runtime fails, which is sent on the error channel.
+	Events(ctx context.Context) (<-chan Event, <-chan error)
+	Create(ctx context.Context, spec Spec) (string, error)
+	Start(ctx context.Context, id string) error
+	Stop(ctx context.Context, id string) error
+	Remove(ctx context.Context, id string) error
+	List(ctx context.Context, all bool) ([]Info, error)
+	Inspect(ctx context.Context, id string) (Info, error)
+	Logs(ctx context.Context, id string, opts LogsOptions) (io.ReadCloser, error)
+	Stats(ctx context.Context, id string) (Stats, error)
+	// Exec runs a command in a running container and returns its exit code.
+	Exec(ctx context.Context, id string, opts ExecOptions, streams ExecStreams) (int, error)
+	// CopyFrom returns a tar archive of the file or directory at path in
+	// the container, CopyTo extracts a tar archive into the directory dir.
+	CopyFrom(ctx context.Context, id, path string) (io.ReadCloser, error)
+	CopyTo(ctx context.Context, id, dir string, content io.Reader) error
+}
+
+var ErrNotFound = errors.New("container not found")
+
+var (
+	defaultRuntime Runtime
+	defaultOnce    sync.Once
+)
+
+func New(name string) (Runtime, error) {
+	switch name {
+	case "docker":
+		return NewDocker(), nil
+	case "containerd":
+		return NewContainerd(), nil
+	case "fake":
+		return NewFake(), nil
+	default:
+		return nil, errors.New("unknown runtime " + name)
+	}
+}
+
+// Get returns the runtime selected by conf.Runtime.
+func Get() Runtime {
+	defaultOnce.Do(func() {
+		r, err := New(conf.Runtime)
+		if err != nil {
+			log.Println(err)
+			panic("runtime initialization error")
+		}
+		defaultRuntime = r
+	})
+	return defaultRuntime
+}
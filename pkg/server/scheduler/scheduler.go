@@ -2,12 +2,13 @@ package scheduler
 
 import (
 	"encoding/json"
-	"fmt"
 	"github.com/loqutus/rws/pkg/server/containers"
 	"github.com/loqutus/rws/pkg/server/etcd"
 	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/images"
 	"github.com/loqutus/rws/pkg/server/pods"
 	"log"
+	"strconv"
 	"time"
 )
 
@@ -81,51 +82,79 @@ func Scheduler() {
 			time.Sleep(60 * time.Second)
 			continue
 		}
+		records := make(map[string]int)
+		for _, c := range containersSlice {
+			records[c.Pod]++
+		}
 		for _, p := range podsSlice {
-			log.Println("scheduler: Pod " + p.Name + " should have " + string(p.Count) + " containers")
-			var foundContainers uint64
+			// finish pod_stop and pod_remove that left containers
+			if p.Deleting || (p.Count == 0 && records[p.Name] > 0) {
+				retryTeardown(p)
+				continue
+			}
+			log.Println("scheduler: Pod " + p.Name + " should have " + strconv.FormatUint(p.Count, 10) + " replicas")
+			// replicas running on each host, a replica counts if any of its containers runs
+			replicaHosts := make(map[string]string)
 			for _, h := range hostsSlice {
-				fmt.Println(h.Name)
 				hostRunningContainers, err4 := containers.GetHostContainers(h.Name, h.Port)
 				if err4 != nil {
 					log.Println("scheduler: getHostContainers error")
 					log.Println(err4)
-					time.Sleep(60 * time.Second)
 					continue
 				}
-				for _, podContainer := range p.Containers {
-					for _, hostContainer := range hostRunningContainers {
-						if podContainer.ID == hostContainer.ID {
-							foundContainers += 1
-							continue
-						}
+				for _, hostContainer := range hostRunningContainers {
+					if hostContainer.Pod != p.Name {
+						continue
+					}
+					replica := hostContainer.Replica
+					if replica == "" {
+						replica = hostContainer.Name
 					}
+					replicaHosts[replica] = h.Name
 				}
 			}
-			if foundContainers == p.Count {
+			foundReplicas := uint64(len(replicaHosts))
+			if foundReplicas >= p.Count {
+				updateStatus(p.Name)
 				continue
 			}
-			var containersToRun uint64
-			if foundContainers < p.Count {
-				containersToRun = p.Count - foundContainers
-			} else {
-				containersToRun = foundContainers - p.Count
+			busyHosts := make(map[string]bool)
+			for _, hostName := range replicaHosts {
+				busyHosts[hostName] = true
 			}
-			var i uint64
-			for i = 0; i < containersToRun; i++ {
-				for _, host := range hostsSlice {
-					id, err := containers.RunContainer(p.Image, p.Name, p.Cmd)
-					if err != nil {
-						log.Println("scheduler: RunContainer error")
-						log.Println(err)
-						time.Sleep(60 * time.Second)
-						continue
-					}
-					var c = containers.Container{p.Image, p.Name, p.Disk, p.Memory, p.Cores, host.Name, id, p.Cmd}
-					p.Containers = append(p.Containers, c)
+			replicasToRun := p.Count - foundReplicas
+			var started []containers.Container
+			for _, host := range images.Prefer(hostsSlice, p.Images()) {
+				if replicasToRun == 0 {
+					break
+				}
+				// one replica per host
+				if busyHosts[host.Name] {
+					continue
 				}
+				replica, err := pods.RunReplica(host, p)
+				if err != nil {
+					log.Println("scheduler: RunReplica error")
+					log.Println(err)
+					continue
+				}
+				started = append(started, replica...)
+				replicasToRun -= 1
 			}
-			podMarshalled, err4 := json.Marshal(p)
+			if len(started) == 0 {
+				updateStatus(p.Name)
+				continue
+			}
+			// pod_stop, pod_remove or an update may have changed the
+			// record while the replicas started, the new replicas are
+			// added to the record as it is now
+			current, err6 := pods.GetPod(p.Name)
+			if err6 != nil || current.Deleting || current.Count == 0 {
+				log.Println("scheduler: pod " + p.Name + " was stopped or removed meanwhile")
+				continue
+			}
+			current.Containers = append(current.Containers, started...)
+			podMarshalled, err4 := json.Marshal(current)
 			if err4 != nil {
 				log.Println("scheduler: json.Marshal error")
 				log.Println(err4)
@@ -139,7 +168,32 @@ func Scheduler() {
 				time.Sleep(60 * time.Second)
 				continue
 			}
+			updateStatus(p.Name)
 		}
 		time.Sleep(60 * time.Second)
 	}
 }
+
+func updateStatus(name string) {
+	err := pods.UpdateStatus(name)
+	if err != nil {
+		log.Println("scheduler: UpdateStatus error for pod " + name)
+		log.Println(err)
+	}
+}
+
+func retryTeardown(p pods.Pod) {
+	teardown := pods.StopPod
+	if p.Deleting {
+		teardown = pods.RemovePod
+	}
+	log.Println("scheduler: tearing down pod " + p.Name)
+	r, err := teardown(p.Name)
+	if err == nil {
+		err = r.Err()
+	}
+	if err != nil {
+		log.Println("scheduler: teardown error for pod " + p.Name)
+		log.Println(err)
+	}
+}
@@ -0,0 +1,278 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Secret is a named set of key/value pairs. Data is only ever stored
+// encrypted and is never returned by the list endpoint.
+type Secret struct {
+	Name      string
+	Namespace string
+	Data      map[string]string
+}
+
+// SecretInfo is what secret_list returns: names and keys, no values.
+type SecretInfo struct {
+	Name      string
+	Namespace string
+	Keys      []string
+}
+
+// record is the etcd representation of a Secret, Data is AES-GCM sealed
+// with the key from conf.SecretKeyFile, prefixed by the nonce.
+type record struct {
+	Name      string
+	Namespace string
+	Keys      []string
+	Data      []byte
+}
+
+func key() ([]byte, error) {
+	keyBytes, err := ioutil.ReadFile(conf.SecretKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	k, err2 := hex.DecodeString(strings.TrimSpace(string(keyBytes)))
+	if err2 != nil {
+		return nil, err2
+	}
+	if len(k) != 32 {
+		return nil, errors.New("secret key must be 32 bytes")
+	}
+	return k, nil
+}
+
+func newGCM() (cipher.AEAD, error) {
+	k, err := key()
+	if err != nil {
+		return nil, err
+	}
+	block, err2 := aes.NewCipher(k)
+	if err2 != nil {
+		return nil, err2
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt(name string, plain []byte) ([]byte, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err2 := io.ReadFull(rand.Reader, nonce)
+	if err2 != nil {
+		return nil, err2
+	}
+	// the secret name is authenticated so records can't be swapped
+	return gcm.Seal(nonce, nonce, plain, []byte(name)), nil
+}
+
+func decrypt(name string, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("secret " + name + " is corrupted")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, sealed[gcm.NonceSize():], []byte(name))
+}
+
+// Seal encrypts plain with the cluster secret key for other stores of
+// sensitive data, name is authenticated and must be passed to Open.
+func Seal(name string, plain []byte) ([]byte, error) {
+	return encrypt(name, plain)
+}
+
+func Open(name string, sealed []byte) ([]byte, error) {
+	return decrypt(name, sealed)
+}
+
+func (r record) info() SecretInfo {
+	return SecretInfo{Name: r.Name, Namespace: r.Namespace, Keys: r.Keys}
+}
+
+func AddSecret(s Secret) error {
+	log.Println(1, "AddSecret")
+	if s.Name == "" {
+		return errors.New("secret name required")
+	}
+	if len(s.Data) == 0 {
+		return errors.New("secret data required")
+	}
+	plain, err := json.Marshal(s.Data)
+	if err != nil {
+		return err
+	}
+	sealed, err2 := encrypt(s.Name, plain)
+	if err2 != nil {
+		log.Println(1, "AddSecret: encrypt error")
+		return err2
+	}
+	r := record{Name: s.Name, Namespace: s.Namespace, Data: sealed}
+	for k := range s.Data {
+		r.Keys = append(r.Keys, k)
+	}
+	sort.Strings(r.Keys)
+	b, err3 := json.Marshal(r)
+	if err3 != nil {
+		return err3
+	}
+	err4 := etcd.CreateKey("/rws/secrets/"+s.Name, string(b))
+	if err4 != nil {
+		log.Println(1, "AddSecret: etcd.CreateKey error")
+		return err4
+	}
+	log.Println(1, "AddSecret: secret "+s.Name+" added")
+	return nil
+}
+
+func RemoveSecret(name string) error {
+	log.Println(1, "RemoveSecret")
+	dir, err := etcd.ListDir("/rws/secrets")
+	if err != nil {
+		return err
+	}
+	for _, node := range dir {
+		keySplit := strings.Split(node.Key, "/")
+		keyName := keySplit[len(keySplit)-1]
+		if keyName == name {
+			return etcd.DeleteKey("/rws/secrets/" + name)
+		}
+	}
+	return errors.New("secret not found")
+}
+
+func ListSecrets() ([]SecretInfo, error) {
+	log.Println(1, "ListSecrets")
+	dir, err := etcd.ListDir("/rws/secrets")
+	if err != nil {
+		log.Println(1, "ListSecrets: etcd.ListDir error")
+		return nil, err
+	}
+	var l []SecretInfo
+	for _, node := range dir {
+		var r record
+		err := json.Unmarshal([]byte(node.Value), &r)
+		if err != nil {
+			log.Println(1, "ListSecrets: json.Unmarshal error")
+			return nil, err
+		}
+		l = append(l, r.info())
+	}
+	return l, nil
+}
+
+// GetSecret returns the decrypted secret. It is only used by the agent
+// when starting containers and must not be exposed by any handler.
+func GetSecret(name string) (Secret, error) {
+	recordString, err := etcd.GetKey("/rws/secrets/" + name)
+	if err != nil {
+		return Secret{}, errors.New("secret " + name + " not found")
+	}
+	var r record
+	err2 := json.Unmarshal([]byte(recordString), &r)
+	if err2 != nil {
+		return Secret{}, err2
+	}
+	plain, err3 := decrypt(r.Name, r.Data)
+	if err3 != nil {
+		log.Println(1, "GetSecret: decrypt error")
+		return Secret{}, err3
+	}
+	s := Secret{Name: r.Name, Namespace: r.Namespace}
+	err4 := json.Unmarshal(plain, &s.Data)
+	if err4 != nil {
+		return Secret{}, err4
+	}
+	return s, nil
+}
+
+// Value returns one key of the named secret, checking that a container
+// in namespace is allowed to use it.
+func Value(name, namespace, key string) (string, error) {
+	s, err := GetSecret(name)
+	if err != nil {
+		return "", err
+	}
+	if s.Namespace != "" && s.Namespace != namespace {
+		return "", errors.New("secret " + name + " belongs to namespace " + s.Namespace)
+	}
+	v, ok := s.Data[key]
+	if !ok {
+		return "", errors.New("secret " + name + " has no key " + key)
+	}
+	return v, nil
+}
+
+func SecretAddHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "SecretAddHandler")
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		utils.Fail("SecretAddHandler: request read error", err, w)
+		return
+	}
+	var s Secret
+	err2 := json.Unmarshal(bodyBytes, &s)
+	if err2 != nil {
+		utils.Fail("SecretAddHandler: json.Unmarshal error", err2, w)
+		return
+	}
+	err3 := AddSecret(s)
+	if err3 != nil {
+		utils.Fail("SecretAddHandler: AddSecret error", err3, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func SecretRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "SecretRemoveHandler")
+	var s Secret
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		utils.Fail("SecretRemoveHandler: json decode error", err, w)
+		return
+	}
+	err2 := RemoveSecret(s.Name)
+	if err2 != nil {
+		utils.Fail("SecretRemoveHandler: RemoveSecret error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func SecretListHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println(1, "SecretListHandler")
+	l, err := ListSecrets()
+	if err != nil {
+		utils.Fail("SecretListHandler: ListSecrets error", err, w)
+		return
+	}
+	b, err2 := json.Marshal(l)
+	if err2 != nil {
+		utils.Fail("SecretListHandler: json.Marshal error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
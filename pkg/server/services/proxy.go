@@ -0,0 +1,233 @@
+package services
+
+import (
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pool picks the endpoints of one service port or ingress rule,
+// least-connections counts the connections this agent has open to each
+// of them.
+type Pool struct {
+	mu        sync.Mutex
+	policy    string
+	endpoints []string
+	next      int
+	active    map[string]int
+}
+
+func NewPool() *Pool {
+	return &Pool{active: make(map[string]int)}
+}
+
+// Update replaces the endpoints and the balancer policy.
+func (b *Pool) Update(policy string, endpoints []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.policy = policy
+	b.endpoints = endpoints
+}
+
+// Pick returns an endpoint other than those in skip, Done has to be
+// called with it when the connection or request ends.
+func (b *Pool) Pick(skip map[string]bool) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	best := ""
+	for i := range b.endpoints {
+		addr := b.endpoints[(b.next+i)%len(b.endpoints)]
+		if skip[addr] {
+			continue
+		}
+		if best == "" || (b.policy == BalancerLeastConnections && b.active[addr] < b.active[best]) {
+			best = addr
+		}
+		if b.policy != BalancerLeastConnections {
+			break
+		}
+	}
+	if best == "" {
+		return "", errors.New("no ready endpoints")
+	}
+	b.next++
+	b.active[best]++
+	return best, nil
+}
+
+func (b *Pool) Done(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active[addr]--
+	if b.active[addr] <= 0 {
+		delete(b.active, addr)
+	}
+}
+
+func (b *Pool) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.endpoints)
+}
+
+// listener serves one service port on this host.
+type listener struct {
+	service  string
+	protocol string
+	b        *Pool
+	closer   io.Closer
+}
+
+var listeners = make(map[uint64]*listener)
+
+// serveTCP proxies every connection to an endpoint, the next ones are
+// tried if it can't be reached.
+func serveTCP(l net.Listener, b *Pool) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println(1, "proxy: accept error")
+			log.Println(1, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			skip := make(map[string]bool)
+			for tries := b.size(); tries > 0; tries-- {
+				addr, err := b.Pick(skip)
+				if err != nil {
+					break
+				}
+				upstream, err2 := net.DialTimeout("tcp", addr, 5*time.Second)
+				if err2 != nil {
+					log.Println(1, "proxy: dial error")
+					log.Println(1, err2)
+					b.Done(addr)
+					skip[addr] = true
+					continue
+				}
+				done := make(chan struct{}, 2)
+				go func() {
+					io.Copy(upstream, conn)
+					if tc, ok := upstream.(*net.TCPConn); ok {
+						tc.CloseWrite()
+					}
+					done <- struct{}{}
+				}()
+				io.Copy(conn, upstream)
+				if tc, ok := conn.(*net.TCPConn); ok {
+					tc.CloseWrite()
+				}
+				<-done
+				upstream.Close()
+				b.Done(addr)
+				return
+			}
+		}(conn)
+	}
+}
+
+// httpHandler proxies every request to an endpoint.
+func httpHandler(b *Pool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, err := b.Pick(nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer b.Done(addr)
+		proxy := &httputil.ReverseProxy{Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = addr
+		}}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+func listen(port uint64, protocol string, b *Pool) (io.Closer, error) {
+	l, err := net.Listen("tcp", ":"+strconv.FormatUint(port, 10))
+	if err != nil {
+		return nil, err
+	}
+	if protocol == ProtocolHTTP {
+		srv := &http.Server{Handler: httpHandler(b)}
+		go srv.Serve(l)
+		return srv, nil
+	}
+	go serveTCP(l, b)
+	return l, nil
+}
+
+// syncListeners opens the ports of new services, closes those of
+// removed ones and updates the endpoints of all of them.
+func syncListeners() error {
+	l, err := ListServices()
+	if err != nil {
+		return err
+	}
+	podsList, conts, err2 := Snapshot()
+	if err2 != nil {
+		return err2
+	}
+	wanted := make(map[uint64]bool)
+	for _, s := range l {
+		endpoints := make(map[uint64][]string)
+		for _, e := range s.Resolve(podsList, conts) {
+			endpoints[e.Port] = append(endpoints[e.Port], e.Addr)
+		}
+		for _, p := range s.Ports {
+			wanted[p.Port] = true
+			ln, ok := listeners[p.Port]
+			if ok && (ln.service != s.Name || ln.protocol != p.protocol()) {
+				ln.closer.Close()
+				delete(listeners, p.Port)
+				ok = false
+			}
+			if !ok {
+				b := NewPool()
+				closer, err3 := listen(p.Port, p.protocol(), b)
+				if err3 != nil {
+					log.Println(1, "proxy: listen error for service "+s.Name)
+					log.Println(1, err3)
+					continue
+				}
+				log.Println(1, "proxy: service "+s.Name+" listening on "+strconv.FormatUint(p.Port, 10))
+				ln = &listener{service: s.Name, protocol: p.protocol(), b: b, closer: closer}
+				listeners[p.Port] = ln
+			}
+			ln.b.Update(s.Balancer, endpoints[p.Port])
+		}
+	}
+	for port, ln := range listeners {
+		if !wanted[port] {
+			log.Println(1, "proxy: closing port "+strconv.FormatUint(port, 10)+" of service "+ln.service)
+			ln.closer.Close()
+			delete(listeners, port)
+		}
+	}
+	return nil
+}
+
+// Proxy serves the ports of all services on this host, endpoints follow
+// the containers every conf.ServiceSyncInterval seconds.
+func Proxy() {
+	for {
+		err := syncListeners()
+		if err != nil {
+			log.Println(1, "proxy: sync error")
+			log.Println(1, err)
+		}
+		time.Sleep(conf.ServiceSyncInterval * time.Second)
+	}
+}
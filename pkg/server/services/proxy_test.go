@@ -0,0 +1,101 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestPoolPick(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		endpoints []string
+		// active connections opened before the picks, by endpoint
+		active map[string]int
+		skip   map[string]bool
+		want   []string
+	}{
+		{
+			name:      "round robin",
+			policy:    BalancerRoundRobin,
+			endpoints: []string{"a:1", "b:1", "c:1"},
+			want:      []string{"a:1", "b:1", "c:1", "a:1"},
+		},
+		{
+			name:      "round robin is the default",
+			endpoints: []string{"a:1", "b:1"},
+			want:      []string{"a:1", "b:1", "a:1"},
+		},
+		{
+			name:      "round robin skips",
+			policy:    BalancerRoundRobin,
+			endpoints: []string{"a:1", "b:1", "c:1"},
+			skip:      map[string]bool{"b:1": true},
+			want:      []string{"a:1", "c:1", "c:1", "a:1"},
+		},
+		{
+			name:      "least connections",
+			policy:    BalancerLeastConnections,
+			endpoints: []string{"a:1", "b:1", "c:1"},
+			active:    map[string]int{"a:1": 2, "b:1": 1},
+			want:      []string{"c:1", "b:1", "c:1", "a:1"},
+		},
+		{
+			name:      "least connections skips",
+			policy:    BalancerLeastConnections,
+			endpoints: []string{"a:1", "b:1", "c:1"},
+			active:    map[string]int{"b:1": 1},
+			skip:      map[string]bool{"a:1": true, "c:1": true},
+			want:      []string{"b:1", "b:1"},
+		},
+		{
+			name:      "all skipped",
+			policy:    BalancerRoundRobin,
+			endpoints: []string{"a:1"},
+			skip:      map[string]bool{"a:1": true},
+			want:      []string{""},
+		},
+		{
+			name: "no endpoints",
+			want: []string{""},
+		},
+	}
+	for _, tt := range tests {
+		p := NewPool()
+		p.Update(tt.policy, tt.endpoints)
+		for addr, n := range tt.active {
+			p.active[addr] = n
+		}
+		for i, want := range tt.want {
+			got, err := p.Pick(tt.skip)
+			if want == "" {
+				if err == nil {
+					t.Errorf("%s: pick %d got %s, want an error", tt.name, i, got)
+				}
+				continue
+			}
+			if err != nil || got != want {
+				t.Errorf("%s: pick %d got %q, %v, want %q", tt.name, i, got, err, want)
+			}
+		}
+	}
+}
+
+func TestPoolDone(t *testing.T) {
+	p := NewPool()
+	p.Update(BalancerLeastConnections, []string{"a:1", "b:1"})
+	a, _ := p.Pick(nil)
+	b, _ := p.Pick(nil)
+	if a == b {
+		t.Fatalf("least connections picked %s twice", a)
+	}
+	p.Done(a)
+	got, _ := p.Pick(nil)
+	if got != a {
+		t.Errorf("got %s after closing it, want %s", got, a)
+	}
+	p.Done(got)
+	p.Done(b)
+	if len(p.active) != 0 {
+		t.Errorf("connections left after Done: %v", p.active)
+	}
+}
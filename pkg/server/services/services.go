@@ -0,0 +1,394 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/conf"
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/pods"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Balancers pick the endpoint of a new connection or HTTP request.
+const (
+	BalancerRoundRobin       = "round-robin"
+	BalancerLeastConnections = "least-connections"
+)
+
+// Protocols of service ports. HTTP ports balance every request, TCP
+// ports every connection.
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolHTTP = "http"
+)
+
+// Service gets Ports on every host that are proxied to the ready
+// containers of the pod named Pod, or of the pods whose Labels have all
+// of Selector, in the service's Namespace.
+type Service struct {
+	Name      string
+	Namespace string
+	Owner     string
+	Pod       string
+	Selector  map[string]string
+	Ports     []ServicePort
+	Balancer  string
+	// Endpoints is filled in by service_list, it isn't stored.
+	Endpoints []Endpoint
+}
+
+// ServicePort proxies Port on every host to ContainerPort, which the
+// containers have to publish. Port is allocated when it is 0.
+type ServicePort struct {
+	Port          uint64
+	ContainerPort uint64
+	Protocol      string
+}
+
+// Endpoint is a ready container a service Port is proxied to, Addr is
+// its published host:port.
+type Endpoint struct {
+	Port      uint64
+	Addr      string
+	Container string
+}
+
+func (p ServicePort) protocol() string {
+	if p.Protocol == "" {
+		return ProtocolTCP
+	}
+	return p.Protocol
+}
+
+func (s Service) validate() error {
+	if s.Name == "" {
+		return errors.New("service name required")
+	}
+	if s.Pod == "" && len(s.Selector) == 0 {
+		return errors.New("service " + s.Name + " needs a Pod or a Selector")
+	}
+	if len(s.Ports) == 0 {
+		return errors.New("service " + s.Name + " needs Ports")
+	}
+	switch s.Balancer {
+	case "", BalancerRoundRobin, BalancerLeastConnections:
+	default:
+		return errors.New("unknown balancer " + s.Balancer)
+	}
+	for _, p := range s.Ports {
+		if p.ContainerPort == 0 {
+			return errors.New("service " + s.Name + " ports need a ContainerPort")
+		}
+		switch p.protocol() {
+		case ProtocolTCP, ProtocolHTTP:
+		default:
+			return errors.New("unknown service protocol " + p.Protocol)
+		}
+	}
+	return nil
+}
+
+// KeepPorts gives the ports of desired without a Port the port allocated
+// to the same ContainerPort and Protocol in current.
+func KeepPorts(current, desired Service) Service {
+	ports := make([]ServicePort, len(desired.Ports))
+	copy(ports, desired.Ports)
+	for i, p := range ports {
+		if p.Port != 0 {
+			continue
+		}
+		for _, old := range current.Ports {
+			if old.ContainerPort == p.ContainerPort && old.protocol() == p.protocol() {
+				ports[i].Port = old.Port
+			}
+		}
+	}
+	desired.Ports = ports
+	return desired
+}
+
+// allocatePorts checks that the ports of s aren't used by the other
+// services in l and allocates the missing ones from conf.ServicePortMin
+// to conf.ServicePortMax.
+func allocatePorts(s *Service, l []Service) error {
+	used := make(map[uint64]string)
+	for _, other := range l {
+		if other.Name == s.Name {
+			continue
+		}
+		for _, p := range other.Ports {
+			used[p.Port] = other.Name
+		}
+	}
+	for _, p := range s.Ports {
+		if p.Port == 0 {
+			continue
+		}
+		if owner, ok := used[p.Port]; ok {
+			return errors.New("port " + strconv.FormatUint(p.Port, 10) + " is used by service " + owner)
+		}
+		used[p.Port] = s.Name
+	}
+	next := uint64(conf.ServicePortMin)
+	for i := range s.Ports {
+		if s.Ports[i].Port != 0 {
+			continue
+		}
+		for next <= conf.ServicePortMax && used[next] != "" {
+			next++
+		}
+		if next > conf.ServicePortMax {
+			return errors.New("no free service ports left")
+		}
+		s.Ports[i].Port = next
+		used[next] = s.Name
+	}
+	return nil
+}
+
+func save(s Service, create bool) error {
+	err := s.validate()
+	if err != nil {
+		return err
+	}
+	l, err2 := ListServices()
+	if err2 != nil {
+		return err2
+	}
+	err3 := allocatePorts(&s, l)
+	if err3 != nil {
+		return err3
+	}
+	s.Endpoints = nil
+	b, err4 := json.Marshal(s)
+	if err4 != nil {
+		return err4
+	}
+	if create {
+		return etcd.CreateKey("/rws/services/"+s.Name, string(b))
+	}
+	return etcd.SetKey("/rws/services/"+s.Name, string(b))
+}
+
+// sameOwner rejects changes to the service current from another
+// namespace or owner, service names are unique across namespaces.
+func sameOwner(current, s Service) error {
+	if current.Namespace != s.Namespace || current.Owner != s.Owner {
+		return errors.New("service " + current.Name + " exists in namespace " + current.Namespace + " of owner " + current.Owner)
+	}
+	return nil
+}
+
+func AddService(s Service) error {
+	log.Println(1, "AddService")
+	current, err := GetService(s.Name)
+	if err == nil {
+		return errors.New("service " + s.Name + " exists in namespace " + current.Namespace)
+	}
+	return save(s, true)
+}
+
+// UpdateService replaces the service, ports without a Port keep theirs.
+func UpdateService(s Service) error {
+	log.Println(1, "UpdateService")
+	current, err := GetService(s.Name)
+	if err != nil {
+		return err
+	}
+	err2 := sameOwner(current, s)
+	if err2 != nil {
+		return err2
+	}
+	return save(KeepPorts(current, s), false)
+}
+
+func GetService(name string) (Service, error) {
+	serviceString, err := etcd.GetKey("/rws/services/" + name)
+	if err != nil {
+		return Service{}, errors.New("service " + name + " not found")
+	}
+	var s Service
+	err2 := json.Unmarshal([]byte(serviceString), &s)
+	return s, err2
+}
+
+func RemoveService(name string) error {
+	log.Println(1, "RemoveService")
+	_, err := GetService(name)
+	if err != nil {
+		return err
+	}
+	return etcd.DeleteKey("/rws/services/" + name)
+}
+
+func ListServices() ([]Service, error) {
+	dir, err := etcd.ListDir("/rws/services")
+	if err != nil {
+		return nil, err
+	}
+	var l []Service
+	for _, node := range dir {
+		var s Service
+		err := json.Unmarshal([]byte(node.Value), &s)
+		if err != nil {
+			log.Println(1, "ListServices: json.Unmarshal error")
+			return nil, err
+		}
+		l = append(l, s)
+	}
+	return l, nil
+}
+
+// selects reports whether the service proxies to the pod.
+func (s Service) selects(p pods.Pod) bool {
+	if p.Namespace != s.Namespace {
+		return false
+	}
+	if s.Pod != "" && p.Name != s.Pod {
+		return false
+	}
+	for k, v := range s.Selector {
+		if p.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve returns the ready containers of the selected pods that
+// publish the container ports of the service.
+func (s Service) Resolve(podsList []pods.Pod, conts []containers.Container) []Endpoint {
+	selected := make(map[string]bool)
+	for _, p := range podsList {
+		if s.selects(p) {
+			selected[p.Name] = true
+		}
+	}
+	var result []Endpoint
+	for _, c := range conts {
+		if !selected[c.Pod] || c.Init || c.State != "running" || !c.Ready {
+			continue
+		}
+		host := strings.Split(c.Host, ":")[0]
+		for _, sp := range s.Ports {
+			for _, cp := range c.Ports {
+				if cp.ContainerPort != sp.ContainerPort || cp.HostPort == 0 || (cp.Protocol != "" && cp.Protocol != "tcp") {
+					continue
+				}
+				result = append(result, Endpoint{
+					Port:      sp.Port,
+					Addr:      host + ":" + strconv.FormatUint(cp.HostPort, 10),
+					Container: c.Name,
+				})
+			}
+		}
+	}
+	return result
+}
+
+// Snapshot reads the pods and containers services select from.
+func Snapshot() ([]pods.Pod, []containers.Container, error) {
+	podsDir, err := etcd.ListDir("/rws/pods")
+	if err != nil {
+		return nil, nil, err
+	}
+	var podsList []pods.Pod
+	for _, node := range podsDir {
+		var p pods.Pod
+		if json.Unmarshal([]byte(node.Value), &p) == nil {
+			podsList = append(podsList, p)
+		}
+	}
+	containersDir, err2 := etcd.ListDir("/rws/containers")
+	if err2 != nil {
+		return nil, nil, err2
+	}
+	var conts []containers.Container
+	for _, node := range containersDir {
+		var c containers.Container
+		if json.Unmarshal([]byte(node.Value), &c) == nil {
+			conts = append(conts, c)
+		}
+	}
+	return podsList, conts, nil
+}
+
+func ServiceAddHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "ServiceAddHandler")
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		utils.Fail("ServiceAddHandler: request read error", err, w)
+		return
+	}
+	var s Service
+	err2 := json.Unmarshal(bodyBytes, &s)
+	if err2 != nil {
+		utils.Fail("ServiceAddHandler: json.Unmarshal error", err2, w)
+		return
+	}
+	err3 := AddService(s)
+	if err3 != nil {
+		utils.Fail("ServiceAddHandler: AddService error", err3, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func ServiceRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(1, "ServiceRemoveHandler")
+	var s Service
+	err := json.NewDecoder(r.Body).Decode(&s)
+	if err != nil {
+		utils.Fail("ServiceRemoveHandler: json decode error", err, w)
+		return
+	}
+	current, err2 := GetService(s.Name)
+	if err2 != nil {
+		utils.Fail("ServiceRemoveHandler: GetService error", err2, w)
+		return
+	}
+	err3 := sameOwner(current, s)
+	if err3 != nil {
+		utils.Fail("ServiceRemoveHandler: namespace or owner mismatch", err3, w)
+		return
+	}
+	err4 := RemoveService(s.Name)
+	if err4 != nil {
+		utils.Fail("ServiceRemoveHandler: RemoveService error", err4, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// ServiceListHandler lists the services with their current endpoints.
+func ServiceListHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println(1, "ServiceListHandler")
+	l, err := ListServices()
+	if err != nil {
+		utils.Fail("ServiceListHandler: ListServices error", err, w)
+		return
+	}
+	podsList, conts, err2 := Snapshot()
+	if err2 != nil {
+		utils.Fail("ServiceListHandler: etcd.ListDir error", err2, w)
+		return
+	}
+	for i := range l {
+		l[i].Endpoints = l[i].Resolve(podsList, conts)
+	}
+	b, err3 := json.Marshal(l)
+	if err3 != nil {
+		utils.Fail("ServiceListHandler: json.Marshal error", err3, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/pods"
+	"reflect"
+	"testing"
+)
+
+func TestKeepPorts(t *testing.T) {
+	current := Service{Ports: []ServicePort{
+		{Port: 29000, ContainerPort: 80},
+		{Port: 29001, ContainerPort: 443, Protocol: ProtocolTCP},
+		{Port: 29002, ContainerPort: 8080, Protocol: ProtocolHTTP},
+	}}
+	tests := []struct {
+		name    string
+		desired []ServicePort
+		want    []ServicePort
+	}{
+		{
+			name:    "allocated port kept",
+			desired: []ServicePort{{ContainerPort: 80}},
+			want:    []ServicePort{{Port: 29000, ContainerPort: 80}},
+		},
+		{
+			name:    "empty protocol is tcp",
+			desired: []ServicePort{{ContainerPort: 443}},
+			want:    []ServicePort{{Port: 29001, ContainerPort: 443}},
+		},
+		{
+			name:    "explicit port wins",
+			desired: []ServicePort{{Port: 29500, ContainerPort: 80}},
+			want:    []ServicePort{{Port: 29500, ContainerPort: 80}},
+		},
+		{
+			name:    "other protocol gets a new port",
+			desired: []ServicePort{{ContainerPort: 8080}},
+			want:    []ServicePort{{ContainerPort: 8080}},
+		},
+		{
+			name:    "new container port",
+			desired: []ServicePort{{ContainerPort: 9090}},
+			want:    []ServicePort{{ContainerPort: 9090}},
+		},
+	}
+	for _, tt := range tests {
+		desired := Service{Ports: tt.desired}
+		got := KeepPorts(current, desired)
+		if !reflect.DeepEqual(got.Ports, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got.Ports, tt.want)
+		}
+		if desired.Ports[0].Port != tt.desired[0].Port {
+			t.Errorf("%s: desired ports were changed", tt.name)
+		}
+	}
+}
+
+func TestAllocatePorts(t *testing.T) {
+	others := []Service{
+		{Name: "db", Ports: []ServicePort{{Port: 29000}, {Port: 29002}}},
+		{Name: "web", Ports: []ServicePort{{Port: 29001}}},
+	}
+	tests := []struct {
+		name  string
+		ports []ServicePort
+		want  []uint64
+		fails bool
+	}{
+		{
+			name:  "free ports in order",
+			ports: []ServicePort{{ContainerPort: 80}, {ContainerPort: 443}},
+			want:  []uint64{29003, 29004},
+		},
+		{
+			name:  "explicit port is skipped",
+			ports: []ServicePort{{ContainerPort: 80}, {Port: 29003, ContainerPort: 443}},
+			want:  []uint64{29004, 29003},
+		},
+		{
+			name:  "port of another service",
+			ports: []ServicePort{{Port: 29001, ContainerPort: 80}},
+			fails: true,
+		},
+		{
+			name:  "same port twice",
+			ports: []ServicePort{{Port: 29100, ContainerPort: 80}, {Port: 29100, ContainerPort: 443}},
+			fails: true,
+		},
+	}
+	for _, tt := range tests {
+		s := Service{Name: "api", Ports: tt.ports}
+		err := allocatePorts(&s, others)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s: got ports %v, want an error", tt.name, s.Ports)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []uint64
+		for _, p := range s.Ports {
+			got = append(got, p.Port)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// the service's own ports can be reused on update
+	s := Service{Name: "web", Ports: []ServicePort{{Port: 29001, ContainerPort: 80}}}
+	if err := allocatePorts(&s, others); err != nil {
+		t.Errorf("own port: %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	podsList := []pods.Pod{
+		{Name: "web", Namespace: "prod", Labels: map[string]string{"app": "web", "tier": "front"}},
+		{Name: "web-canary", Namespace: "prod", Labels: map[string]string{"app": "web"}},
+		{Name: "web-dev", Namespace: "dev", Labels: map[string]string{"app": "web"}},
+	}
+	port := func(container, host uint64) []containers.Port {
+		return []containers.Port{{ContainerPort: container, HostPort: host}}
+	}
+	conts := []containers.Container{
+		{Name: "web-0", Pod: "web", Host: "pi1:8888", State: "running", Ready: true, Ports: port(80, 30001)},
+		{Name: "web-1", Pod: "web", Host: "pi2:8888", State: "running", Ready: false, Ports: port(80, 30002)},
+		{Name: "web-2", Pod: "web", Host: "pi3:8888", State: "exited", Ready: true, Ports: port(80, 30003)},
+		{Name: "web-init", Pod: "web", Host: "pi1:8888", State: "running", Ready: true, Init: true, Ports: port(80, 30004)},
+		{Name: "web-3", Pod: "web", Host: "pi1:8888", State: "running", Ready: true, Ports: port(8080, 30005)},
+		{Name: "web-udp", Pod: "web", Host: "pi1:8888", State: "running", Ready: true,
+			Ports: []containers.Port{{ContainerPort: 80, HostPort: 30006, Protocol: "udp"}}},
+		{Name: "canary-0", Pod: "web-canary", Host: "pi2:8888", State: "running", Ready: true, Ports: port(80, 30007)},
+		{Name: "dev-0", Pod: "web-dev", Host: "pi2:8888", State: "running", Ready: true, Ports: port(80, 30008)},
+	}
+	tests := []struct {
+		name string
+		s    Service
+		want []string
+	}{
+		{
+			name: "by pod",
+			s:    Service{Namespace: "prod", Pod: "web"},
+			want: []string{"web-0 pi1:30001"},
+		},
+		{
+			name: "by selector",
+			s:    Service{Namespace: "prod", Selector: map[string]string{"app": "web"}},
+			want: []string{"web-0 pi1:30001", "canary-0 pi2:30007"},
+		},
+		{
+			name: "selector needs every label",
+			s:    Service{Namespace: "prod", Selector: map[string]string{"app": "web", "tier": "front"}},
+			want: []string{"web-0 pi1:30001"},
+		},
+		{
+			name: "other namespace",
+			s:    Service{Namespace: "test", Pod: "web"},
+		},
+	}
+	for _, tt := range tests {
+		tt.s.Ports = []ServicePort{{Port: 29000, ContainerPort: 80}}
+		var got []string
+		for _, e := range tt.s.Resolve(podsList, conts) {
+			if e.Port != 29000 {
+				t.Errorf("%s: endpoint %v of another port", tt.name, e)
+			}
+			got = append(got, e.Container+" "+e.Addr)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,27 +1,32 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/loqutus/rws/pkg/server/conf"
 	"github.com/loqutus/rws/pkg/server/etcd"
 	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/quotas"
 	"github.com/loqutus/rws/pkg/server/utils"
 	"github.com/shirou/gopsutil/disk"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 )
 
 type File struct {
-	Name     string
-	Host     string
-	Size     uint64
-	Replicas uint64
+	Name      string
+	Host      string
+	Size      uint64
+	Replicas  uint64
+	Namespace string
+	Owner     string
 }
 
 func GetFileNameFromPath(p string) string {
@@ -30,19 +35,31 @@ func GetFileNameFromPath(p string) string {
 	return fileName
 }
 
+// validName reports whether name can be stored in conf.DataDir without
+// clashing with the directory of container state.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && name != conf.StateDir
+}
+
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println(1, "storage.UploadHandler")
 	fileName := GetFileNameFromPath(r.URL.Path)
 	log.Println(1, "storage.UploadHandler: "+fileName)
+	if !validName(fileName) {
+		utils.Fail("storage.UploadHandler: invalid file name "+fileName, errors.New("invalid file name"), w)
+		return
+	}
 	dir, err := etcd.ListDir("/rws/storage")
 	if err != nil {
 		utils.Fail("storage.UploadHandler: EtcdListDir error", err, w)
 	}
 	var found = false
+	var existing File
 	for _, file := range dir {
 		keyName := GetFileNameFromPath(file.Key)
 		if keyName == fileName {
 			found = true
+			json.Unmarshal([]byte(file.Value), &existing)
 			break
 		}
 	}
@@ -51,35 +68,64 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		utils.Fail("storage.UploadHandler: request reading error", err, w)
 		return
 	}
+	// an existing file is overwritten on the host that holds it
+	if found && existing.Host != "" && !hosts.IsLocal(existing.Host) {
+		err10 := forwardUpload(existing.Host, fileName, r.URL.RawQuery, body)
+		if err10 != nil {
+			utils.Fail("storage.UploadHandler: upload to "+existing.Host+" error", err10, w)
+			return
+		}
+		log.Println(1, "storage.UploadHandler: "+fileName+" uploaded to "+existing.Host)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+		return
+	}
 	FileSize := len(body)
 	FilePathName := conf.DataDir + "/" + fileName
+	namespace := r.URL.Query().Get("namespace")
+	owner := r.URL.Query().Get("owner")
+	var previous uint64
+	if found && existing.Namespace == namespace && existing.Owner == owner {
+		previous = existing.Size
+	}
+	err9 := quotas.Check(namespace, owner, quotas.Usage{Storage: growth(previous, uint64(FileSize))})
+	if err9 != nil {
+		utils.Forbidden("storage.UploadHandler: quota check failed", err9, w)
+		return
+	}
 	di, err2 := disk.Usage("/")
 	if err2 != nil {
 		utils.Fail("storage.UploadHandler: disk usage get error", err2, w)
 		return
 	}
 	if di.Free > uint64(FileSize) {
-		if found == true {
-			err := os.Remove(fileName)
-			if err != nil {
-				utils.Fail("storage.UploadHandler: file remove error", err, w)
-				return
-			}
-		}
 		err3 := ioutil.WriteFile(FilePathName, []byte(body), 0644)
 		if err3 != nil {
 			utils.Fail("storage.UploadHandler: file write error", err3, w)
 			return
 		}
-		f := File{fileName, conf.LocalHostName, uint64(FileSize), 1}
+		f := File{
+			Name:      fileName,
+			Host:      localHost(),
+			Size:      uint64(FileSize),
+			Replicas:  1,
+			Namespace: namespace,
+			Owner:     owner,
+		}
 		fileBytes, err7 := json.Marshal(f)
 		if err7 != nil {
 			utils.Fail("storage.UploadHandler: json.Marshal error", err7, w)
 			return
 		}
-		err8 := etcd.CreateKey("/rws/storage/"+fileName, string(fileBytes))
+		// an upload of an existing file overwrites it
+		var err8 error
+		if found == true {
+			err8 = etcd.SetKey("/rws/storage/"+fileName, string(fileBytes))
+		} else {
+			err8 = etcd.CreateKey("/rws/storage/"+fileName, string(fileBytes))
+		}
 		if err8 != nil {
-			utils.Fail("storage.UploadHandler: etcdCreateKey error", err8, w)
+			utils.Fail("storage.UploadHandler: etcd key write error", err8, w)
 			return
 		}
 		log.Println(1, "storage.UploadHandler: file "+FilePathName+" uploaded")
@@ -117,7 +163,7 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			if uint64(FileSize) < thatHost.Disk {
 				log.Println(1, "storage.UploadHandler: uploading to "+host.Name)
-				url := fmt.Sprintf("%s/storage_upload/%s", host.Name, FilePathName)
+				url := fmt.Sprintf("%s/storage_upload/%s?%s", host.Name, FilePathName, r.URL.RawQuery)
 				dat, err6 := http.Post(url, "application/octet-stream", r.Body)
 				if err6 != nil {
 					log.Println("StorageUploadHandle: post error: " + url)
@@ -144,6 +190,29 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// growth is how much a file grows when it is overwritten, which is what
+// has to fit in the quota.
+func growth(previous, size uint64) uint64 {
+	if size < previous {
+		return 0
+	}
+	return size - previous
+}
+
+// forwardUpload uploads the file to the storage_upload of host.
+func forwardUpload(host, name, rawQuery string, data []byte) error {
+	uploadURL := "http://" + hosts.Addr(host) + "/storage_upload/" + name + "?" + rawQuery
+	resp, err := http.Post(uploadURL, "application/octet-stream", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(host + " returned " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
 func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println(1, "DownloadHandler")
 	fileName := GetFileNameFromPath(r.URL.Path)
@@ -176,8 +245,8 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		utils.Fail("DownloadHandler: json.Unmarshal error", err10, w)
 		return
 	}
-	if file.Host == conf.LocalHostName {
-		dat, err1 := ioutil.ReadFile("data/" + fileName)
+	if hosts.IsLocal(file.Host) {
+		dat, err1 := ioutil.ReadFile(conf.DataDir + "/" + fileName)
 		if err1 != nil {
 			utils.Fail("DownloadHandler: file read error", err1, w)
 			return
@@ -191,7 +260,7 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 		log.Println(1, "DownloadHandler: file "+fileName+" downloaded")
 		return
 	} else {
-		url := "http://" + file.Host + "/storage_download/" + file.Name
+		url := "http://" + hosts.Addr(file.Host) + "/storage_download/" + file.Name
 		body, err3 := http.Get(url)
 		if err3 != nil {
 			utils.Fail("DownloadHandler: file get error", err3, w)
@@ -243,8 +312,8 @@ func RemoveHandler(w http.ResponseWriter, r *http.Request) {
 		utils.Fail("RemoveHandler: json.Unmarshal error", err3, w)
 		return
 	}
-	if file.Host == conf.LocalHostName {
-		err := os.Remove("data/" + fileName)
+	if hosts.IsLocal(file.Host) {
+		err := os.Remove(conf.DataDir + "/" + fileName)
 		if err != nil {
 			utils.Fail("RemoveHandler: file remove error", err, w)
 			return
@@ -253,7 +322,7 @@ func RemoveHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	} else {
-		url := "http://" + file.Host + "/storage_remove/" + fileName
+		url := "http://" + hosts.Addr(file.Host) + "/storage_remove/" + fileName
 		resp, err3 := http.Get(url)
 		if err3 != nil {
 			utils.Fail("RemoveHandler: file remove get error", err3, w)
@@ -380,3 +449,102 @@ func GetFileSize(filename, host, port string) (uint64, error) {
 	}
 	return uint64(i), nil
 }
+
+// localHost is the name files stored on this host are recorded under.
+func localHost() string {
+	name, err := hosts.LocalName()
+	if err != nil {
+		return conf.LocalHostName
+	}
+	return name
+}
+
+func GetFile(name string) (File, error) {
+	fileString, err := etcd.GetKey("/rws/storage/" + name)
+	if err != nil {
+		return File{}, errors.New("file " + name + " not found")
+	}
+	var f File
+	err2 := json.Unmarshal([]byte(fileString), &f)
+	if err2 != nil {
+		return File{}, err2
+	}
+	return f, nil
+}
+
+// Fetch returns the contents of a stored file from whichever host holds it.
+func Fetch(name string) ([]byte, error) {
+	log.Println(1, "Fetch: "+name)
+	f, err := GetFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if hosts.IsLocal(f.Host) {
+		return ioutil.ReadFile(conf.DataDir + "/" + name)
+	}
+	resp, err2 := http.Get("http://" + hosts.Addr(f.Host) + "/storage_download/" + name)
+	if err2 != nil {
+		return nil, err2
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Fetch: " + f.Host + " returned " + strconv.Itoa(resp.StatusCode))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Store overwrites a stored file on the host that holds it.
+func Store(name string, data []byte) error {
+	log.Println(1, "Store: "+name)
+	f, err := GetFile(name)
+	if err != nil {
+		return err
+	}
+	if hosts.IsLocal(f.Host) {
+		err5 := quotas.Check(f.Namespace, f.Owner, quotas.Usage{Storage: growth(f.Size, uint64(len(data)))})
+		if err5 != nil {
+			return err5
+		}
+		err2 := ioutil.WriteFile(conf.DataDir+"/"+name, data, 0644)
+		if err2 != nil {
+			return err2
+		}
+		f.Size = uint64(len(data))
+		fileBytes, err3 := json.Marshal(f)
+		if err3 != nil {
+			return err3
+		}
+		return etcd.SetKey("/rws/storage/"+name, string(fileBytes))
+	}
+	q := url.Values{}
+	q.Set("namespace", f.Namespace)
+	q.Set("owner", f.Owner)
+	err4 := forwardUpload(f.Host, name, q.Encode(), data)
+	if err4 != nil {
+		return errors.New("Store: " + err4.Error())
+	}
+	return nil
+}
+
+// Put stores data as the file name, overwriting it if it exists and
+// uploading it through this host's storage_upload otherwise.
+func Put(name, namespace, owner string, data []byte) error {
+	log.Println(1, "Put: "+name)
+	_, err := GetFile(name)
+	if err == nil {
+		return Store(name, data)
+	}
+	q := url.Values{}
+	q.Set("namespace", namespace)
+	q.Set("owner", owner)
+	uploadURL := "http://" + conf.LocalHostName + "/storage_upload/" + name + "?" + q.Encode()
+	resp, err2 := http.Post(uploadURL, "application/octet-stream", bytes.NewBuffer(data))
+	if err2 != nil {
+		return err2
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Put: storage_upload returned " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package top
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/loqutus/rws/pkg/server/containers"
+	"github.com/loqutus/rws/pkg/server/etcd"
+	"github.com/loqutus/rws/pkg/server/hosts"
+	"github.com/loqutus/rws/pkg/server/pods"
+	"github.com/loqutus/rws/pkg/server/utils"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// HostUsage is the usage of one host and the number of containers it
+// runs. Error is set when the host couldn't be reached.
+type HostUsage struct {
+	hosts.HostStats
+	Containers int
+	Error      string
+}
+
+// PodUsage sums the usage of the containers of a pod over all hosts.
+type PodUsage struct {
+	Name        string
+	Namespace   string
+	Containers  int
+	CPUPercent  float64
+	MemoryUsage uint64
+	NetworkRx   uint64
+	NetworkTx   uint64
+	BlockRead   uint64
+	BlockWrite  uint64
+}
+
+// Top is the cluster wide usage, pods and containers sorted by CPU.
+type Top struct {
+	Hosts      []HostUsage
+	Pods       []PodUsage
+	Containers []containers.ContainerStats
+}
+
+func getHostStats(addr string) (hosts.HostStats, error) {
+	resp, err := http.Get("http://" + addr + "/host_stats")
+	if err != nil {
+		return hosts.HostStats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return hosts.HostStats{}, errors.New("host_stats: " + addr + " returned " + strconv.Itoa(resp.StatusCode))
+	}
+	var s hosts.HostStats
+	err2 := json.NewDecoder(resp.Body).Decode(&s)
+	return s, err2
+}
+
+// podsByContainer maps container IDs to the pods that created them.
+func podsByContainer() (map[string]pods.Pod, error) {
+	dir, err := etcd.ListDir("/rws/pods")
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]pods.Pod)
+	for _, node := range dir {
+		var p pods.Pod
+		err := json.Unmarshal([]byte(node.Value), &p)
+		if err != nil {
+			log.Println(1, "podsByContainer: json.Unmarshal error")
+			log.Println(1, err)
+			continue
+		}
+		for _, c := range p.Containers {
+			result[c.ID] = p
+		}
+	}
+	return result, nil
+}
+
+// Collect asks every host for its own and its containers' usage.
+func Collect() (Top, error) {
+	dir, err := etcd.ListDir("/rws/hosts")
+	if err != nil {
+		return Top{}, err
+	}
+	var t Top
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range dir {
+		var h hosts.Host
+		err := json.Unmarshal([]byte(node.Value), &h)
+		if err != nil {
+			log.Println(1, "Collect: json.Unmarshal error")
+			log.Println(1, err)
+			continue
+		}
+		wg.Add(1)
+		go func(h hosts.Host) {
+			defer wg.Done()
+			addr := h.Name + ":" + strconv.FormatUint(h.Port, 10)
+			usage := HostUsage{HostStats: hosts.HostStats{Name: h.Name}}
+			s, err := getHostStats(addr)
+			var l []containers.ContainerStats
+			if err == nil {
+				usage.HostStats = s
+				l, err = containers.HostStats(addr)
+			}
+			if err != nil {
+				log.Println(1, "Collect: stats error for host "+h.Name)
+				log.Println(1, err)
+				usage.Error = err.Error()
+			}
+			usage.Containers = len(l)
+			mu.Lock()
+			t.Hosts = append(t.Hosts, usage)
+			t.Containers = append(t.Containers, l...)
+			mu.Unlock()
+		}(h)
+	}
+	wg.Wait()
+	owners, err2 := podsByContainer()
+	if err2 != nil {
+		return Top{}, err2
+	}
+	podUsage := make(map[string]*PodUsage)
+	for _, c := range t.Containers {
+		p, ok := owners[c.ID]
+		if !ok {
+			continue
+		}
+		u, ok := podUsage[p.Name]
+		if !ok {
+			u = &PodUsage{Name: p.Name, Namespace: p.Namespace}
+			podUsage[p.Name] = u
+		}
+		u.Containers += 1
+		u.CPUPercent += c.CPUPercent
+		u.MemoryUsage += c.MemoryUsage
+		u.NetworkRx += c.NetworkRx
+		u.NetworkTx += c.NetworkTx
+		u.BlockRead += c.BlockRead
+		u.BlockWrite += c.BlockWrite
+	}
+	for _, u := range podUsage {
+		t.Pods = append(t.Pods, *u)
+	}
+	sort.Slice(t.Hosts, func(i, j int) bool { return t.Hosts[i].Name < t.Hosts[j].Name })
+	sort.Slice(t.Pods, func(i, j int) bool { return t.Pods[i].CPUPercent > t.Pods[j].CPUPercent })
+	sort.Slice(t.Containers, func(i, j int) bool { return t.Containers[i].CPUPercent > t.Containers[j].CPUPercent })
+	return t, nil
+}
+
+func TopHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println(1, "TopHandler")
+	t, err := Collect()
+	if err != nil {
+		utils.Fail("TopHandler: Collect error", err, w)
+		return
+	}
+	b, err2 := json.Marshal(t)
+	if err2 != nil {
+		utils.Fail("TopHandler: json.Marshal error", err2, w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
@@ -24,3 +24,14 @@ func Fail(str string, err error, w http.ResponseWriter) {
 	}
 	w.WriteHeader(500)
 }
+
+func Forbidden(str string, err error, w http.ResponseWriter) {
+	log.Println(1, str)
+	log.Println(1, err.Error())
+	w.WriteHeader(http.StatusForbidden)
+	_, err2 := w.Write([]byte(str + ": " + err.Error()))
+	if err2 != nil {
+		fmt.Println("response write error")
+		log.Println(err2)
+	}
+}
@@ -10,14 +10,15 @@ import (
 )
 
 type WebContainer struct {
-	Image  string
-	Name   string
-	Disk   string
-	Memory string
-	Cores  uint64
-	Host   string
-	ID     string
-	Cmd    string
+	Image     string
+	Name      string
+	Disk      string
+	Memory    string
+	Cores     uint64
+	Host      string
+	ID        string
+	Cmd       string
+	Endpoints string
 }
 
 type WebContainersInfo struct {
@@ -40,7 +41,12 @@ func ContainersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	var WC WebContainersInfo
 	for _, c := range cnts {
-		WC.Containers = append(WC.Containers, WebContainer{Name: c.Name, Image: c.Image, Disk: ByteCountBinary(c.Disk), Memory: ByteCountBinary(c.Memory), Cores: c.Cores, Host: c.Host, ID: c.ID[0:5], Cmd: strings.Join(c.Cmd, " ")})
+		// records still pulling their image have no ID yet
+		id := c.ID
+		if len(id) >= 5 {
+			id = id[0:5]
+		}
+		WC.Containers = append(WC.Containers, WebContainer{Name: c.Name, Image: c.Image, Disk: ByteCountBinary(c.Disk), Memory: ByteCountBinary(c.Memory), Cores: c.Cores, Host: c.Host, ID: id, Cmd: strings.Join(c.Cmd, " "), Endpoints: strings.Join(c.Endpoints, " ")})
 	}
 	tmpl := template.New("containers")
 	tmpl, err = tmpl.ParseFiles("/web/containers.html", "/web/inc/header.html", "/web/inc/navbar.html")
@@ -9,6 +9,7 @@ docker tag rws loqutus/rws
 docker push loqutus/rws
 docker container prune -f
 cd deployments
+[ -f secret.key ] || openssl rand -hex 32 > secret.key
 docker-compose -f docker-compose.yml down --remove-orphans
 docker-compose -f docker-compose-etcd.yml down --remove-orphans
 docker-compose -f docker-compose-etcd.yml up -d
@@ -17,9 +18,16 @@ etcdctl mkdir /rws/hosts
 etcdctl mkdir /rws/pods
 etcdctl mkdir /rws/containers
 etcdctl mkdir /rws/storage
+etcdctl mkdir /rws/quotas
+etcdctl mkdir /rws/secrets
+etcdctl mkdir /rws/registries
+etcdctl mkdir /rws/images
+etcdctl mkdir /rws/podstatus
+etcdctl mkdir /rws/services
+etcdctl mkdir /rws/ingresses
 docker-compose -f docker-compose.yml up -d
 s(){
-    scp docker-compose.yml pi$1:~/
+    scp docker-compose.yml secret.key pi$1:~/
     ssh pi$1 docker-compose -f docker-compose.yml down --remove-orphans
     ssh pi$1 docker pull loqutus/rws
     ssh pi$1 docker-compose -f docker-compose.yml up -d
@@ -6,6 +6,7 @@ docker build . -t rws
 docker tag rws loqutus/rws
 docker push loqutus/rws
 docker container prune -f
+[ -f secret.key ] || openssl rand -hex 32 > secret.key
 docker-compose down --remove-orphans
 docker-compose  -f docker-compose-etcd.yml down --remove-orphans
 docker-compose  -f docker-compose-etcd.yml up -d
@@ -16,9 +17,16 @@ etcdctl mkdir /rws/hosts
 etcdctl mkdir /rws/pods
 etcdctl mkdir /rws/containers
 etcdctl mkdir /rws/storage
+etcdctl mkdir /rws/quotas
+etcdctl mkdir /rws/secrets
+etcdctl mkdir /rws/registries
+etcdctl mkdir /rws/images
+etcdctl mkdir /rws/podstatus
+etcdctl mkdir /rws/services
+etcdctl mkdir /rws/ingresses
 docker-compose up -d
 for i in $(seq 2 5); do
-    scp docker-compose.yml pi$i:~/ &
+    scp docker-compose.yml secret.key pi$i:~/ &
 done
 wait
 for i in $(seq 2 5); do
@@ -8,6 +8,7 @@ docker build -f build/package/Dockerfile-local . -t rws-local
 docker tag rws-local loqutus/rws-local
 docker container prune -f
 cd deployments
+[ -f secret.key ] || openssl rand -hex 32 > secret.key
 docker-compose -f docker-compose-local.yml down --remove-orphans
 docker-compose -f docker-compose-local.yml up -d
 sleep 1
@@ -16,6 +17,13 @@ etcdctl mkdir /rws/hosts
 etcdctl mkdir /rws/pods
 etcdctl mkdir /rws/containers
 etcdctl mkdir /rws/storage
+etcdctl mkdir /rws/quotas
+etcdctl mkdir /rws/secrets
+etcdctl mkdir /rws/registries
+etcdctl mkdir /rws/images
+etcdctl mkdir /rws/podstatus
+etcdctl mkdir /rws/services
+etcdctl mkdir /rws/ingresses
 cd ../cmd/client
 go test
 cd ../../scripts/